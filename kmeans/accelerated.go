@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// assigner finds the closest centroid of every point, -1 for a point outside the threshold of every centroid
+type assigner interface {
+	nearest(clusters []Cluster, points []Point) []int
+}
+
+// lloyd measures the distance from every point to every centroid
+type lloyd struct{}
+
+func (lloyd) nearest(clusters []Cluster, points []Point) []int {
+
+	nearest := make([]int, len(points))
+	forBlocks(len(points), func(b int, start int, end int) {
+		distances := make([]float64, len(clusters)) // Ceate a distances slice
+		for p := start; p < end; p++ {
+			for i, cluster := range clusters {
+				distances[i] = distanceMetric.distance(cluster.centroid, points[p]) // Get the distance for each cluster centroid for the specified point and assign it in distances
+			}
+			nearest[p] = findLeastDistanceIndex(distances) // Assign the index containing the shortest distance, -1 for an outlier
+		}
+	})
+	return nearest
+}
+
+// elkan skips distances with the triangle inequality, keeping an upper bound on the distance of each point to its centroid
+// and a lower bound on its distance to every other centroid
+type elkan struct {
+	previous []Point     // Centroids of the last call, to know how far each one has moved since
+	assigned []int       // Closest centroid of each point, whatever the threshold
+	upper    []float64   // Upper bound on the distance of each point to its centroid
+	lower    [][]float64 // Lower bound on the distance of each point to each centroid
+}
+
+func (e *elkan) nearest(clusters []Cluster, points []Point) []int {
+
+	centroids := centroidsOf(clusters)
+	if len(e.previous) != len(centroids) || len(e.assigned) != len(points) { // First call, or a cluster was dropped
+		e.assigned = make([]int, len(points))
+		e.upper = make([]float64, len(points))
+		e.lower = make([][]float64, len(points))
+		forBlocks(len(points), func(b int, start int, end int) {
+			for p := start; p < end; p++ {
+				e.lower[p] = make([]float64, len(centroids))
+				for c, centroid := range centroids {
+					e.lower[p][c] = distanceMetric.distance(centroid, points[p])
+				}
+				e.assigned[p] = closest(e.lower[p])
+				e.upper[p] = e.lower[p][e.assigned[p]]
+			}
+		})
+		e.previous = clonePoints(centroids)
+		return applyThreshold(e.assigned, centroids, points)
+	}
+
+	drift := centroidDrift(e.previous, centroids)
+	between, separation := centroidDistances(centroids)
+
+	forBlocks(len(points), func(b int, start int, end int) {
+		for p := start; p < end; p++ {
+
+			// Loosen the bounds by how far the centroids moved
+			a := e.assigned[p]
+			u := e.upper[p] + drift[a]
+			for c := range centroids {
+				e.lower[p][c] = math.Max(e.lower[p][c]-drift[c], 0)
+			}
+
+			// Strictly closer to its centroid than to halfway to any other, so no other centroid can be as close
+			if u < separation[a] {
+				e.upper[p] = u
+				continue
+			}
+
+			tight := false
+			for c := range centroids {
+				if c == a || u < e.lower[p][c] || u < between[a][c]/2 {
+					continue
+				}
+				if !tight {
+					u = distanceMetric.distance(centroids[a], points[p])
+					e.lower[p][a] = u
+					tight = true
+					if u < e.lower[p][c] || u < between[a][c]/2 {
+						continue
+					}
+				}
+
+				distance := distanceMetric.distance(centroids[c], points[p])
+				e.lower[p][c] = distance
+				if distance < u || (distance == u && c < a) { // Ties go to the first centroid, as in lloyd
+					a, u = c, distance
+				}
+			}
+
+			e.assigned[p] = a
+			e.upper[p] = u
+		}
+	})
+
+	e.previous = clonePoints(centroids)
+	return applyThreshold(e.assigned, centroids, points)
+}
+
+// hamerly skips distances with the triangle inequality, keeping an upper bound on the distance of each point to its centroid
+// and a single lower bound on its distance to every other centroid, which needs less memory than elkan for many clusters
+type hamerly struct {
+	previous []Point   // Centroids of the last call, to know how far each one has moved since
+	assigned []int     // Closest centroid of each point, whatever the threshold
+	upper    []float64 // Upper bound on the distance of each point to its centroid
+	lower    []float64 // Lower bound on the distance of each point to its second closest centroid
+}
+
+func (h *hamerly) nearest(clusters []Cluster, points []Point) []int {
+
+	centroids := centroidsOf(clusters)
+	if len(h.previous) != len(centroids) || len(h.assigned) != len(points) { // First call, or a cluster was dropped
+		h.assigned = make([]int, len(points))
+		h.upper = make([]float64, len(points))
+		h.lower = make([]float64, len(points))
+		forBlocks(len(points), func(b int, start int, end int) {
+			distances := make([]float64, len(centroids))
+			for p := start; p < end; p++ {
+				h.assigned[p], h.upper[p], h.lower[p] = closestTwo(centroids, points[p], distances)
+			}
+		})
+		h.previous = clonePoints(centroids)
+		return applyThreshold(h.assigned, centroids, points)
+	}
+
+	drift := centroidDrift(h.previous, centroids)
+	_, separation := centroidDistances(centroids)
+
+	// The largest and second largest drift, so each point can use the largest drift of the centroids other than its own
+	largest, second := -1, -1
+	for c := range drift {
+		if largest == -1 || drift[c] > drift[largest] {
+			largest, second = c, largest
+		} else if second == -1 || drift[c] > drift[second] {
+			second = c
+		}
+	}
+
+	forBlocks(len(points), func(b int, start int, end int) {
+		distances := make([]float64, len(centroids))
+		for p := start; p < end; p++ {
+
+			// Loosen the bounds by how far the centroids moved
+			a := h.assigned[p]
+			h.upper[p] += drift[a]
+			if len(centroids) > 1 {
+				if a == largest {
+					h.lower[p] -= drift[second]
+				} else {
+					h.lower[p] -= drift[largest]
+				}
+			}
+
+			bound := math.Max(separation[a], h.lower[p])
+			if h.upper[p] < bound {
+				continue
+			}
+			h.upper[p] = distanceMetric.distance(centroids[a], points[p])
+			if h.upper[p] < bound {
+				continue
+			}
+
+			h.assigned[p], h.upper[p], h.lower[p] = closestTwo(centroids, points[p], distances)
+		}
+	})
+
+	h.previous = clonePoints(centroids)
+	return applyThreshold(h.assigned, centroids, points)
+}
+
+// newAssigner creates the named way of finding the closest centroids
+func newAssigner(name string) (assigner, error) {
+	switch name {
+	case "lloyd":
+		return lloyd{}, nil
+	case "elkan", "hamerly":
+		switch distanceMetric.(type) {
+		case squaredEuclidean, cosine: // The triangle inequality doesn't hold for these
+			return nil, fmt.Errorf("%s needs a distance that obeys the triangle inequality, not %s", name, metricName)
+		}
+		if name == "elkan" {
+			return &elkan{}, nil
+		}
+		return &hamerly{}, nil
+	}
+	return nil, fmt.Errorf("unknown algorithm %q, use lloyd, elkan or hamerly", name)
+}
+
+// applyThreshold gives back the closest centroids, with -1 for points farther than the threshold from their closest centroid
+func applyThreshold(assigned []int, centroids []Point, points []Point) []int {
+
+	if threshold == 0 {
+		return append([]int(nil), assigned...)
+	}
+
+	nearest := make([]int, len(points))
+	forBlocks(len(points), func(b int, start int, end int) {
+		for p := start; p < end; p++ {
+			nearest[p] = assigned[p]
+			if threshold < 0 || distanceMetric.distance(centroids[assigned[p]], points[p]) > threshold {
+				nearest[p] = -1
+			}
+		}
+	})
+	return nearest
+}
+
+// closest finds the index of the smallest distance, the first one on a tie
+func closest(distances []float64) int {
+	index := 0
+	for c, distance := range distances {
+		if distance < distances[index] {
+			index = c
+		}
+	}
+	return index
+}
+
+// closestTwo measures the distance of the point to every centroid, giving back the closest centroid, its distance
+// and the distance of the second closest
+func closestTwo(centroids []Point, point Point, distances []float64) (int, float64, float64) {
+
+	for c, centroid := range centroids {
+		distances[c] = distanceMetric.distance(centroid, point)
+	}
+	a := closest(distances)
+
+	second := math.Inf(1)
+	for c, distance := range distances {
+		if c != a && distance < second {
+			second = distance
+		}
+	}
+	return a, distances[a], second
+}
+
+// centroidDrift is how far each centroid moved
+func centroidDrift(previous []Point, centroids []Point) []float64 {
+	drift := make([]float64, len(centroids))
+	for c := range centroids {
+		drift[c] = distanceMetric.distance(previous[c], centroids[c])
+	}
+	return drift
+}
+
+// centroidDistances measures the distance between every 2 centroids, and half the distance of each centroid to its closest other
+func centroidDistances(centroids []Point) ([][]float64, []float64) {
+
+	between := make([][]float64, len(centroids))
+	separation := make([]float64, len(centroids))
+	for i := range centroids {
+		between[i] = make([]float64, len(centroids))
+	}
+	for i := range centroids {
+		separation[i] = math.Inf(1)
+		for j := range centroids {
+			if i == j {
+				continue
+			}
+			if j > i {
+				between[i][j] = distanceMetric.distance(centroids[i], centroids[j])
+				between[j][i] = between[i][j]
+			}
+			separation[i] = math.Min(separation[i], between[i][j]/2)
+		}
+	}
+	return between, separation
+}
+
+// centroidsOf gathers the centroids of the clusters
+func centroidsOf(clusters []Cluster) []Point {
+	centroids := make([]Point, len(clusters))
+	for i, cluster := range clusters {
+		centroids[i] = cluster.centroid
+	}
+	return centroids
+}
+
+// clonePoints copies every point
+func clonePoints(points []Point) []Point {
+	clones := make([]Point, len(points))
+	for i, point := range points {
+		clones[i] = clonePoint(point)
+	}
+	return clones
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"testing"
+)
+
+func TestAcceleratedMatchesLloyd(t *testing.T) {
+
+	defer func(metric metric, name string, limit float64) {
+		distanceMetric, metricName, threshold = metric, name, limit
+	}(distanceMetric, metricName, threshold)
+
+	for _, name := range []string{"euclidean", "manhattan", "chebyshev", "minkowski", "mahalanobis"} {
+		for _, limit := range []float64{0, 4} {
+			for seed := int64(1); seed <= 3; seed++ {
+				t.Run(fmt.Sprintf("%s/threshold=%g/seed=%d", name, limit, seed), func(t *testing.T) {
+
+					r1 := rand.New(rand.NewSource(seed))
+					points := blobs(1000, 6, 3, r1)
+					var err error
+					metricName, threshold = name, limit
+					if distanceMetric, err = newMetric(name, 3, points); err != nil {
+						t.Fatal(err)
+					}
+					start, err := seedClusters(points, 6, "forgy", r1)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					fit := func(solver assigner) ([][]int, []Cluster) {
+						var assignments [][]int
+						clusters := start
+						for i := 0; i < 15; i++ {
+							nearest := solver.nearest(clusters, points)
+							assignments = append(assignments, nearest)
+							clusters = updateCentroid(assignPoints(clusters, points, nearest))
+						}
+						return assignments, clusters
+					}
+
+					lloydAssignments, lloydClusters := fit(lloyd{})
+					for _, solverName := range []string{"elkan", "hamerly"} {
+						solver, err := newAssigner(solverName)
+						if err != nil {
+							t.Fatal(err)
+						}
+						assignments, clusters := fit(solver)
+						for i := range assignments {
+							for p := range assignments[i] {
+								if assignments[i][p] != lloydAssignments[i][p] {
+									t.Fatalf("%s: iteration %d puts point %d in cluster %d, lloyd %d", solverName, i, p, assignments[i][p], lloydAssignments[i][p])
+								}
+							}
+						}
+						if !sameCentroids(lloydClusters, clusters) {
+							t.Errorf("%s: centroids %v differ from lloyd's %v", solverName, centroidsOf(clusters), centroidsOf(lloydClusters))
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestAcceleratedNeedsTriangleInequality(t *testing.T) {
+
+	defer func(metric metric, name string) { distanceMetric, metricName = metric, name }(distanceMetric, metricName)
+
+	for _, name := range []string{"sqeuclidean", "cosine"} {
+		metricName = name
+		distanceMetric, _ = newMetric(name, 3, nil)
+		for _, solver := range []string{"elkan", "hamerly"} {
+			if _, err := newAssigner(solver); err == nil {
+				t.Errorf("%s accepted %s distance", solver, name)
+			}
+		}
+	}
+}
+
+func BenchmarkSolvers(b *testing.B) {
+
+	defer func(w int) { workers = w }(workers)
+	workers = runtime.NumCPU()
+
+	for _, size := range benchmarkSizes {
+		for _, name := range []string{"lloyd", "elkan", "hamerly"} {
+			b.Run(fmt.Sprintf("points=%d/%s", size, name), func(b *testing.B) {
+				points, clusters := benchmarkData(b, size)
+				solver, err := newAssigner(name)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				// Each iteration goes on from the last, so elkan and hamerly make up for their first full scan
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					clusters = updateCentroid(assignPoints(clusters, points, solver.nearest(clusters, points)))
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// metric measures how far apart points are, and where the center of a cluster is under that measure
+type metric interface {
+	distance(p1 Point, p2 Point) float64 // Distance between 2 points, the one compared with the threshold
+	cost(p1 Point, p2 Point) float64     // What a point adds to the inertia, smallest for the same centroid as distance
+	center(points []Point) Point         // Centroid keeping the cost of the points lowest
+}
+
+// euclidean is the straight line distance, with the mean as the center
+type euclidean struct{}
+
+func (euclidean) distance(p1 Point, p2 Point) float64 { return findDistance(p1, p2) }
+func (euclidean) cost(p1 Point, p2 Point) float64     { return squaredDistance(p1, p2) }
+func (euclidean) center(points []Point) Point         { return meanPoint(points) }
+
+// squaredEuclidean is the squared straight line distance, with the mean as the center
+type squaredEuclidean struct{}
+
+func (squaredEuclidean) distance(p1 Point, p2 Point) float64 { return squaredDistance(p1, p2) }
+func (squaredEuclidean) cost(p1 Point, p2 Point) float64     { return squaredDistance(p1, p2) }
+func (squaredEuclidean) center(points []Point) Point         { return meanPoint(points) }
+
+// manhattan is the sum of the absolute differences, with the median of each coordinate as the center (k-medians)
+type manhattan struct{}
+
+func (manhattan) distance(p1 Point, p2 Point) float64 {
+	sum := 0.0
+	for d := range p1 {
+		sum += math.Abs(p1[d] - p2[d])
+	}
+	return sum
+}
+
+func (m manhattan) cost(p1 Point, p2 Point) float64 { return m.distance(p1, p2) }
+func (manhattan) center(points []Point) Point       { return medianPoint(points) }
+
+// chebyshev is the largest absolute difference of any coordinate, with the midrange of each coordinate as the center,
+// which keeps the farthest point of the cluster as close as possible rather than the total cost lowest
+type chebyshev struct{}
+
+func (chebyshev) distance(p1 Point, p2 Point) float64 {
+	largest := 0.0
+	for d := range p1 {
+		largest = math.Max(largest, math.Abs(p1[d]-p2[d]))
+	}
+	return largest
+}
+
+func (c chebyshev) cost(p1 Point, p2 Point) float64 { return math.Pow(c.distance(p1, p2), 2) }
+func (chebyshev) center(points []Point) Point       { return midrangePoint(points) }
+
+// minkowski is the p-th root of the sum of the absolute differences to the power p, p of 1 being manhattan and 2 euclidean
+type minkowski struct {
+	p float64
+}
+
+func (m minkowski) distance(p1 Point, p2 Point) float64 { return math.Pow(m.cost(p1, p2), 1/m.p) }
+
+func (m minkowski) cost(p1 Point, p2 Point) float64 {
+	sum := 0.0
+	for d := range p1 {
+		sum += math.Pow(math.Abs(p1[d]-p2[d]), m.p)
+	}
+	return sum
+}
+
+// center minimizes the sum of |x - c|^p separately for each coordinate, bisecting on its derivative, which grows with c
+func (m minkowski) center(points []Point) Point {
+
+	center := make(Point, len(points[0]))
+	for d := range center {
+		low, high := points[0][d], points[0][d]
+		for _, point := range points {
+			low = math.Min(low, point[d])
+			high = math.Max(high, point[d])
+		}
+
+		for step := 0; step < 60 && high-low > 1e-12*(1+math.Abs(low)); step++ {
+			middle := (low + high) / 2
+			slope := 0.0
+			for _, point := range points {
+				difference := middle - point[d]
+				if difference != 0 {
+					slope += math.Copysign(math.Pow(math.Abs(difference), m.p-1), difference)
+				}
+			}
+			if slope > 0 {
+				high = middle
+			} else {
+				low = middle
+			}
+		}
+		center[d] = (low + high) / 2
+	}
+	return center
+}
+
+// cosine is 1 minus the cosine similarity, with the normalized mean as the center (spherical k-means)
+type cosine struct{}
+
+func (cosine) distance(p1 Point, p2 Point) float64 {
+	dot, norm1, norm2 := 0.0, 0.0, 0.0
+	for d := range p1 {
+		dot += p1[d] * p2[d]
+		norm1 += p1[d] * p1[d]
+		norm2 += p2[d] * p2[d]
+	}
+	if norm1 == 0 || norm2 == 0 { // A zero vector points nowhere
+		return 1
+	}
+	return 1 - dot/math.Sqrt(norm1*norm2)
+}
+
+func (c cosine) cost(p1 Point, p2 Point) float64 { return c.distance(p1, p2) }
+
+func (cosine) center(points []Point) Point {
+
+	// Add up the unit vectors, so long points don't outweigh short ones
+	sum := make(Point, len(points[0]))
+	for _, point := range points {
+		norm := math.Sqrt(squaredDistance(point, make(Point, len(point))))
+		if norm == 0 {
+			continue
+		}
+		for d, value := range point {
+			sum[d] += value / norm
+		}
+	}
+
+	norm := math.Sqrt(squaredDistance(sum, make(Point, len(sum))))
+	if norm == 0 { // The points cancel out, any direction is as good
+		return meanPoint(points)
+	}
+	for d := range sum {
+		sum[d] /= norm
+	}
+	return sum
+}
+
+// mahalanobis is the euclidean distance after scaling by the inverse covariance of all the points, with the mean as the center
+type mahalanobis struct {
+	inverse [][]float64 // Inverse of the covariance matrix
+}
+
+// newMahalanobis inverts the covariance of the points, with a little added to the diagonal so it always has an inverse
+func newMahalanobis(points []Point) (mahalanobis, error) {
+
+	if len(points) == 0 {
+		return mahalanobis{}, fmt.Errorf("mahalanobis distance needs the points up front for their covariance, so it can't be streamed")
+	}
+
+	mean := meanPoint(points)
+	n := len(mean)
+	covariance := make([][]float64, n)
+	for i := range covariance {
+		covariance[i] = make([]float64, n)
+	}
+	for _, point := range points {
+		for i := range point {
+			for j := range point {
+				covariance[i][j] += (point[i] - mean[i]) * (point[j] - mean[j])
+			}
+		}
+	}
+
+	trace := 0.0
+	for i := range covariance {
+		for j := range covariance[i] {
+			covariance[i][j] /= float64(len(points))
+		}
+		trace += covariance[i][i]
+	}
+	ridge := 1e-9 * (trace/float64(n) + 1)
+	for i := range covariance {
+		covariance[i][i] += ridge
+	}
+
+	inverse, err := invert(covariance)
+	if err != nil {
+		return mahalanobis{}, fmt.Errorf("mahalanobis distance: %v", err)
+	}
+	return mahalanobis{inverse: inverse}, nil
+}
+
+func (m mahalanobis) distance(p1 Point, p2 Point) float64 { return math.Sqrt(m.cost(p1, p2)) }
+
+func (m mahalanobis) cost(p1 Point, p2 Point) float64 {
+	sum := 0.0
+	for i := range p1 {
+		row := 0.0
+		for j := range p2 {
+			row += m.inverse[i][j] * (p1[j] - p2[j])
+		}
+		sum += (p1[i] - p2[i]) * row
+	}
+	return math.Max(sum, 0)
+}
+
+func (mahalanobis) center(points []Point) Point { return meanPoint(points) }
+
+// newMetric creates the named metric, p being the power for minkowski and points the data for mahalanobis
+func newMetric(name string, p float64, points []Point) (metric, error) {
+	switch name {
+	case "euclidean":
+		return euclidean{}, nil
+	case "sqeuclidean":
+		return squaredEuclidean{}, nil
+	case "manhattan":
+		return manhattan{}, nil
+	case "chebyshev":
+		return chebyshev{}, nil
+	case "minkowski":
+		if p < 1 {
+			return nil, fmt.Errorf("minkowski needs a power p of at least 1, got %g", p)
+		}
+		return minkowski{p: p}, nil
+	case "cosine":
+		return cosine{}, nil
+	case "mahalanobis":
+		return newMahalanobis(points)
+	}
+	return nil, fmt.Errorf("unknown metric %q, use euclidean, sqeuclidean, manhattan, chebyshev, minkowski, cosine or mahalanobis", name)
+}
+
+// medianPoint finds the median of each coordinate of the points
+func medianPoint(points []Point) Point {
+	median := make(Point, len(points[0]))
+	values := make([]float64, len(points))
+	for d := range median {
+		for i, point := range points {
+			values[i] = point[d]
+		}
+		sort.Float64s(values)
+		if len(values)%2 == 1 {
+			median[d] = values[len(values)/2]
+		} else {
+			median[d] = (values[len(values)/2-1] + values[len(values)/2]) / 2
+		}
+	}
+	return median
+}
+
+// midrangePoint finds the point halfway between the smallest and largest value of each coordinate of the points
+func midrangePoint(points []Point) Point {
+	low := clonePoint(points[0])
+	high := clonePoint(points[0])
+	for _, point := range points {
+		for d, value := range point {
+			low[d] = math.Min(low[d], value)
+			high[d] = math.Max(high[d], value)
+		}
+	}
+	for d := range low {
+		low[d] = (low[d] + high[d]) / 2
+	}
+	return low
+}
+
+// invert finds the inverse of a square matrix by Gauss-Jordan elimination with partial pivoting
+func invert(matrix [][]float64) ([][]float64, error) {
+
+	n := len(matrix)
+	a := make([][]float64, n) // The matrix with the identity to its right
+	for i := range a {
+		a[i] = make([]float64, 2*n)
+		copy(a[i], matrix[i])
+		a[i][n+i] = 1
+	}
+
+	for column := 0; column < n; column++ {
+		pivot := column
+		for row := column + 1; row < n; row++ {
+			if math.Abs(a[row][column]) > math.Abs(a[pivot][column]) {
+				pivot = row
+			}
+		}
+		if a[pivot][column] == 0 {
+			return nil, fmt.Errorf("the matrix has no inverse")
+		}
+		a[column], a[pivot] = a[pivot], a[column]
+
+		scale := a[column][column]
+		for j := range a[column] {
+			a[column][j] /= scale
+		}
+		for row := range a {
+			if row == column || a[row][column] == 0 {
+				continue
+			}
+			factor := a[row][column]
+			for j := range a[row] {
+				a[row][j] -= factor * a[column][j]
+			}
+		}
+	}
+
+	inverse := make([][]float64, n)
+	for i := range inverse {
+		inverse[i] = a[i][n:]
+	}
+	return inverse, nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestChebyshevCenter(t *testing.T) {
+
+	points := []Point{{0, 0}, {1, 8}, {2, 1}, {10, 2}}
+	center := chebyshev{}.center(points)
+	if want := (Point{5, 4}); squaredDistance(center, want) != 0 {
+		t.Fatalf("center is %v, want %v", center, want)
+	}
+
+	// No other point is closer to the farthest of the points
+	farthest := func(c Point) float64 {
+		largest := 0.0
+		for _, point := range points {
+			if d := (chebyshev{}).distance(point, c); d > largest {
+				largest = d
+			}
+		}
+		return largest
+	}
+	r1 := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		other := Point{center[0] + r1.NormFloat64(), center[1] + r1.NormFloat64()}
+		if farthest(other) < farthest(center) {
+			t.Fatalf("%v is %g from its farthest point, closer than the center's %g", other, farthest(other), farthest(center))
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// emptyStrategies are the ways to deal with a cluster left without points, chosen with -empty
+var emptyStrategies = map[string]func(clusters []Cluster, empty int) []Cluster{
+	"farthest": reseedFarthest,
+	"split":    splitLargest,
+	"drop":     dropEmpty,
+}
+
+// checkEmptyStrategy makes sure the empty cluster strategy exists
+func checkEmptyStrategy(name string) error {
+	if _, ok := emptyStrategies[name]; !ok {
+		return fmt.Errorf("unknown empty cluster strategy %q, use farthest, split or drop", name)
+	}
+	return nil
+}
+
+// reseedFarthest moves the point farthest from its own centroid into the empty cluster, which is centered on it
+func reseedFarthest(clusters []Cluster, empty int) []Cluster {
+
+	donor, farthest, distance := -1, -1, -1.0
+	for i, cluster := range clusters {
+		if len(cluster.points) < 2 { // Taking its only point would just empty another cluster
+			continue
+		}
+		for j, point := range cluster.points {
+			if d := distanceMetric.cost(point, cluster.centroid); d > distance {
+				donor, farthest, distance = i, j, d
+			}
+		}
+	}
+	if donor == -1 { // No cluster can spare a point, the centroid stays where it was
+		return clusters
+	}
+
+	point := clusters[donor].points[farthest]
+	clusters[donor].points = removePoint(clusters[donor].points, farthest)
+	clusters[empty].points = []Point{point}
+	clusters[empty].centroid = clonePoint(point)
+	return clusters
+}
+
+// splitLargest splits the cluster with the most points in two along its coordinate with the largest variance,
+// the points above the mean of that coordinate going to the empty cluster
+func splitLargest(clusters []Cluster, empty int) []Cluster {
+
+	largest := -1
+	for i, cluster := range clusters {
+		if len(cluster.points) >= 2 && (largest == -1 || len(cluster.points) > len(clusters[largest].points)) {
+			largest = i
+		}
+	}
+	if largest == -1 { // No cluster has points to split, the centroid stays where it was
+		return clusters
+	}
+
+	points := clusters[largest].points
+	mean := meanPoint(points)
+	widest, variance := 0, -1.0
+	for d := range mean {
+		sum := 0.0
+		for _, point := range points {
+			sum += (point[d] - mean[d]) * (point[d] - mean[d])
+		}
+		if sum > variance {
+			widest, variance = d, sum
+		}
+	}
+	if variance == 0 { // Every point is the same, there is nothing to split
+		return clusters
+	}
+
+	var below, above []Point
+	for _, point := range points {
+		if point[widest] > mean[widest] {
+			above = append(above, point)
+		} else {
+			below = append(below, point)
+		}
+	}
+
+	clusters[largest].points = below
+	clusters[largest].centroid = distanceMetric.center(below)
+	clusters[empty].points = above
+	clusters[empty].centroid = distanceMetric.center(above)
+	return clusters
+}
+
+// dropEmpty removes the empty cluster, leaving one cluster fewer
+func dropEmpty(clusters []Cluster, empty int) []Cluster {
+	log.Printf("Warning: dropping empty cluster %d, %d clusters left", empty+1, len(clusters)-1)
+	return append(clusters[:empty:empty], clusters[empty+1:]...)
+}
+
+// removePoint returns a copy of the points without the one at index i
+func removePoint(points []Point, i int) []Point {
+	return append(append(make([]Point, 0, len(points)-1), points[:i]...), points[i+1:]...)
+}
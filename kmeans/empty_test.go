@@ -0,0 +1,53 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEmptyStrategies(t *testing.T) {
+
+	// A tight cluster around (1, 1) and a wider one around (11, 1) with an outlier at (11, 10)
+	points := []Point{
+		{0, 0}, {0, 2}, {2, 0}, {2, 2},
+		{10, 0}, {10, 2}, {12, 0}, {12, 2}, {11, 10},
+	}
+
+	for _, test := range []struct {
+		strategy  string
+		centroids []Point
+		sizes     []int
+	}{
+		// The outlier is the point farthest from its centroid, so it reseeds the empty cluster
+		{"farthest", []Point{{11, 10}, {1, 1}, {11, 1}}, []int{1, 4, 4}},
+		// The wide cluster is the largest and splits along y, the outlier being the only point above the mean
+		{"split", []Point{{11, 10}, {1, 1}, {11, 1}}, []int{1, 4, 4}},
+		{"drop", []Point{{1, 1}, {11, 2.8}}, []int{4, 5}},
+	} {
+		t.Run(test.strategy, func(t *testing.T) {
+
+			defer func(strategy string) { emptyCluster = strategy }(emptyCluster)
+			emptyCluster = test.strategy
+
+			// The first centroid is outside the data, as range seeding can place it, so its cluster gets no points.
+			// The others start away from their means so any cluster left without an update shows.
+			clusters := []Cluster{{centroid: Point{100, 100}}, {centroid: Point{0, 0}}, {centroid: Point{10, 0}}}
+			clusters = updateCentroid(updateClusters(clusters, points))
+
+			if len(clusters) != len(test.centroids) {
+				t.Fatalf("%d clusters, want %d", len(clusters), len(test.centroids))
+			}
+			for i, cluster := range clusters {
+				if len(cluster.points) != test.sizes[i] {
+					t.Errorf("cluster %d has %d points, want %d", i, len(cluster.points), test.sizes[i])
+				}
+				for d := range cluster.centroid {
+					if math.Abs(cluster.centroid[d]-test.centroids[i][d]) > 1e-9 {
+						t.Errorf("cluster %d centroid is %v, want %v", i, cluster.centroid, test.centroids[i])
+						break
+					}
+				}
+			}
+		})
+	}
+}
@@ -1,10 +1,18 @@
 // ================================================================================
 //
 // kmeans.go
-// Provides a set of clusters based on a set of a randomized points
+// Provides a set of clusters based on a set of randomized points, or points of any dimension loaded from a CSV file
 //
 // Usage:
-// go run kmeans.go [numberOfPoints] [numberOfClusters] [iterations] [rangeMin] [rangeMax] [threshold]
+// go run . [-init kmeans++|kmeans|||forgy|random|partition|range] [-n-init 1] [-empty farthest|split|drop] [-metric euclidean] [-p 3] [-tol 1e-4] [-inertia-tol 1e-6] [-batch-size 0] [-stream] [-passes 1] [-workers 0] [-algorithm lloyd|elkan|hamerly] [-seed 0]
+// then answer the prompts for the points, clusters, iterations, threshold and file name, or
+// go run . -select-k [-k-min 1] [-k-max 10] [-gap-refs 10] [-silhouette-sample 1000] [-curves curves.csv] with the same options
+// and prompts, less the clusters, to recommend a number of clusters
+//
+// The file can be any CSV of coordinates, such as blobs from the neural network's generator, run from ../neural-net:
+// nn generate -kind blobs -features 2 -classes 3 -labels none -seed 1 -out ../kmeans/points.csv
+//
+// go test -bench . times the solvers on 100,000 to 10,000,000 random points (-short skips the largest)
 //
 // ================================================================================
 
@@ -13,21 +21,21 @@ package main
 import (
 	"bufio"
 	"encoding/csv"
+	"flag"
 	"fmt"
 	"log"
 	"math"
 	"math/rand"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-// Point stuct
-type Point struct {
-	x float64
-	y float64
-}
+// Point stuct, holding one coordinate for each dimension
+type Point []float64
 
 // Cluster struct
 type Cluster struct {
@@ -39,14 +47,67 @@ type Cluster struct {
 var (
 	numberOfPoints   = 5     // Number of points to use
 	numberOfClusters = 3     // Number of clusters desired
+	dimensions       = 2     // Number of coordinates in each random point (points from a file have as many as its columns)
 	iteratoins       = 5     // Number of iterations before stopping
 	rangeMin         = 0     // Minimum value for a point using random number generator
 	rangeMax         = 10    // Maximum value for a point using random number generator
 	threshold        float64 // The threshold for points to be considered within a cluster
+	seeding          = "kmeans++"
+	restartCount     = 1 // Number of runs from different seedings, keeping the one with the lowest inertia
+	emptyCluster     = "farthest"
+	metricName       = "euclidean"
+	minkowskiPower   = 3.0
+	tolerance        = 1e-4 // Largest centroid shift that counts as converged
+	inertiaTolerance = 1e-6 // Smallest relative change of the inertia that keeps the iterations going
+	batchSize        = 0    // Points in each mini-batch, 0 for the whole set every iteration
+	streaming        = false
+	passes           = 1 // Times a streamed file is read through
+	workers          = 0 // Goroutines sharing the assignment and the sums
+	algorithm        = "lloyd"
+	seed             int64
+)
+
+// distanceMetric measures distances and places centroids
+var distanceMetric metric = euclidean{}
+
+// Reasons for a run to stop
+const (
+	stoppedShift      = "centroids moved less than the tolerance"
+	stoppedInertia    = "inertia changed less than the tolerance"
+	stoppedIterations = "ran out of iterations"
 )
 
 func main() {
 
+	flag.StringVar(&seeding, "init", seeding, "centroid seeding: kmeans++, kmeans|| (parallel), forgy (random points), random (random coordinates within the points), partition (means of a random partition) or range (random integers in the range)")
+	flag.IntVar(&restartCount, "n-init", restartCount, "number of runs from different seedings, run concurrently, keeping the one with the lowest inertia")
+	flag.StringVar(&emptyCluster, "empty", emptyCluster, "what to do with a cluster left without points: farthest (move the point farthest from its centroid into it), split (split the largest cluster) or drop (remove it with a warning), at the end of each pass with -batch-size")
+	flag.StringVar(&metricName, "metric", metricName, "distance: euclidean, sqeuclidean, manhattan (k-medians), chebyshev, minkowski, cosine (spherical k-means) or mahalanobis")
+	flag.Float64Var(&minkowskiPower, "p", minkowskiPower, "power of the minkowski distance")
+	flag.Float64Var(&tolerance, "tol", tolerance, "stop once no centroid moves farther than this")
+	flag.Float64Var(&inertiaTolerance, "inertia-tol", inertiaTolerance, "stop once the inertia changes by less than this fraction of itself (0 to never stop on it)")
+	flag.IntVar(&batchSize, "batch-size", batchSize, "fit mini-batch k-means on this many points an iteration (0 to use every point)")
+	flag.BoolVar(&streaming, "stream", streaming, "read the file a mini-batch at a time instead of all at once, for files too big to hold")
+	flag.IntVar(&passes, "passes", passes, "times to read through a streamed file")
+	flag.IntVar(&workers, "workers", workers, "goroutines sharing the assignment of points and the centroid sums, the results being the same for any number (0 for one per CPU)")
+	flag.StringVar(&algorithm, "algorithm", algorithm, "how to find the closest centroids: lloyd (every distance), elkan or hamerly (skipping distances with the triangle inequality, same results)")
+	flag.Int64Var(&seed, "seed", 0, "random seed for the points and the seeding, run i uses seed+i (0 for the time)")
+	selectClusters := flag.Bool("select-k", false, "recommend a number of clusters instead of clustering, skipping its prompt")
+	kMin := flag.Int("k-min", 1, "smallest number of clusters to try")
+	kMax := flag.Int("k-max", 10, "largest number of clusters to try")
+	gapRefs := flag.Int("gap-refs", 10, "uniform reference sets for the gap statistic")
+	silhouetteSample := flag.Int("silhouette-sample", 1000, "points to average the silhouette over (0 for all of them)")
+	curves := flag.String("curves", "", "CSV file to save the inertia, silhouette, gap and BIC of each number of clusters to")
+	flag.Parse()
+
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	r1 := rand.New(rand.NewSource(seed))
+
 	// // // // // //
 	// TERMINAL INPUT
 
@@ -66,18 +127,20 @@ func main() {
 	}
 	numberOfPoints = num
 
-	// Ask for number of clusters
-	fmt.Print("Number of Clusters: ")
-	input, err = reader.ReadString('\n') // Get the input
-	if err != nil {
-		log.Fatal(err)
-	}
-	input = strings.TrimSpace(input) // Remove the '\n' delimiter
-	num, err = strconv.Atoi(input)   // Check to see if input is an int
-	if err != nil {
-		log.Fatal(err)
+	// Ask for number of clusters, unless it is to be picked
+	if !*selectClusters {
+		fmt.Print("Number of Clusters: ")
+		input, err = reader.ReadString('\n') // Get the input
+		if err != nil {
+			log.Fatal(err)
+		}
+		input = strings.TrimSpace(input) // Remove the '\n' delimiter
+		num, err = strconv.Atoi(input)   // Check to see if input is an int
+		if err != nil {
+			log.Fatal(err)
+		}
+		numberOfClusters = num
 	}
-	numberOfClusters = num
 
 	// Ask for iterations
 	fmt.Print("Number of Iterations: ")
@@ -118,120 +181,252 @@ func main() {
 
 	// // //
 
-	// Create points & clusters slices with a defined size
-	points := make([]Point, numberOfPoints)
-	clusters := make([]Cluster, numberOfClusters)
+	// Fit the clusters a mini-batch at a time as the file is read
+	if streaming {
+		if fileName == "none" || fileName == "" {
+			log.Fatal("streaming needs a file")
+		}
+		if distanceMetric, err = newMetric(metricName, minkowskiPower, nil); err != nil {
+			log.Fatal(err)
+		}
+		if err := streamClusters(fileName, numberOfClusters, passes, seed); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	// Initialize or load points & clusters with data
-	clusters = initClusters(clusters, rangeMin, rangeMax)
+	// Create points slice with a defined size
+	points := make([]Point, numberOfPoints)
 
+	// Initialize or load points, then seed the clusters from them
 	if fileName == "none" || fileName == "" {
-		points = initPoints(points, rangeMin, rangeMax)
+		points = initPoints(points, rangeMin, rangeMax, r1)
 	} else {
-		points = load(fileName, 2, points)
+		points = load(fileName)
+		numberOfPoints = len(points)
+		dimensions = len(points[0])
+	}
+
+	distanceMetric, err = newMetric(metricName, minkowskiPower, points)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Try a range of numbers of clusters and recommend one
+	if *selectClusters {
+		scores, k, err := selectK(points, *kMin, *kMax, *gapRefs, *silhouetteSample, seed)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if k == 0 {
+			fmt.Println("\nNo recommended number of clusters, try a wider range")
+		} else {
+			fmt.Printf("\nRecommended number of clusters: %d\n", k)
+		}
+		if *curves != "" {
+			if err := writeCurves(*curves, scores); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println("Curves saved to", *curves)
+		}
+		return
 	}
 
 	// Print some stuff
 	fmt.Println("Points:", points)
-	fmt.Println("Initial Clusters:", clusters)
 	fmt.Println()
 
-	// Loop through iterations
-	for i := iteratoins; i > 0; i-- {
+	// Run the whole clustering from several seedings and keep the tightest
+	results, err := restarts(points, numberOfClusters, restartCount, seed)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		previousClusters := clusters
+	for i, result := range results {
+		fmt.Printf("Run %d (seed %d): inertia %g after %d iterations, %s\n", i+1, result.seed, result.inertia, result.iterations, result.stopped)
+	}
+	best := bestRun(results)
+	clusters := results[best].clusters
+	fmt.Printf("Keeping run %d\n", best+1)
+	fmt.Println("Inertia after each iteration:", results[best].history)
+	fmt.Println()
+
+	// fmt.Println("Final clusters:", clusters)
+	fmt.Printf("%+v\n", clusters)
+
+	outliers := findOutliers(clusters, points)
+	fmt.Println("Outliers:", outliers)
+
+}
+
+// bestRun finds the run with the lowest inertia
+func bestRun(results []result) int {
+	best := 0
+	for i, result := range results {
+		if result.inertia < results[best].inertia {
+			best = i
+		}
+	}
+	return best
+}
+
+// result is the outcome of one run
+type result struct {
+	clusters   []Cluster
+	inertia    float64 // Sum of the costs of the points from their centroids
+	iterations int
+	stopped    string    // Why the iterations stopped
+	history    []float64 // Inertia after each iteration
+	seed       int64
+}
+
+// restarts runs the clustering n times concurrently, run i seeding its centroids with seed+i
+func restarts(points []Point, k int, n int, seed int64) ([]result, error) {
+
+	if n < 1 {
+		return nil, fmt.Errorf("need at least 1 run, got %d", n)
+	}
+	if err := checkEmptyStrategy(emptyCluster); err != nil {
+		return nil, err
+	}
+
+	results := make([]result, n)
+	errs := make([]error, n)
+
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = run(points, k, seed+int64(i))
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// run seeds k clusters and moves them until their centroids or the inertia settle, or the iterations run out
+func run(points []Point, k int, seed int64) (result, error) {
+
+	if batchSize > 0 {
+		return runMiniBatch(points, k, seed)
+	}
+
+	solver, err := newAssigner(algorithm)
+	if err != nil {
+		return result{}, err
+	}
+
+	r1 := rand.New(rand.NewSource(seed))
+	clusters, err := seedClusters(points, k, seeding, r1)
+	if err != nil {
+		return result{}, err
+	}
 
-		// fmt.Println("Iteratoins remain:", i) // Print iterations
+	outcome := result{stopped: stoppedIterations, seed: seed}
+	for outcome.iterations < iteratoins {
 
-		clusters = updateClusters(clusters, points)
-		// fmt.Println("Clusters:", clusters)
+		previousClusters := clusters
 
+		clusters = assignPoints(clusters, points, solver.nearest(clusters, points))
 		clusters = updateCentroid(clusters)
+		outcome.iterations++
+		outcome.history = append(outcome.history, inertia(clusters))
 
-		changedCentroids := 0
-		for i, cluster := range clusters {
-			if cluster.centroid == previousClusters[i].centroid {
-				changedCentroids++
-			}
-			fmt.Println("New cluster centroid:", cluster.centroid) // Print the new centroids
+		if len(clusters) < len(previousClusters) { // A cluster was dropped, keep going with the rest
+			continue
+		}
+
+		if centroidShift(clusters, previousClusters) <= tolerance {
+			outcome.stopped = stoppedShift
+			break
 		}
-		if changedCentroids == numberOfClusters {
-			fmt.Println("\nEnding iterations sooner due to unchanged centroids")
-			fmt.Println()
+		if n := len(outcome.history); n > 1 && math.Abs(outcome.history[n-2]-outcome.history[n-1]) <= inertiaTolerance*outcome.history[n-2] {
+			outcome.stopped = stoppedInertia
 			break
 		}
-
-		fmt.Println()
 	}
 
-	// fmt.Println("Final clusters:", clusters)
-	fmt.Printf("%+v\n", clusters)
+	// Assign the points to the final centroids
+	outcome.clusters = assignPoints(clusters, points, solver.nearest(clusters, points))
+	outcome.inertia = inertia(outcome.clusters)
+	return outcome, nil
+}
 
-	outliers := findOutliers(clusters, points)
-	fmt.Println("Outliers:", outliers)
+// centroidShift finds the farthest any centroid moved between 2 sets of the same clusters
+func centroidShift(clusters []Cluster, previousClusters []Cluster) float64 {
+	shift := 0.0
+	for i, cluster := range clusters {
+		shift = math.Max(shift, distanceMetric.distance(cluster.centroid, previousClusters[i].centroid))
+	}
+	return shift
+}
 
+// inertia adds up the costs of the points of each cluster from its centroid, their squared distances for euclidean
+func inertia(clusters []Cluster) float64 {
+	sum := 0.0
+	for _, cluster := range clusters {
+		for _, point := range cluster.points {
+			sum += distanceMetric.cost(point, cluster.centroid)
+		}
+	}
+	return sum
 }
 
 // initPoints sets a defined number of points randomly based on min and max values
-func initPoints(points []Point, min int, max int) []Point {
+func initPoints(points []Point, min int, max int, r1 *rand.Rand) []Point {
 
-	s1 := rand.NewSource(time.Now().UnixNano()) // Set randomization based on clock time
-	r1 := rand.New(s1)                          // Create a new rand
-
-	// Set the x and y coordinate for each point
-	for i, point := range points {
-		point.x = float64(r1.Intn(max+1-min) + min) // Assign a random value for x
-		point.y = float64(r1.Intn(max+1-min) + min) // Assign a random value for y
-		points[i] = point                           // Assign the point to the slice of points
+	// Set each coordinate of each point
+	for i := range points {
+		point := make(Point, dimensions)
+		for d := range point {
+			point[d] = float64(r1.Intn(max+1-min) + min) // Assign a random value for the coordinate
+		}
+		points[i] = point // Assign the point to the slice of points
 	}
 
 	return points
 }
 
 // initClusters sets a defined number of clusters randomly based on the min and max values (so that the clusters aren't too far from the points)
-func initClusters(clusters []Cluster, min int, max int) []Cluster {
+func initClusters(clusters []Cluster, min int, max int, r1 *rand.Rand) []Cluster {
 
-	s1 := rand.NewSource(time.Now().UnixNano()) // Set randomization based on clock time
-	r1 := rand.New(s1)                          // Create a new rand
-
-	// Set the x and y coordinate for each cluster point
-	for i, cluster := range clusters {
-		cluster.centroid.x = float64(r1.Intn(max+1-min) + min) // Assign a random value for x
-		cluster.centroid.y = float64(r1.Intn(max+1-min) + min) // Assign a random value for y
-		clusters[i].centroid = cluster.centroid                // Assign the cluster point to the centroid of the slice of clustes
+	// Set each coordinate of each cluster point
+	for i := range clusters {
+		centroid := make(Point, dimensions)
+		for d := range centroid {
+			centroid[d] = float64(r1.Intn(max+1-min) + min) // Assign a random value for the coordinate
+		}
+		clusters[i].centroid = centroid // Assign the cluster point to the centroid of the slice of clustes
 	}
 
 	return clusters
 }
 
-// updateCluster finds and assigns the points to each cluster
+// updateCluster finds and assigns the points to each cluster, the workers each finding the closest centroids for a block of points
 func updateClusters(clusters []Cluster, points []Point) []Cluster {
+	return assignPoints(clusters, points, lloyd{}.nearest(clusters, points))
+}
 
-	distances := make([]float64, numberOfClusters) // Ceate a distances slice
-	newClusters := make([]Cluster, numberOfClusters)
+// assignPoints puts each point in the cluster of its closest centroid, leaving out the points whose closest centroid is -1
+func assignPoints(clusters []Cluster, points []Point, nearest []int) []Cluster {
 
-	for i, cluster := range newClusters {
+	newClusters := make([]Cluster, len(clusters))
+
+	for i, cluster := range clusters {
 		newClusters[i].centroid = cluster.centroid
 	}
 
-	// For each point in points find the distance between the cluster centroids
-	for _, point := range points {
-		for i, cluster := range clusters {
-			// fmt.Println("i value", i)
-
-			distances[i] = findDistance(cluster.centroid, point) // Get the distance for each cluster centroid for the specified point and assign it in distances
-			// fmt.Println("centroid:", cluster.centroid, "- point:", point, "- distance:", distances[i]) // Print some stuff
-
-			// If all distances to each cluster centroid has been found then continue
-			if i == numberOfClusters-1 {
-				index := findLeastDistanceIndex(distances) // Assign a temporary index to the index containing the shortest distance
-				// fmt.Println("least distance index:", findLeastDistanceIndex(distances)) // Print some more stuff
-
-				if index != -1 { // If no shorter index has been found (aka no outliers)
-					newClusters[index].points = append(newClusters[index].points, point) // Assign that point to the cluster containing the closer centroid
-
-				}
-			}
+	// Assign each point to the cluster containing the closer centroid, in the same order as the points
+	for p, index := range nearest {
+		if index != -1 {
+			newClusters[index].points = append(newClusters[index].points, points[p])
 		}
 	}
 
@@ -241,28 +436,25 @@ func updateClusters(clusters []Cluster, points []Point) []Cluster {
 // updateCentroid finds the new centroid of a cluster based on the points
 func updateCentroid(clusters []Cluster) []Cluster {
 
-	for i, cluster := range clusters { // For each cluster
-
-		if len(cluster.points) == 0 {
-			break
+	// Give each empty cluster some points, or drop it
+	for i := 0; i < len(clusters); i++ {
+		if len(clusters[i].points) == 0 {
+			before := len(clusters)
+			clusters = emptyStrategies[emptyCluster](clusters, i)
+			if len(clusters) < before {
+				i--
+			}
 		}
+	}
 
-		// Initialize a couple temporary variables
-		xSum := 0.0
-		ySum := 0.0
+	for i, cluster := range clusters { // For each cluster
 
-		// For each point in the cluster, add up the x and y values
-		for _, point := range cluster.points {
-			xSum += point.x
-			ySum += point.y
+		if len(cluster.points) == 0 { // Still empty, the centroid stays where it was
+			continue
 		}
 
-		// Get the average of the x and y values and reassign them
-		if len(cluster.points) != 0 {
-			cluster.centroid.x = xSum / float64(len(cluster.points))
-			cluster.centroid.y = ySum / float64(len(cluster.points))
-			clusters[i].centroid = cluster.centroid
-		}
+		// Move the centroid to the center of the points, their mean for euclidean
+		clusters[i].centroid = distanceMetric.center(cluster.points)
 
 	}
 
@@ -271,7 +463,7 @@ func updateCentroid(clusters []Cluster) []Cluster {
 
 // findDistance calculates the Euclidean distance between 2 points
 func findDistance(p1 Point, p2 Point) float64 {
-	return math.Sqrt((math.Pow(float64(p1.x)-float64(p2.x), 2.0)) + (math.Pow(float64(p1.y)-float64(p2.y), 2.0)))
+	return math.Sqrt(squaredDistance(p1, p2))
 }
 
 // findLeastDistanceIndex finds the smallest number in a slice and returns its index
@@ -282,7 +474,7 @@ func findLeastDistanceIndex(distances []float64) int {
 
 	for i, distance := range distances { // Go through each distance
 
-		if i == 0 || distance < leastValue {
+		if leastIndex == -1 || distance < leastValue { // The first distance within the threshold, or a shorter one
 
 			if threshold >= 0 && distance <= threshold { // This applies if there is a threshold value
 				leastValue = distance
@@ -297,30 +489,19 @@ func findLeastDistanceIndex(distances []float64) int {
 	return leastIndex
 }
 
+// findOutliers finds the points that have no centroid within the threshold
 func findOutliers(clusters []Cluster, points []Point) []Point {
 
 	outliers := make([]Point, 0)
+	distances := make([]float64, len(clusters))
 
 	for _, point := range points {
 
-		isFound := false
-
-		for _, cluster := range clusters {
-
-			for _, cPoint := range cluster.points {
-				if cPoint == point {
-					isFound = true
-					break
-				}
-			}
-
-			if isFound {
-				break
-			}
-
+		for i, cluster := range clusters {
+			distances[i] = distanceMetric.distance(cluster.centroid, point)
 		}
 
-		if !isFound {
+		if findLeastDistanceIndex(distances) == -1 {
 			// fmt.Println("Outlier found:", point)
 			outliers = append(outliers, point)
 		}
@@ -328,10 +509,10 @@ func findOutliers(clusters []Cluster, points []Point) []Point {
 	}
 
 	return outliers
-
 }
 
-func load(fileName string, fields int, points []Point) []Point {
+// load reads a point from each line of a CSV file, with a dimension for each of its columns
+func load(fileName string) []Point {
 
 	// Open file
 	f, err := os.Open(fileName)
@@ -340,34 +521,30 @@ func load(fileName string, fields int, points []Point) []Point {
 	}
 	defer f.Close() // CLose when funcion exits
 
-	reader := csv.NewReader(f)      // Create new reader
-	reader.FieldsPerRecord = fields // Assign number of fields
+	reader := csv.NewReader(f) // Create new reader, every line must have as many fields as the first
 
 	// Read in the data
 	rawCSVData, err := reader.ReadAll()
 	if err != nil {
 		log.Fatal(err)
 	}
+	if len(rawCSVData) == 0 {
+		log.Fatal(fileName, " has no points")
+	}
 
 	// Read in the lines
+	points := make([]Point, len(rawCSVData))
 	for j, record := range rawCSVData {
 
 		// Read in the columns
+		points[j] = make(Point, len(record))
 		for i, val := range record {
 
-			parsedVal, err := strconv.ParseFloat(val, 64) // Convert value to a float
+			parsedVal, err := strconv.ParseFloat(strings.TrimSpace(val), 64) // Convert value to a float
 			if err != nil {
 				log.Fatal(err)
 			}
-
-			// Add to the labelsData if relevant.
-			if i == 0 {
-				points[j].x = parsedVal
-				continue
-			} else if i == 1 {
-				points[j].y = parsedVal
-				continue
-			}
+			points[j][i] = parsedVal
 		}
 	}
 
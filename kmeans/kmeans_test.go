@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+)
+
+// testdata/blobs.csv comes from the neural network's generator, run from ../neural-net:
+// nn generate -kind blobs -features 2 -classes 3 -spread 0.5 -rows 150 -labels class -seed 1 -out ../kmeans/testdata/blobs.csv
+// Each row is a point followed by the number of the blob it was drawn from.
+
+// loadBlobs loads the generated blobs, splitting the blob numbers off the points
+func loadBlobs(t *testing.T) ([]Point, []int) {
+	t.Helper()
+
+	var points []Point
+	var blobs []int
+	for _, row := range load("testdata/blobs.csv") {
+		if len(row) != 3 {
+			t.Fatalf("row %v should be 2 coordinates and a blob", row)
+		}
+		points = append(points, row[:2])
+		blobs = append(blobs, int(row[2]))
+	}
+	return points, blobs
+}
+
+func TestGeneratedBlobs(t *testing.T) {
+
+	defer func(i int) { iteratoins = i }(iteratoins)
+	iteratoins = 100
+
+	points, blobs := loadBlobs(t)
+	if len(points) != 150 {
+		t.Fatalf("loaded %d points, want 150", len(points))
+	}
+
+	outcome, err := run(points, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outcome.clusters) != 3 {
+		t.Fatalf("%d clusters, want 3", len(outcome.clusters))
+	}
+
+	// Every cluster holds exactly one blob
+	nearest := lloyd{}.nearest(outcome.clusters, points)
+	blobOf := map[int]int{}
+	clusterOf := map[int]int{}
+	for i, cluster := range nearest {
+		if blob, ok := blobOf[cluster]; ok && blob != blobs[i] {
+			t.Fatalf("cluster %d mixes blobs %d and %d", cluster, blob, blobs[i])
+		}
+		if c, ok := clusterOf[blobs[i]]; ok && c != cluster {
+			t.Fatalf("blob %d is split between clusters %d and %d", blobs[i], c, cluster)
+		}
+		blobOf[cluster], clusterOf[blobs[i]] = blobs[i], cluster
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// miniBatch is k-means fitted a batch of points at a time, each centroid stepping toward its points
+// at a learning rate of 1 over the number of points it has taken in so far
+type miniBatch struct {
+	k         int
+	centroids []Point
+	counts    []float64 // Points taken in by each centroid
+	taken     []int     // Points taken in by each centroid since the pass began
+	r1        *rand.Rand
+}
+
+// reseedSample is the most points a streamed pass keeps for the empty cluster strategy
+const reseedSample = 10000
+
+// newMiniBatch creates a mini-batch k-means whose centroids get seeded from the first batch
+func newMiniBatch(k int, r1 *rand.Rand) *miniBatch {
+	return &miniBatch{k: k, r1: r1}
+}
+
+// checkMiniBatchMetric makes sure the metric centers a cluster on the mean of its points, the only center a running mean follows
+func checkMiniBatchMetric() error {
+	switch distanceMetric.(type) {
+	case euclidean, squaredEuclidean, mahalanobis:
+		return nil
+	}
+	return fmt.Errorf("mini-batch k-means moves the centroids by a running mean, which isn't the center for %s distance", metricName)
+}
+
+// partialFit moves the centroids toward a batch of points, returning the farthest a centroid moved and the cost of the batch
+func (m *miniBatch) partialFit(batch []Point) (float64, float64, error) {
+
+	if len(batch) == 0 {
+		return 0, 0, nil
+	}
+	if m.centroids == nil {
+		clusters, err := seedClusters(batch, m.k, seeding, m.r1)
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, cluster := range clusters {
+			m.centroids = append(m.centroids, cluster.centroid)
+		}
+		m.counts = make([]float64, m.k)
+		m.taken = make([]int, m.k)
+	}
+
+	// Assign the whole batch before moving anything, so the order of the points doesn't matter
+	nearest := make([]int, len(batch))
+	cost := 0.0
+	for i, point := range batch {
+		nearest[i] = m.nearest(point)
+		if nearest[i] != -1 {
+			cost += distanceMetric.cost(point, m.centroids[nearest[i]])
+		}
+	}
+
+	previous := make([]Point, len(m.centroids))
+	for c, centroid := range m.centroids {
+		previous[c] = clonePoint(centroid)
+	}
+
+	for i, point := range batch {
+		c := nearest[i]
+		if c == -1 { // Outside the threshold of every centroid
+			continue
+		}
+		m.counts[c]++
+		m.taken[c]++
+		rate := 1 / m.counts[c]
+		for d, value := range point {
+			m.centroids[c][d] += rate * (value - m.centroids[c][d])
+		}
+	}
+
+	shift := 0.0
+	for c, centroid := range m.centroids {
+		shift = math.Max(shift, distanceMetric.distance(centroid, previous[c]))
+	}
+	return shift, cost, nil
+}
+
+// nearest finds the index of the closest centroid to a point, or -1 if none is within the threshold
+func (m *miniBatch) nearest(point Point) int {
+	distances := make([]float64, len(m.centroids))
+	for c, centroid := range m.centroids {
+		distances[c] = distanceMetric.distance(centroid, point)
+	}
+	return findLeastDistanceIndex(distances)
+}
+
+// endPass applies the -empty strategy to the centroids that took in no points during the pass, handing the strategy
+// the points the pass drew from, then starts the next pass
+func (m *miniBatch) endPass(points []Point) {
+
+	if m.centroids == nil {
+		return
+	}
+	defer func() { m.taken = make([]int, len(m.centroids)) }()
+
+	empty := false
+	for _, n := range m.taken {
+		empty = empty || n == 0
+	}
+	if !empty {
+		return
+	}
+
+	// Give the points to the centroids that took some in, leaving the others empty
+	nearest := make([]int, len(points))
+	distances := make([]float64, len(m.centroids))
+	for i, point := range points {
+		for c, centroid := range m.centroids {
+			distances[c] = math.Inf(1)
+			if m.taken[c] > 0 {
+				distances[c] = distanceMetric.distance(centroid, point)
+			}
+		}
+		nearest[i] = findLeastDistanceIndex(distances)
+	}
+	clusters := assignPoints(m.clusters(), points, nearest)
+
+	// Give each empty cluster some points, or drop it, remembering which centroid each cluster started from
+	origin := make([]int, len(clusters))
+	for c := range origin {
+		origin[c] = c
+	}
+	for c := 0; c < len(clusters); c++ {
+		if m.taken[origin[c]] > 0 {
+			continue
+		}
+		before := len(clusters)
+		clusters = emptyStrategies[emptyCluster](clusters, c)
+		if len(clusters) < before {
+			origin = append(origin[:c:c], origin[c+1:]...)
+			c--
+		}
+	}
+
+	// A centroid the strategy moved starts its running mean over from the points it was given
+	centroids := make([]Point, len(clusters))
+	counts := make([]float64, len(clusters))
+	for c, cluster := range clusters {
+		centroids[c], counts[c] = cluster.centroid, m.counts[origin[c]]
+		if distanceMetric.distance(cluster.centroid, m.centroids[origin[c]]) != 0 {
+			counts[c] = float64(len(cluster.points))
+		}
+	}
+	m.k, m.centroids, m.counts = len(centroids), centroids, counts
+}
+
+// clusters returns the centroids as clusters without points
+func (m *miniBatch) clusters() []Cluster {
+	clusters := make([]Cluster, len(m.centroids))
+	for c, centroid := range m.centroids {
+		clusters[c].centroid = clonePoint(centroid)
+	}
+	return clusters
+}
+
+// runMiniBatch fits the centroids on batches sampled from the points, one batch per iteration, stopping early once
+// a batch moves no centroid farther than the tolerance (the batch inertia is too noisy to stop on). Every pass,
+// as many batches as it takes to sample as many points as there are, ends with the empty cluster strategy.
+func runMiniBatch(points []Point, k int, seed int64) (result, error) {
+
+	if err := checkMiniBatchMetric(); err != nil {
+		return result{}, err
+	}
+
+	r1 := rand.New(rand.NewSource(seed))
+	m := newMiniBatch(k, r1)
+	outcome := result{stopped: stoppedIterations, seed: seed}
+
+	batch := make([]Point, batchSize)
+	batchesPerPass := (len(points) + batchSize - 1) / batchSize
+	for outcome.iterations < iteratoins {
+		for i := range batch {
+			batch[i] = points[r1.Intn(len(points))]
+		}
+
+		shift, cost, err := m.partialFit(batch)
+		if err != nil {
+			return result{}, err
+		}
+		outcome.iterations++
+		outcome.history = append(outcome.history, cost*float64(len(points))/float64(len(batch))) // Scaled up to all the points
+
+		if outcome.iterations > 1 && shift <= tolerance {
+			outcome.stopped = stoppedShift
+			break
+		}
+		if outcome.iterations%batchesPerPass == 0 {
+			m.endPass(points)
+		}
+	}
+	if outcome.iterations%batchesPerPass != 0 { // The last pass was cut short
+		m.endPass(points)
+	}
+
+	outcome.clusters = updateClusters(m.clusters(), points)
+	outcome.inertia = inertia(outcome.clusters)
+	return outcome, nil
+}
+
+// streamClusters fits mini-batch k-means on a CSV file read a batch at a time, passing over it a number of times,
+// then reads it once more to count the points of each centroid and the inertia. Each pass ends with the empty
+// cluster strategy, run on a sample of the pass's points.
+func streamClusters(fileName string, k int, passes int, seed int64) error {
+
+	if batchSize < 1 {
+		return fmt.Errorf("streaming needs a batch size of at least 1, got %d", batchSize)
+	}
+	if err := checkEmptyStrategy(emptyCluster); err != nil {
+		return err
+	}
+	if err := checkMiniBatchMetric(); err != nil {
+		return err
+	}
+
+	m := newMiniBatch(k, rand.New(rand.NewSource(seed)))
+	for pass := 1; pass <= passes; pass++ {
+		batches, largestShift := 0, 0.0
+		var sample []Point
+		seen := 0
+		err := streamPoints(fileName, batchSize, func(batch []Point) error {
+			shift, _, err := m.partialFit(batch)
+			batches++
+			largestShift = math.Max(largestShift, shift)
+
+			// Keep a sample spread evenly over the pass
+			for _, point := range batch {
+				seen++
+				if len(sample) < reseedSample {
+					sample = append(sample, point)
+				} else if i := m.r1.Intn(seen); i < reseedSample {
+					sample[i] = point
+				}
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Pass %d: %d batches, largest centroid shift %g\n", pass, batches, largestShift)
+		m.endPass(sample)
+	}
+
+	sizes := make([]int, len(m.centroids)) // Fewer than k if the strategy dropped any
+	total, outliers := 0.0, 0
+	err := streamPoints(fileName, batchSize, func(batch []Point) error {
+		for _, point := range batch {
+			c := m.nearest(point)
+			if c == -1 {
+				outliers++
+				continue
+			}
+			sizes[c]++
+			total += distanceMetric.cost(point, m.centroids[c])
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Println()
+	for c, centroid := range m.centroids {
+		fmt.Printf("Cluster %d (%d points): %v\n", c+1, sizes[c], centroid)
+	}
+	fmt.Println("Inertia:", total)
+	fmt.Println("Outliers:", outliers)
+	return nil
+}
+
+// streamPoints reads a CSV file of points in batches, handing each batch to fn, every line having as many columns as the first
+func streamPoints(fileName string, batchSize int, fn func(batch []Point) error) error {
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	batch := make([]Point, 0, batchSize)
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		point := make(Point, len(record))
+		for d, val := range record {
+			point[d], err = strconv.ParseFloat(strings.TrimSpace(val), 64)
+			if err != nil {
+				return fmt.Errorf("%s line %d: %v", fileName, line, err)
+			}
+		}
+
+		batch = append(batch, point)
+		if len(batch) == batchSize {
+			if err := fn(batch); err != nil {
+				return err
+			}
+			batch = make([]Point, 0, batchSize)
+		}
+	}
+
+	if len(batch) > 0 {
+		return fn(batch)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestMiniBatchMetrics(t *testing.T) {
+
+	defer func(metric metric, name string, size int) { distanceMetric, metricName, batchSize = metric, name, size }(distanceMetric, metricName, batchSize)
+	batchSize = 10
+
+	points := blobs(200, 3, 2, rand.New(rand.NewSource(1)))
+	for _, test := range []struct {
+		name string
+		ok   bool
+	}{
+		{"euclidean", true},
+		{"sqeuclidean", true},
+		{"mahalanobis", true},
+		{"manhattan", false},
+		{"chebyshev", false},
+		{"minkowski", false},
+		{"cosine", false},
+	} {
+		var err error
+		metricName = test.name
+		if distanceMetric, err = newMetric(test.name, 3, points); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := runMiniBatch(points, 3, 1); (err == nil) != test.ok {
+			t.Errorf("%s: mini-batch gave error %v, want success %v", test.name, err, test.ok)
+		}
+	}
+}
+
+func TestMiniBatchEmptyStrategies(t *testing.T) {
+
+	defer func(name string) { emptyCluster = name }(emptyCluster)
+
+	// Two groups of points, and a third centroid too far away to take any in
+	points := []Point{{0, 0}, {1, 0}, {0, 1}, {1, 1}, {10, 10}, {11, 10}, {10, 11}, {11, 11}, {13, 13}}
+	start := []Point{{0.5, 0.5}, {11, 11}, {1000, 1000}}
+
+	for _, test := range []struct {
+		strategy string
+		want     []Point // Centroids once the pass ends
+	}{
+		{"farthest", []Point{{0.5, 0.5}, {11, 11}, {13, 13}}},
+		{"split", []Point{{0.5, 0.5}, {10.5, 10.5}, {13, 13}}},
+		{"drop", []Point{{0.5, 0.5}, {11, 11}}},
+	} {
+		emptyCluster = test.strategy
+		m := newMiniBatch(len(start), rand.New(rand.NewSource(1)))
+		m.centroids = clonePoints(start)
+		m.counts = []float64{4, 5, 0}
+		m.taken = []int{4, 5, 0}
+
+		m.endPass(points)
+		if !sameCentroids(m.clusters(), (&miniBatch{centroids: test.want}).clusters()) {
+			t.Errorf("%s: centroids %v, want %v", test.strategy, m.centroids, test.want)
+		}
+		if len(m.counts) != len(test.want) || len(m.taken) != len(test.want) {
+			t.Errorf("%s: %d counts and %d taken for %d centroids", test.strategy, len(m.counts), len(m.taken), len(test.want))
+		}
+		for _, n := range m.taken {
+			if n != 0 {
+				t.Errorf("%s: the next pass starts with %v taken", test.strategy, m.taken)
+				break
+			}
+		}
+	}
+}
+
+func TestMiniBatchDropsEmpty(t *testing.T) {
+
+	defer func(name, method string, size, i int) {
+		emptyCluster, seeding, batchSize, iteratoins = name, method, size, i
+	}(emptyCluster, seeding, batchSize, iteratoins)
+	emptyCluster, seeding, batchSize, iteratoins = "drop", "forgy", 10, 20
+
+	// 3 centroids seeded from 2 places, so 2 of them start together and one never takes in a point
+	var points []Point
+	for i := 0; i < 50; i++ {
+		points = append(points, Point{0, 0}, Point{10, 10})
+	}
+
+	outcome, err := runMiniBatch(points, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outcome.clusters) != 2 {
+		t.Fatalf("%d clusters, want the empty one dropped", len(outcome.clusters))
+	}
+	for _, cluster := range outcome.clusters {
+		if len(cluster.points) != 50 {
+			t.Errorf("cluster at %v has %d points, want 50", cluster.centroid, len(cluster.points))
+		}
+	}
+}
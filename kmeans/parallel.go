@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// blockSize is how many points a worker takes at a time, fixed so sums add up in the same order whatever the number of workers
+const blockSize = 4096
+
+// forBlocks splits [0, n) into blocks of blockSize and has the workers run fn on them, block b covering [start, end)
+func forBlocks(n int, fn func(b int, start int, end int)) {
+
+	blocks := blockCount(n)
+	if workers <= 1 || blocks <= 1 {
+		for b := 0; b < blocks; b++ {
+			fn(b, b*blockSize, blockEnd(b, n))
+		}
+		return
+	}
+
+	var next int64 = -1 // Last block handed out
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < blocks; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				b := int(atomic.AddInt64(&next, 1))
+				if b >= blocks {
+					return
+				}
+				fn(b, b*blockSize, blockEnd(b, n))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// blockEnd is where block b stops in [0, n)
+func blockEnd(b int, n int) int {
+	if end := (b + 1) * blockSize; end < n {
+		return end
+	}
+	return n
+}
+
+// blockCount is the number of blocks [0, n) splits into
+func blockCount(n int) int {
+	return (n + blockSize - 1) / blockSize
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"testing"
+)
+
+// Shape of the benchmark data
+const (
+	benchmarkK    = 16
+	benchmarkDims = 8
+)
+
+// benchmarkSizes are the numbers of points each benchmark runs on
+var benchmarkSizes = []int{1e5, 1e6, 1e7}
+
+// benchmarkPoints keeps the points of each size, as creating 10 million of them takes longer than a benchmark
+var benchmarkPoints = map[int][]Point{}
+
+func TestParallelMatchesSerial(t *testing.T) {
+
+	defer func(w int) { workers = w }(workers)
+
+	r1 := rand.New(rand.NewSource(1))
+	points := blobs(10*blockSize+123, 5, 3, r1) // Several blocks and a partial one
+	start, err := seedClusters(points, 5, "forgy", r1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fit := func(n int) ([][]int, []Cluster) {
+		workers = n
+		var assignments [][]int
+		clusters := start
+		for i := 0; i < 5; i++ {
+			nearest := lloyd{}.nearest(clusters, points)
+			assignments = append(assignments, nearest)
+			clusters = updateCentroid(assignPoints(clusters, points, nearest))
+		}
+		return assignments, clusters
+	}
+
+	serialAssignments, serial := fit(1)
+	for _, n := range []int{2, 3, 8} {
+		assignments, clusters := fit(n)
+		for i := range assignments {
+			for p := range assignments[i] {
+				if assignments[i][p] != serialAssignments[i][p] {
+					t.Fatalf("%d workers: iteration %d puts point %d in cluster %d, serially %d", n, i, p, assignments[i][p], serialAssignments[i][p])
+				}
+			}
+		}
+		if !sameCentroids(serial, clusters) {
+			t.Errorf("%d workers: centroids %v differ from the serial %v", n, centroidsOf(clusters), centroidsOf(serial))
+		}
+	}
+}
+
+func BenchmarkAssign(b *testing.B) {
+	benchmarkWorkers(b, func(b *testing.B, points []Point, start []Cluster) {
+		for i := 0; i < b.N; i++ {
+			lloyd{}.nearest(start, points)
+		}
+	})
+}
+
+func BenchmarkUpdate(b *testing.B) {
+	benchmarkWorkers(b, func(b *testing.B, points []Point, start []Cluster) {
+		nearest := lloyd{}.nearest(start, points)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			updateCentroid(assignPoints(start, points, nearest))
+		}
+	})
+}
+
+// benchmarkWorkers runs a benchmark on every size, with one worker and with one per CPU
+func benchmarkWorkers(b *testing.B, run func(b *testing.B, points []Point, start []Cluster)) {
+
+	defer func(w int) { workers = w }(workers)
+
+	counts := []int{1}
+	if runtime.NumCPU() > 1 {
+		counts = append(counts, runtime.NumCPU())
+	}
+
+	for _, size := range benchmarkSizes {
+		for _, n := range counts {
+			b.Run(fmt.Sprintf("points=%d/workers=%d", size, n), func(b *testing.B) {
+				points, start := benchmarkData(b, size)
+				workers = n
+				b.ResetTimer()
+				run(b, points, start)
+			})
+		}
+	}
+}
+
+// benchmarkData gives the points of a size and the centroids to start from, skipping the largest size in short mode
+func benchmarkData(b *testing.B, size int) ([]Point, []Cluster) {
+
+	if testing.Short() && size > 1e6 {
+		b.Skip("skipping", size, "points in short mode")
+	}
+
+	r1 := rand.New(rand.NewSource(1))
+	points, ok := benchmarkPoints[size]
+	if !ok {
+		points = blobs(size, benchmarkK, benchmarkDims, r1)
+		benchmarkPoints[size] = points
+	}
+
+	start, err := seedClusters(points, benchmarkK, "forgy", r1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return points, start
+}
+
+// blobs creates n points scattered normally around k random centers
+func blobs(n int, k int, dims int, r1 *rand.Rand) []Point {
+
+	centers := make([]Point, k)
+	for c := range centers {
+		centers[c] = make(Point, dims)
+		for d := range centers[c] {
+			centers[c][d] = r1.Float64()*20 - 10
+		}
+	}
+
+	points := make([]Point, n)
+	coordinates := make([]float64, n*dims) // One allocation for all the points
+	for i := range points {
+		points[i] = coordinates[i*dims : (i+1)*dims : (i+1)*dims]
+		center := centers[r1.Intn(k)]
+		for d := range points[i] {
+			points[i][d] = center[d] + r1.NormFloat64()
+		}
+	}
+	return points
+}
+
+// sameCentroids checks that 2 sets of clusters have bit for bit the same centroids
+func sameCentroids(a []Cluster, b []Cluster) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if len(a[i].centroid) != len(b[i].centroid) {
+			return false
+		}
+		for d := range a[i].centroid {
+			if a[i].centroid[d] != b[i].centroid[d] {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// seedings are the ways to place the first centroids, chosen with -init
+var seedings = map[string]func(points []Point, k int, r1 *rand.Rand) ([]Point, error){
+	"kmeans++":  seedPlusPlus,
+	"kmeans||":  seedParallel,
+	"forgy":     seedForgy,
+	"random":    seedBounds,
+	"partition": seedPartition,
+	"range":     seedRange,
+}
+
+// seedClusters places k centroids with the named seeding, each cluster starting without points
+func seedClusters(points []Point, k int, method string, r1 *rand.Rand) ([]Cluster, error) {
+
+	seeding, ok := seedings[method]
+	if !ok {
+		return nil, fmt.Errorf("unknown seeding %q, use kmeans++, kmeans||, forgy, random, partition or range", method)
+	}
+	if len(points) == 0 {
+		return nil, fmt.Errorf("no points to seed %d clusters from", k)
+	}
+	if k < 1 {
+		return nil, fmt.Errorf("need at least 1 cluster, got %d", k)
+	}
+
+	centroids, err := seeding(points, k, r1)
+	if err != nil {
+		return nil, err
+	}
+
+	clusters := make([]Cluster, k)
+	for i, centroid := range centroids {
+		clusters[i].centroid = centroid
+	}
+	return clusters, nil
+}
+
+// seedRange places the centroids at random integer coordinates in [rangeMin, rangeMax], ignoring the points
+func seedRange(points []Point, k int, r1 *rand.Rand) ([]Point, error) {
+
+	clusters := initClusters(make([]Cluster, k), rangeMin, rangeMax, r1)
+	centroids := make([]Point, k)
+	for i, cluster := range clusters {
+		centroids[i] = cluster.centroid
+	}
+	return centroids, nil
+}
+
+// seedBounds places the centroids at uniformly random coordinates within the bounding box of the points
+func seedBounds(points []Point, k int, r1 *rand.Rand) ([]Point, error) {
+
+	low := clonePoint(points[0])
+	high := clonePoint(points[0])
+	for _, point := range points {
+		for d, value := range point {
+			low[d] = math.Min(low[d], value)
+			high[d] = math.Max(high[d], value)
+		}
+	}
+
+	centroids := make([]Point, k)
+	for i := range centroids {
+		centroids[i] = make(Point, len(low))
+		for d := range low {
+			centroids[i][d] = low[d] + r1.Float64()*(high[d]-low[d])
+		}
+	}
+	return centroids, nil
+}
+
+// seedForgy uses k distinct points, picked at random, as the centroids
+func seedForgy(points []Point, k int, r1 *rand.Rand) ([]Point, error) {
+
+	if k > len(points) {
+		return nil, fmt.Errorf("forgy seeding needs at least %d points, got %d", k, len(points))
+	}
+
+	centroids := make([]Point, k)
+	for i, index := range r1.Perm(len(points))[:k] {
+		centroids[i] = clonePoint(points[index])
+	}
+	return centroids, nil
+}
+
+// seedPartition puts every point in a random cluster and uses the center of each cluster as its centroid
+func seedPartition(points []Point, k int, r1 *rand.Rand) ([]Point, error) {
+
+	clusters := make([]Cluster, k)
+	for _, point := range points {
+		i := r1.Intn(k)
+		clusters[i].points = append(clusters[i].points, point)
+	}
+
+	centroids := make([]Point, k)
+	for i, cluster := range clusters {
+		if len(cluster.points) == 0 { // More clusters than points, fall back on a random point
+			centroids[i] = clonePoint(points[r1.Intn(len(points))])
+			continue
+		}
+		centroids[i] = distanceMetric.center(cluster.points)
+	}
+	return centroids, nil
+}
+
+// seedPlusPlus picks each centroid among the points with a probability proportional to its cost from the closest centroid so far,
+// the squared distance for euclidean
+func seedPlusPlus(points []Point, k int, r1 *rand.Rand) ([]Point, error) {
+	return weightedPlusPlus(points, nil, k, r1), nil
+}
+
+// weightedPlusPlus is k-means++ where each point counts weights[i] times (nil weights count every point once)
+func weightedPlusPlus(points []Point, weights []float64, k int, r1 *rand.Rand) []Point {
+
+	weight := func(i int) float64 {
+		if weights == nil {
+			return 1
+		}
+		return weights[i]
+	}
+
+	centroids := make([]Point, 0, k)
+	centroids = append(centroids, clonePoint(points[pickWeighted(len(points), weight, r1)]))
+
+	closest := make([]float64, len(points)) // Cost of each point from its closest centroid
+	for i, point := range points {
+		closest[i] = distanceMetric.cost(point, centroids[0])
+	}
+
+	for len(centroids) < k {
+		next := pickWeighted(len(points), func(i int) float64 { return weight(i) * closest[i] }, r1)
+		if next == -1 { // Every point sits on a centroid already
+			next = r1.Intn(len(points))
+		}
+		centroids = append(centroids, clonePoint(points[next]))
+		for i, point := range points {
+			closest[i] = math.Min(closest[i], distanceMetric.cost(point, centroids[len(centroids)-1]))
+		}
+	}
+	return centroids
+}
+
+// pickWeighted picks an index in [0, n) with a probability proportional to its weight, or -1 if all the weights are 0
+func pickWeighted(n int, weight func(i int) float64, r1 *rand.Rand) int {
+
+	total := 0.0
+	for i := 0; i < n; i++ {
+		total += weight(i)
+	}
+	if total <= 0 {
+		return -1
+	}
+
+	target := r1.Float64() * total
+	last := -1
+	for i := 0; i < n; i++ {
+		w := weight(i)
+		if w <= 0 {
+			continue
+		}
+		last = i
+		target -= w
+		if target < 0 {
+			return i
+		}
+	}
+	return last // Rounding left a sliver of the total
+}
+
+// seedParallel is k-means||: a few rounds oversample candidates with probability proportional to their cost,
+// then k-means++ on the candidates, weighted by how many points each one is closest to, picks the k centroids
+func seedParallel(points []Point, k int, r1 *rand.Rand) ([]Point, error) {
+
+	oversampling := 2 * float64(k) // Expected candidates added each round
+	rounds := 5
+
+	candidates := []Point{clonePoint(points[r1.Intn(len(points))])}
+	closest := make([]float64, len(points))
+	nearest := make([]int, len(points)) // Index of the closest candidate of each point
+	for i := range closest {
+		closest[i] = math.Inf(1)
+	}
+	updateClosest(points, candidates, 0, closest, nearest)
+
+	for round := 0; round < rounds; round++ {
+		cost := 0.0
+		for _, c := range closest {
+			cost += c
+		}
+		if cost == 0 {
+			break
+		}
+
+		added := len(candidates)
+		for i, point := range points {
+			if r1.Float64() < oversampling*closest[i]/cost {
+				candidates = append(candidates, clonePoint(point))
+			}
+		}
+		updateClosest(points, candidates, added, closest, nearest)
+	}
+
+	// Identical points can be sampled in the same round
+	candidates = distinctCandidates(candidates, nearest)
+
+	if len(candidates) <= k {
+		for len(candidates) < k { // Too few candidates, top up with points away from them
+			next := pickWeighted(len(points), func(i int) float64 { return closest[i] }, r1)
+			if next == -1 { // Fewer than k distinct points, the empty cluster strategy sorts out the repeated centroids
+				next = r1.Intn(len(points))
+			}
+			candidates = append(candidates, clonePoint(points[next]))
+			updateClosest(points, candidates, len(candidates)-1, closest, nearest)
+		}
+		return candidates, nil
+	}
+
+	weights := make([]float64, len(candidates))
+	for _, c := range nearest {
+		weights[c]++
+	}
+	return weightedPlusPlus(candidates, weights, k, r1), nil
+}
+
+// distinctCandidates drops each candidate equal to an earlier one, pointing the points nearest to it at the one kept
+func distinctCandidates(candidates []Point, nearest []int) []Point {
+
+	var distinct []Point
+	kept := make([]int, len(candidates)) // Index in distinct of each candidate
+	for c, candidate := range candidates {
+		kept[c] = len(distinct)
+		for d, other := range distinct {
+			if squaredDistance(candidate, other) == 0 {
+				kept[c] = d
+				break
+			}
+		}
+		if kept[c] == len(distinct) {
+			distinct = append(distinct, candidate)
+		}
+	}
+
+	for i, c := range nearest {
+		nearest[i] = kept[c]
+	}
+	return distinct
+}
+
+// updateClosest lowers the cost of each point from its closest candidate with the candidates from index first on,
+// the workers taking a block of points each
+func updateClosest(points []Point, candidates []Point, first int, closest []float64, nearest []int) {
+	forBlocks(len(points), func(b int, start int, end int) {
+		for i := start; i < end; i++ {
+			for c := first; c < len(candidates); c++ {
+				if cost := distanceMetric.cost(points[i], candidates[c]); cost < closest[i] {
+					closest[i] = cost
+					nearest[i] = c
+				}
+			}
+		}
+	})
+}
+
+// squaredDistance calculates the squared Euclidean distance between 2 points
+func squaredDistance(p1 Point, p2 Point) float64 {
+	sum := 0.0
+	for d := range p1 {
+		difference := p1[d] - p2[d]
+		sum += difference * difference
+	}
+	return sum
+}
+
+// meanPoint calculates the mean of each coordinate of the points, adding up a partial sum for each block of points
+// and then the partial sums in block order
+func meanPoint(points []Point) Point {
+
+	sums := make([]Point, blockCount(len(points)))
+	forBlocks(len(points), func(b int, start int, end int) {
+		sums[b] = make(Point, len(points[0]))
+		for _, point := range points[start:end] {
+			for d, value := range point {
+				sums[b][d] += value
+			}
+		}
+	})
+
+	mean := make(Point, len(points[0]))
+	for _, sum := range sums {
+		for d, value := range sum {
+			mean[d] += value
+		}
+	}
+	for d := range mean {
+		mean[d] /= float64(len(points))
+	}
+	return mean
+}
+
+// clonePoint copies a point so centroids never share coordinates with the points
+func clonePoint(point Point) Point {
+	return append(Point(nil), point...)
+}
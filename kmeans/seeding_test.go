@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestSeedParallelDistinct(t *testing.T) {
+
+	// Many copies of a few points, so the same coordinates are often sampled in one round
+	var points []Point
+	for i := 0; i < 200; i++ {
+		points = append(points, Point{float64(i % 4), float64(i % 4 * 3)})
+	}
+
+	for seed := int64(1); seed <= 20; seed++ {
+		for _, k := range []int{3, 4} {
+			centroids, err := seedParallel(points, k, rand.New(rand.NewSource(seed)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(centroids) != k {
+				t.Fatalf("seed %d: %d centroids, want %d", seed, len(centroids), k)
+			}
+			for i := range centroids {
+				for j := i + 1; j < len(centroids); j++ {
+					if squaredDistance(centroids[i], centroids[j]) == 0 {
+						t.Errorf("seed %d, k %d: centroids %d and %d are both %v", seed, k, i, j, centroids[i])
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestDistinctCandidates(t *testing.T) {
+
+	candidates := []Point{{0, 0}, {1, 1}, {0, 0}, {2, 2}, {1, 1}}
+	nearest := []int{0, 1, 2, 3, 4, 2}
+
+	distinct := distinctCandidates(candidates, nearest)
+
+	want := []Point{{0, 0}, {1, 1}, {2, 2}}
+	if len(distinct) != len(want) {
+		t.Fatalf("%d distinct candidates, want %d", len(distinct), len(want))
+	}
+	for i := range want {
+		if squaredDistance(distinct[i], want[i]) != 0 {
+			t.Errorf("candidate %d is %v, want %v", i, distinct[i], want[i])
+		}
+	}
+	for i, c := range []int{0, 1, 0, 2, 1, 0} {
+		if nearest[i] != c {
+			t.Errorf("point %d is nearest candidate %d, want %d", i, nearest[i], c)
+		}
+	}
+}
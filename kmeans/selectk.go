@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+)
+
+// kScore is how well each criterion rates one number of clusters
+type kScore struct {
+	k          int
+	inertia    float64
+	silhouette float64 // Mean silhouette, NaN for a single cluster
+	gap        float64 // Gap statistic against uniform reference data
+	gapSpread  float64 // Standard error of the gap
+	bic        float64 // Bayesian information criterion of spherical Gaussians, higher is better, NaN when it can't be scored
+}
+
+// selectK clusters the points with every k in [kMin, kMax], scores each k by the elbow of the inertia, the mean silhouette,
+// the gap statistic over refs reference sets and the BIC (for euclidean inertia only), and recommends the k picked by the most criteria
+func selectK(points []Point, kMin int, kMax int, refs int, sample int, seed int64) ([]kScore, int, error) {
+
+	if kMin < 1 || kMax < kMin {
+		return nil, 0, fmt.Errorf("need 1 <= k-min <= k-max, got %d and %d", kMin, kMax)
+	}
+	if kMax > len(points) {
+		return nil, 0, fmt.Errorf("k-max %d is more than the %d points", kMax, len(points))
+	}
+	if refs < 1 {
+		return nil, 0, fmt.Errorf("need at least 1 reference set for the gap statistic, got %d", refs)
+	}
+
+	r1 := rand.New(rand.NewSource(seed))
+	references := make([][]Point, refs)
+	for b := range references {
+		references[b] = uniformLike(points, r1)
+	}
+
+	var scores []kScore
+	for k := kMin; k <= kMax; k++ {
+		clusters, err := bestClusters(points, k, seed)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		score := kScore{k: k, inertia: inertia(clusters)}
+		score.silhouette = meanSilhouette(clusters, sample, r1)
+		score.bic = math.NaN()
+		if euclideanInertia() {
+			score.bic = bic(clusters)
+		}
+
+		// The gap is how much tighter the clusters are than in data without any clusters
+		logs := make([]float64, refs)
+		mean := 0.0
+		for b, reference := range references {
+			referenceClusters, err := bestClusters(reference, k, seed)
+			if err != nil {
+				return nil, 0, err
+			}
+			logs[b] = math.Log(inertia(referenceClusters))
+			mean += logs[b] / float64(refs)
+		}
+		variance := 0.0
+		for _, l := range logs {
+			variance += (l - mean) * (l - mean) / float64(refs)
+		}
+		score.gap = mean - math.Log(score.inertia)
+		score.gapSpread = math.Sqrt(variance) * math.Sqrt(1+1/float64(refs))
+		if math.IsInf(score.gap, 0) || math.IsNaN(score.gap) { // Clusters that fit the points or a reference exactly leave no gap to measure
+			score.gap, score.gapSpread = math.NaN(), math.NaN()
+		}
+
+		scores = append(scores, score)
+		fmt.Printf("k %d: inertia %g, silhouette %.4f, gap %.4f ± %.4f, BIC %.1f\n", k, score.inertia, score.silhouette, score.gap, score.gapSpread, score.bic)
+	}
+
+	type pick struct {
+		name string
+		k    int // 0 when the criterion can't pick
+	}
+	picks := []pick{
+		{"elbow", elbowK(scores)},
+		{"silhouette", silhouetteK(scores)},
+		{"gap", gapK(scores)},
+	}
+	fmt.Println()
+	if euclideanInertia() {
+		picks = append(picks, pick{"BIC", bicK(scores)})
+	} else {
+		fmt.Printf("BIC: left out, it takes the inertia as euclidean and the metric is %s\n", metricName)
+	}
+	votes := map[int]int{}
+	for _, pick := range picks {
+		if pick.k == 0 {
+			fmt.Printf("%s: no pick\n", pick.name)
+			continue
+		}
+		fmt.Printf("%s picks k = %d\n", pick.name, pick.k)
+		votes[pick.k]++
+	}
+
+	recommended := 0
+	for k := kMin; k <= kMax; k++ {
+		if votes[k] > votes[recommended] {
+			recommended = k
+		}
+	}
+	return scores, recommended, nil
+}
+
+// bestClusters runs the clustering from restartCount seedings and keeps the clusters with the lowest inertia
+func bestClusters(points []Point, k int, seed int64) ([]Cluster, error) {
+	results, err := restarts(points, k, restartCount, seed)
+	if err != nil {
+		return nil, err
+	}
+	return results[bestRun(results)].clusters, nil
+}
+
+// uniformLike creates as many points as given, spread uniformly over their bounding box
+func uniformLike(points []Point, r1 *rand.Rand) []Point {
+	uniform, _ := seedBounds(points, len(points), r1)
+	return uniform
+}
+
+// meanSilhouette averages, over at most sample points of the clusters (every point for 0), how much closer each point is
+// to the rest of its cluster than to the nearest other cluster, from -1 to 1
+func meanSilhouette(clusters []Cluster, sample int, r1 *rand.Rand) float64 {
+
+	var points []Point
+	var labels []int
+	for c, cluster := range clusters {
+		for _, point := range cluster.points {
+			points = append(points, point)
+			labels = append(labels, c)
+		}
+	}
+	if len(clusters) < 2 || len(points) == 0 {
+		return math.NaN()
+	}
+
+	chosen := r1.Perm(len(points))
+	if sample > 0 && sample < len(chosen) {
+		chosen = chosen[:sample]
+	}
+
+	total := 0.0
+	for _, i := range chosen {
+		sums := make([]float64, len(clusters))
+		for j, point := range points {
+			if j != i {
+				sums[labels[j]] += distanceMetric.distance(points[i], point)
+			}
+		}
+
+		own := len(clusters[labels[i]].points) - 1
+		if own == 0 { // Alone in its cluster
+			continue
+		}
+		a := sums[labels[i]] / float64(own)
+		b := math.Inf(1)
+		for c, cluster := range clusters {
+			if c != labels[i] && len(cluster.points) > 0 {
+				b = math.Min(b, sums[c]/float64(len(cluster.points)))
+			}
+		}
+		if math.IsInf(b, 1) || math.Max(a, b) == 0 {
+			continue
+		}
+		total += (b - a) / math.Max(a, b)
+	}
+	return total / float64(len(chosen))
+}
+
+// euclideanInertia reports whether the inertia sums squared euclidean distances, as bic takes it to
+func euclideanInertia() bool {
+	switch distanceMetric.(type) {
+	case euclidean, squaredEuclidean:
+		return true
+	}
+	return false
+}
+
+// bic is the X-means score of the clusters as spherical Gaussians sharing one variance: their log-likelihood
+// less half the number of parameters times the log of the number of points, taking the inertia as euclidean
+func bic(clusters []Cluster) float64 {
+
+	n, k, dims := 0, 0, 0
+	for _, cluster := range clusters {
+		if len(cluster.points) > 0 {
+			n += len(cluster.points)
+			k++
+			dims = len(cluster.points[0])
+		}
+	}
+	if n <= k {
+		return math.NaN()
+	}
+
+	variance := inertia(clusters) / float64(dims*(n-k)) // Of each coordinate
+
+	// Every point on its centroid makes the likelihood unbounded, which says nothing about k
+	if variance == 0 {
+		return math.NaN()
+	}
+
+	likelihood := -float64(n*dims)/2*math.Log(2*math.Pi*variance) - float64(dims*(n-k))/2
+	for _, cluster := range clusters {
+		if size := float64(len(cluster.points)); size > 0 {
+			likelihood += size * math.Log(size/float64(n))
+		}
+	}
+	parameters := float64(k-1) + float64(k*dims) + 1 // Mixing weights, centroids and the variance
+	return likelihood - parameters/2*math.Log(float64(n))
+}
+
+// elbowK picks the k whose inertia lies farthest below the straight line from the first k to the last, both scaled to [0, 1]
+func elbowK(scores []kScore) int {
+
+	if len(scores) < 3 {
+		return 0
+	}
+	first, last := scores[0], scores[len(scores)-1]
+	if first.inertia == last.inertia {
+		return 0
+	}
+
+	best, farthest := 0, 0.0
+	for _, score := range scores[1 : len(scores)-1] {
+		x := float64(score.k-first.k) / float64(last.k-first.k)
+		y := (score.inertia - last.inertia) / (first.inertia - last.inertia)
+		if below := (1 - x) - y; below > farthest {
+			best, farthest = score.k, below
+		}
+	}
+	return best
+}
+
+// silhouetteK picks the k with the highest mean silhouette
+func silhouetteK(scores []kScore) int {
+	best := 0
+	highest := math.Inf(-1)
+	for _, score := range scores {
+		if !math.IsNaN(score.silhouette) && score.silhouette > highest {
+			best, highest = score.k, score.silhouette
+		}
+	}
+	return best
+}
+
+// gapK picks the smallest k whose gap is within a standard error of the next k's, skipping the ks without a gap
+func gapK(scores []kScore) int {
+	var gaps []kScore
+	for _, score := range scores {
+		if !math.IsNaN(score.gap) {
+			gaps = append(gaps, score)
+		}
+	}
+	for i := 0; i+1 < len(gaps); i++ {
+		if gaps[i].gap >= gaps[i+1].gap-gaps[i+1].gapSpread {
+			return gaps[i].k
+		}
+	}
+	return 0
+}
+
+// bicK picks the k with the highest BIC
+func bicK(scores []kScore) int {
+	best := 0
+	highest := math.Inf(-1)
+	for _, score := range scores {
+		if !math.IsNaN(score.bic) && score.bic > highest {
+			best, highest = score.k, score.bic
+		}
+	}
+	return best
+}
+
+// writeCurves saves the score of each k as CSV, leaving out the values that don't exist
+func writeCurves(fileName string, scores []kScore) error {
+
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	format := func(value float64) string {
+		if math.IsNaN(value) {
+			return ""
+		}
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+
+	writer := csv.NewWriter(f)
+	writer.Write([]string{"k", "inertia", "silhouette", "gap", "gap_sd", "bic"})
+	for _, score := range scores {
+		writer.Write([]string{strconv.Itoa(score.k), format(score.inertia), format(score.silhouette), format(score.gap), format(score.gapSpread), format(score.bic)})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
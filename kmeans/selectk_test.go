@@ -0,0 +1,130 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSelectKFindsBlobs(t *testing.T) {
+
+	defer func(i int) { iteratoins = i }(iteratoins)
+	iteratoins = 100
+
+	points, _ := loadBlobs(t) // 3 blobs
+	scores, k, err := selectK(points, 1, 6, 5, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scores) != 6 {
+		t.Fatalf("%d scores for k from 1 to 6", len(scores))
+	}
+
+	for _, pick := range []struct {
+		name string
+		k    int
+	}{
+		{"elbow", elbowK(scores)},
+		{"silhouette", silhouetteK(scores)},
+		{"gap", gapK(scores)},
+		{"BIC", bicK(scores)},
+		{"recommendation", k},
+	} {
+		if pick.k != 3 {
+			t.Errorf("%s picks k = %d, want 3", pick.name, pick.k)
+		}
+	}
+}
+
+func TestSelectKSingleK(t *testing.T) {
+
+	defer func(i int) { iteratoins = i }(iteratoins)
+	iteratoins = 100
+
+	points, _ := loadBlobs(t)
+	scores, k, err := selectK(points, 3, 3, 5, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scores) != 1 || k != 3 {
+		t.Errorf("%d scores recommending k = %d, want 1 recommending 3", len(scores), k)
+	}
+	if elbowK(scores) != 0 || gapK(scores) != 0 {
+		t.Errorf("the elbow picks %d and the gap %d from a single k, want no pick", elbowK(scores), gapK(scores))
+	}
+}
+
+func TestSelectKAsManyClustersAsPoints(t *testing.T) {
+
+	defer func(i int) { iteratoins = i }(iteratoins)
+	iteratoins = 100
+
+	// 2 groups of 3
+	points := []Point{{0, 0}, {0, 1}, {1, 0}, {10, 10}, {10, 11}, {11, 10}}
+	scores, k, err := selectK(points, 1, len(points), 5, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last := scores[len(scores)-1]
+	if last.inertia != 0 || !math.IsNaN(last.bic) || !math.IsNaN(last.gap) {
+		t.Errorf("a cluster per point scores inertia %g, BIC %g and gap %g, want 0 and no BIC or gap", last.inertia, last.bic, last.gap)
+	}
+	if k != 2 {
+		t.Errorf("recommends k = %d, want 2", k)
+	}
+
+	if _, _, err := selectK(points, 1, len(points)+1, 5, 0, 1); err == nil {
+		t.Error("a k-max above the number of points was accepted")
+	}
+}
+
+func TestSelectKDuplicatePoints(t *testing.T) {
+
+	defer func(i int) { iteratoins = i }(iteratoins)
+	iteratoins = 100
+
+	// 3 places with 20 points each, so from k = 3 every point sits on its centroid
+	var points []Point
+	for i := 0; i < 20; i++ {
+		points = append(points, Point{0, 0}, Point{5, 0}, Point{0, 5})
+	}
+	scores, k, err := selectK(points, 1, 5, 5, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, score := range scores {
+		if score.inertia != 0 {
+			continue
+		}
+		if !math.IsNaN(score.bic) || !math.IsNaN(score.gap) {
+			t.Errorf("k %d: no inertia gives BIC %g and gap %g, want neither", score.k, score.bic, score.gap)
+		}
+		if score.k == bicK(scores) || score.k == gapK(scores) {
+			t.Errorf("k %d without a BIC or gap was picked", score.k)
+		}
+	}
+	if k != 3 {
+		t.Errorf("recommends k = %d, want 3", k)
+	}
+}
+
+func TestSelectKLeavesOutBICWithoutEuclideanInertia(t *testing.T) {
+
+	defer func(metric metric, name string, i int) { distanceMetric, metricName, iteratoins = metric, name, i }(distanceMetric, metricName, iteratoins)
+	distanceMetric, metricName, iteratoins = manhattan{}, "manhattan", 100
+
+	points, _ := loadBlobs(t)
+	scores, k, err := selectK(points, 1, 6, 5, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, score := range scores {
+		if !math.IsNaN(score.bic) {
+			t.Errorf("k %d has a BIC of %g with manhattan distances", score.k, score.bic)
+		}
+	}
+	if k != 3 {
+		t.Errorf("recommends k = %d, want 3", k)
+	}
+}
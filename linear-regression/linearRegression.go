@@ -218,6 +218,8 @@ func getSlice(points []Point, axis rune) ([]float64, error) {
 	return slice, nil
 }
 
+// load reads x,y rows from a CSV file, such as coords.csv or the linear rows of the neural network's
+// generator, run from ../neural-net: nn generate -kind linear -features 1 -noise 1 -seed 1 -out ../linear-regression/coords.csv
 func load(fileName string, fields int, coords []Point) []Point {
 
 	// Open file
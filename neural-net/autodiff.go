@@ -0,0 +1,601 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// tape records the operations of a forward pass so the gradients can be found by walking it backwards
+type tape struct {
+	variables []*variable // Every variable in the order it was computed
+}
+
+// variable is a matrix on a tape along with the gradient of the final result with respect to it
+type variable struct {
+	value    *mat.Dense
+	gradient *mat.Dense // Set by the tape's backward
+	backward func()     // Adds to the gradients of the operation's inputs (nil for inputs & parameters)
+}
+
+// graphFunction is the forward pass of a graphLayer, built from operations on a tape
+type graphFunction func(t *tape, x *variable, parameters []*variable) *variable
+
+// tapeLayer is a layer defined only by its forward pass, its backward pass comes from the tape
+type tapeLayer interface {
+	layer
+	record(t *tape, x *variable, parameters []*variable) *variable // Records the forward pass, given a variable for each of layerParameters
+}
+
+// graphLayer is a tape layer whose forward pass is picked by name, so any of graphFunctions can be saved
+type graphLayer struct {
+	function   string       // Name of the forward pass in graphFunctions
+	parameters []*mat.Dense // Parameters in the order the forward pass expects them
+}
+
+// graphFunctions are the forward passes a graphLayer can use
+var graphFunctions = map[string]graphFunction{
+	// x * W + b
+	"dense": func(t *tape, x *variable, p []*variable) *variable {
+		return t.add(t.matMul(x, p[0]), p[1])
+	},
+	// x * sigmoid(x)
+	"swish": func(t *tape, x *variable, _ []*variable) *variable {
+		return t.mul(x, t.sigmoid(x))
+	},
+	// x + tanh(x * W + b)
+	"residual": func(t *tape, x *variable, p []*variable) *variable {
+		return t.add(x, t.tanh(t.add(t.matMul(x, p[0]), p[1])))
+	},
+}
+
+// lossFunction is a loss built from operations on a tape, returning the loss of each output
+type lossFunction func(t *tape, output, labels *variable) *variable
+
+// lossFunctions are the losses a network can be trained with
+var lossFunctions = map[string]lossFunction{
+	// Half the squared error, whose gradient is output - labels
+	"squared-error": func(t *tape, output, labels *variable) *variable {
+		return t.scale(0.5, t.square(t.sub(output, labels)))
+	},
+	// Binary cross-entropy, for sigmoid outputs
+	"cross-entropy": func(t *tape, output, labels *variable) *variable {
+		output = t.clip(output, 1e-12, 1-1e-12)
+		positive := t.mul(labels, t.log(output))
+		negative := t.mul(t.sub(t.constant(1), labels), t.log(t.sub(t.constant(1), output)))
+		return t.scale(-1, t.add(positive, negative))
+	},
+	"focal": focalLoss(2),
+}
+
+// focalLoss returns the binary focal loss, cross-entropy scaled down for outputs that are already
+// close to their labels so that training focuses on the hard rows. A gamma of 0 gives cross-entropy.
+func focalLoss(gamma float64) lossFunction {
+	return func(t *tape, output, labels *variable) *variable {
+		output = t.clip(output, 1e-12, 1-1e-12)
+		one := t.constant(1)
+		positive := t.mul(labels, t.mul(t.pow(t.sub(one, output), gamma), t.log(output)))
+		negative := t.mul(t.sub(one, labels), t.mul(t.pow(output, gamma), t.log(t.sub(one, output))))
+		return t.scale(-1, t.add(positive, negative))
+	}
+}
+
+// newGraphLayer creates a layer from a named forward pass and its parameters
+func newGraphLayer(function string, parameters ...*mat.Dense) (*graphLayer, error) {
+
+	if _, ok := graphFunctions[function]; !ok {
+		return nil, fmt.Errorf("unknown graph function %q", function)
+	}
+
+	return &graphLayer{function: function, parameters: parameters}, nil
+}
+
+// newGraphDenseLayer creates a graph layer computing x * W + b with normally distributed weights
+func newGraphDenseLayer(numberOfInputs, numberOfOutputs int, r *rand.Rand) *graphLayer {
+	layer, _ := newGraphLayer("dense", randomNormalMatrix(numberOfInputs, numberOfOutputs, math.Sqrt(1/float64(numberOfInputs)), r), mat.NewDense(1, numberOfOutputs, nil))
+	return layer
+}
+
+// record runs the named forward pass
+func (layer *graphLayer) record(t *tape, x *variable, parameters []*variable) *variable {
+	return graphFunctions[layer.function](t, x, parameters)
+}
+
+// forward runs the forward pass
+func (layer *graphLayer) forward(x *mat.Dense) *mat.Dense {
+	return tapeForward(layer, x)
+}
+
+// backward walks the forward pass back on a tape to adjust the parameters
+func (layer *graphLayer) backward(x, _, gradient *mat.Dense, learningRate float64) *mat.Dense {
+	return tapeBackward(layer, x, gradient, learningRate)
+}
+
+// buildTape records a tape layer's forward pass on t, with a variable for its input and each of its parameters
+func buildTape(layer tapeLayer, t *tape, x *mat.Dense) (input, output *variable, parameters []*variable) {
+
+	input = t.newVariable(x)
+	for _, parameter := range layerParameters(layer) {
+		parameters = append(parameters, t.newVariable(parameter))
+	}
+
+	return input, layer.record(t, input, parameters), parameters
+}
+
+// tapeForward runs a tape layer's forward pass
+func tapeForward(layer tapeLayer, x *mat.Dense) *mat.Dense {
+	_, output, _ := buildTape(layer, new(tape), x)
+	return output.value
+}
+
+// tapeBackward reruns a tape layer's forward pass on a tape and walks it back to adjust the parameters,
+// returning the gradient for the input
+func tapeBackward(layer tapeLayer, x, gradient *mat.Dense, learningRate float64) *mat.Dense {
+
+	t := new(tape)
+	input, output, parameters := buildTape(layer, t, x)
+	t.backward(output, gradient)
+
+	// The variables hold the layer's own parameters, so adjusting them adjusts the layer
+	for _, parameter := range parameters {
+		parameter.gradient.Scale(learningRate, parameter.gradient)
+		parameter.value.Sub(parameter.value, parameter.gradient)
+	}
+
+	return input.gradient
+}
+
+// lossGradient returns the total of a loss and its gradient with respect to the output. The loss
+// of each row is multiplied by its weight if weights (one column) is set.
+func lossGradient(loss lossFunction, output, labels, weights *mat.Dense) (float64, *mat.Dense) {
+
+	t := new(tape)
+	outputVariable := t.newVariable(output)
+	losses := loss(t, outputVariable, t.newVariable(labels))
+	if weights != nil {
+		losses = t.mul(losses, t.newVariable(weights))
+	}
+	result := t.sum(losses)
+	t.backward(result, nil)
+
+	return result.value.At(0, 0), outputVariable.gradient
+}
+
+// newVariable records an input or parameter on the tape
+func (t *tape) newVariable(value *mat.Dense) *variable {
+	v := &variable{value: value}
+	t.variables = append(t.variables, v)
+	return v
+}
+
+// constant records a 1x1 value, which operations broadcast to the shape of their other input
+func (t *tape) constant(value float64) *variable {
+	return t.newVariable(mat.NewDense(1, 1, []float64{value}))
+}
+
+// record adds the result of an operation to the tape along with the function passing its gradient back
+func (t *tape) record(value *mat.Dense, backward func(gradient *mat.Dense)) *variable {
+	v := t.newVariable(value)
+	v.backward = func() { backward(v.gradient) }
+	return v
+}
+
+// backward finds the gradient of output with respect to every variable on the tape. The
+// gradient of output itself is seeded with gradient, or with ones if gradient is nil.
+func (t *tape) backward(output *variable, gradient *mat.Dense) {
+
+	for _, v := range t.variables {
+		rows, cols := v.value.Dims()
+		v.gradient = mat.NewDense(rows, cols, nil)
+	}
+
+	if gradient == nil {
+		output.gradient.Apply(func(_, _ int, _ float64) float64 { return 1 }, output.gradient)
+	} else {
+		output.gradient.Copy(gradient)
+	}
+
+	// Variables are recorded after their inputs, so the reverse order visits each one after everything using it
+	for i := len(t.variables) - 1; i >= 0; i-- {
+		if t.variables[i].backward != nil {
+			t.variables[i].backward()
+		}
+	}
+}
+
+// accumulate adds to a variable's gradient
+func (v *variable) accumulate(gradient mat.Matrix) {
+	v.gradient.Add(v.gradient, gradient)
+}
+
+// matMul multiplies two matrices
+func (t *tape) matMul(a, b *variable) *variable {
+
+	value := new(mat.Dense)
+	value.Mul(a.value, b.value)
+
+	return t.record(value, func(gradient *mat.Dense) {
+		aGradient := new(mat.Dense)
+		aGradient.Mul(gradient, b.value.T())
+		a.accumulate(aGradient)
+
+		bGradient := new(mat.Dense)
+		bGradient.Mul(a.value.T(), gradient)
+		b.accumulate(bGradient)
+	})
+}
+
+// broadcast repeats a single row, a single column or a single value to fill rows x cols
+func (t *tape) broadcast(a *variable, rows, cols int) *variable {
+
+	aRows, aCols := a.value.Dims()
+	if aRows == rows && aCols == cols {
+		return a
+	}
+	if (aRows != 1 && aRows != rows) || (aCols != 1 && aCols != cols) {
+		panic(fmt.Sprintf("can't broadcast %dx%d to %dx%d", aRows, aCols, rows, cols))
+	}
+
+	return t.record(repeat(a.value, rows, cols), func(gradient *mat.Dense) {
+		// Every repeated value adds to the gradient of the value it came from
+		aGradient := gradient
+		if aRows == 1 && rows != 1 {
+			aGradient, _ = sumAlongAxis(0, aGradient)
+		}
+		if aCols == 1 && cols != 1 {
+			aGradient, _ = sumAlongAxis(1, aGradient)
+		}
+		a.accumulate(aGradient)
+	})
+}
+
+// match broadcasts two variables to the same shape
+func (t *tape) match(a, b *variable) (*variable, *variable) {
+
+	aRows, aCols := a.value.Dims()
+	bRows, bCols := b.value.Dims()
+	rows, cols := max(aRows, bRows), max(aCols, bCols)
+
+	return t.broadcast(a, rows, cols), t.broadcast(b, rows, cols)
+}
+
+// add adds two variables element by element, broadcasting them to the same shape
+func (t *tape) add(a, b *variable) *variable {
+
+	a, b = t.match(a, b)
+	value := new(mat.Dense)
+	value.Add(a.value, b.value)
+
+	return t.record(value, func(gradient *mat.Dense) {
+		a.accumulate(gradient)
+		b.accumulate(gradient)
+	})
+}
+
+// sub subtracts b from a element by element, broadcasting them to the same shape
+func (t *tape) sub(a, b *variable) *variable {
+
+	a, b = t.match(a, b)
+	value := new(mat.Dense)
+	value.Sub(a.value, b.value)
+
+	return t.record(value, func(gradient *mat.Dense) {
+		a.accumulate(gradient)
+		bGradient := new(mat.Dense)
+		bGradient.Scale(-1, gradient)
+		b.accumulate(bGradient)
+	})
+}
+
+// mul multiplies two variables element by element, broadcasting them to the same shape
+func (t *tape) mul(a, b *variable) *variable {
+
+	a, b = t.match(a, b)
+	value := new(mat.Dense)
+	value.MulElem(a.value, b.value)
+
+	return t.record(value, func(gradient *mat.Dense) {
+		aGradient := new(mat.Dense)
+		aGradient.MulElem(gradient, b.value)
+		a.accumulate(aGradient)
+
+		bGradient := new(mat.Dense)
+		bGradient.MulElem(gradient, a.value)
+		b.accumulate(bGradient)
+	})
+}
+
+// div divides a by b element by element, broadcasting them to the same shape
+func (t *tape) div(a, b *variable) *variable {
+
+	a, b = t.match(a, b)
+	value := new(mat.Dense)
+	value.DivElem(a.value, b.value)
+
+	return t.record(value, func(gradient *mat.Dense) {
+		aGradient := new(mat.Dense)
+		aGradient.DivElem(gradient, b.value)
+		a.accumulate(aGradient)
+
+		// d(a/b)/db = -(a/b)/b
+		bGradient := new(mat.Dense)
+		bGradient.Apply(func(i, j int, v float64) float64 { return -v * value.At(i, j) / b.value.At(i, j) }, gradient)
+		b.accumulate(bGradient)
+	})
+}
+
+// scale multiplies a variable by a constant
+func (t *tape) scale(factor float64, a *variable) *variable {
+
+	value := new(mat.Dense)
+	value.Scale(factor, a.value)
+
+	return t.record(value, func(gradient *mat.Dense) {
+		aGradient := new(mat.Dense)
+		aGradient.Scale(factor, gradient)
+		a.accumulate(aGradient)
+	})
+}
+
+// elementwise applies function to each element, with derivative given the element x and its result y
+func (t *tape) elementwise(a *variable, function func(x float64) float64, derivative func(x, y float64) float64) *variable {
+
+	value := new(mat.Dense)
+	value.Apply(func(_, _ int, v float64) float64 { return function(v) }, a.value)
+
+	return t.record(value, func(gradient *mat.Dense) {
+		aGradient := new(mat.Dense)
+		aGradient.Apply(func(i, j int, v float64) float64 {
+			return v * derivative(a.value.At(i, j), value.At(i, j))
+		}, gradient)
+		a.accumulate(aGradient)
+	})
+}
+
+// sigmoid applies the sigmoid function to each element
+func (t *tape) sigmoid(a *variable) *variable {
+	return t.elementwise(a, sigmoid, func(_, y float64) float64 { return y * (1 - y) })
+}
+
+// tanh applies the hyperbolic tangent to each element
+func (t *tape) tanh(a *variable) *variable {
+	return t.elementwise(a, math.Tanh, func(_, y float64) float64 { return 1 - y*y })
+}
+
+// relu replaces each negative element with zero
+func (t *tape) relu(a *variable) *variable {
+	return t.elementwise(a, func(x float64) float64 { return math.Max(0, x) }, func(x, _ float64) float64 {
+		if x > 0 {
+			return 1
+		}
+		return 0
+	})
+}
+
+// exp raises e to each element
+func (t *tape) exp(a *variable) *variable {
+	return t.elementwise(a, math.Exp, func(_, y float64) float64 { return y })
+}
+
+// log takes the natural logarithm of each element
+func (t *tape) log(a *variable) *variable {
+	return t.elementwise(a, math.Log, func(x, _ float64) float64 { return 1 / x })
+}
+
+// pow raises each element to a constant power
+func (t *tape) pow(a *variable, exponent float64) *variable {
+	return t.elementwise(a, func(x float64) float64 { return math.Pow(x, exponent) }, func(x, _ float64) float64 {
+		return exponent * math.Pow(x, exponent-1)
+	})
+}
+
+// square squares each element
+func (t *tape) square(a *variable) *variable {
+	return t.elementwise(a, func(x float64) float64 { return x * x }, func(x, _ float64) float64 { return 2 * x })
+}
+
+// clip limits each element to [low, high], passing no gradient back for clipped elements
+func (t *tape) clip(a *variable, low, high float64) *variable {
+	return t.elementwise(a, func(x float64) float64 { return math.Min(math.Max(x, low), high) }, func(x, _ float64) float64 {
+		if x < low || x > high {
+			return 0
+		}
+		return 1
+	})
+}
+
+// sum adds every element into a 1x1 variable
+func (t *tape) sum(a *variable) *variable {
+
+	value := mat.NewDense(1, 1, []float64{mat.Sum(a.value)})
+
+	return t.record(value, func(gradient *mat.Dense) {
+		rows, cols := a.value.Dims()
+		a.accumulate(repeat(gradient, rows, cols))
+	})
+}
+
+// mean averages every element into a 1x1 variable
+func (t *tape) mean(a *variable) *variable {
+	rows, cols := a.value.Dims()
+	return t.scale(1/float64(rows*cols), t.sum(a))
+}
+
+// sumAlong sums along axis 0 (giving one row) or axis 1 (giving one column), like sumAlongAxis
+func (t *tape) sumAlong(axis int, a *variable) *variable {
+
+	value, err := sumAlongAxis(axis, a.value)
+	if err != nil {
+		panic(err)
+	}
+
+	return t.record(value, func(gradient *mat.Dense) {
+		rows, cols := a.value.Dims()
+		a.accumulate(repeat(gradient, rows, cols))
+	})
+}
+
+// softmax applies the softmax function to each row
+func (t *tape) softmax(a *variable) *variable {
+
+	value := new(mat.Dense)
+	value.CloneFrom(a.value)
+	numberOfRows, _ := value.Dims()
+	for i := 0; i < numberOfRows; i++ {
+		softmax(value.RawRowView(i))
+	}
+
+	return t.record(value, func(gradient *mat.Dense) {
+		// Each row's Jacobian is diag(y) - y*y^T
+		aGradient := new(mat.Dense)
+		aGradient.CloneFrom(gradient)
+		for i := 0; i < numberOfRows; i++ {
+			row := aGradient.RawRowView(i)
+			y := value.RawRowView(i)
+			dot := 0.0
+			for j := range row {
+				dot += row[j] * y[j]
+			}
+			for j := range row {
+				row[j] = y[j] * (row[j] - dot)
+			}
+		}
+		a.accumulate(aGradient)
+	})
+}
+
+// gather fills a rows x cols variable with elements of a, taking element i, j from the element of a
+// at index(i, j) in row major order, or 0 where index returns -1
+func (t *tape) gather(a *variable, rows, cols int, index func(i, j int) int) *variable {
+
+	source := a.value.RawMatrix()
+	value := mat.NewDense(rows, cols, nil)
+	data := value.RawMatrix().Data
+	indices := make([]int, rows*cols) // Kept for the backward pass, as working them out is most of the cost
+	for i := 0; i < rows; i++ {
+		for j := 0; j < cols; j++ {
+			k := index(i, j)
+			indices[i*cols+j] = k
+			if k >= 0 {
+				data[i*cols+j] = source.Data[k/source.Cols*source.Stride+k%source.Cols]
+			}
+		}
+	}
+
+	return t.record(value, func(gradient *mat.Dense) {
+		// Each element's gradient goes back to where it came from. The tape's gradients are never
+		// views, so this adds straight into a's instead of building a matrix the size of a.
+		gradientData, aGradient := gradient.RawMatrix().Data, a.gradient.RawMatrix().Data
+		for i, k := range indices {
+			if k >= 0 {
+				aGradient[k] += gradientData[i]
+			}
+		}
+	})
+}
+
+// columns takes the columns from start up to end
+func (t *tape) columns(a *variable, start, end int) *variable {
+	rows, cols := a.value.Dims()
+	return t.gather(a, rows, end-start, func(i, j int) int { return i*cols + start + j })
+}
+
+// reshape lays the elements of a out again as rows x cols, keeping their row major order
+func (t *tape) reshape(a *variable, rows, cols int) *variable {
+	return t.gather(a, rows, cols, func(i, j int) int { return i*cols + j })
+}
+
+// concat joins variables with the same number of rows side by side
+func (t *tape) concat(parts ...*variable) *variable {
+
+	rows, cols := parts[0].value.Dims()
+	for _, part := range parts[1:] {
+		partRows, partCols := part.value.Dims()
+		if partRows != rows {
+			panic(fmt.Sprintf("can't join %d rows to %d rows", partRows, rows))
+		}
+		cols += partCols
+	}
+
+	value := mat.NewDense(rows, cols, nil)
+	start := 0
+	for _, part := range parts {
+		_, partCols := part.value.Dims()
+		value.Slice(0, rows, start, start+partCols).(*mat.Dense).Copy(part.value)
+		start += partCols
+	}
+
+	return t.record(value, func(gradient *mat.Dense) {
+		start := 0
+		for _, part := range parts {
+			_, partCols := part.value.Dims()
+			part.accumulate(gradient.Slice(0, rows, start, start+partCols))
+			start += partCols
+		}
+	})
+}
+
+// choose takes each row from a where use is set for it and from b otherwise
+func (t *tape) choose(use []bool, a, b *variable) *variable {
+
+	value := mat.DenseCopyOf(b.value)
+	for i, useA := range use {
+		if useA {
+			value.SetRow(i, a.value.RawRowView(i))
+		}
+	}
+
+	return t.record(value, func(gradient *mat.Dense) {
+		rows, cols := gradient.Dims()
+		aGradient, bGradient := mat.NewDense(rows, cols, nil), mat.NewDense(rows, cols, nil)
+		for i, useA := range use {
+			if useA {
+				aGradient.SetRow(i, gradient.RawRowView(i))
+			} else {
+				bGradient.SetRow(i, gradient.RawRowView(i))
+			}
+		}
+		a.accumulate(aGradient)
+		b.accumulate(bGradient)
+	})
+}
+
+// rowMax takes the largest element of each row into one column, passing the gradient back to the first largest
+func (t *tape) rowMax(a *variable) *variable {
+
+	rows, _ := a.value.Dims()
+	value := mat.NewDense(rows, 1, nil)
+	largest := make([]int, rows)
+	for i := range largest {
+		row := a.value.RawRowView(i)
+		for j := range row {
+			if row[j] > row[largest[i]] {
+				largest[i] = j
+			}
+		}
+		value.Set(i, 0, row[largest[i]])
+	}
+
+	return t.record(value, func(gradient *mat.Dense) {
+		for i, j := range largest {
+			a.gradient.Set(i, j, a.gradient.At(i, j)+gradient.At(i, 0))
+		}
+	})
+}
+
+// detach passes a's value on without passing any gradient back, cutting the tape at that point
+func (t *tape) detach(a *variable) *variable {
+	return t.newVariable(a.value)
+}
+
+// repeat fills a rows x cols matrix by repeating m, which has one row, one column or the full size in each dimension
+func repeat(m *mat.Dense, rows, cols int) *mat.Dense {
+
+	mRows, mCols := m.Dims()
+	output := mat.NewDense(rows, cols, nil)
+	output.Apply(func(i, j int, _ float64) float64 { return m.At(min(i, mRows-1), min(j, mCols-1)) }, output)
+
+	return output
+}
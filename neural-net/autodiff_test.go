@@ -0,0 +1,284 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// Step for the finite differences and the largest relative error allowed against them
+const (
+	gradientEpsilon   = 1e-6
+	gradientTolerance = 1e-5
+)
+
+// gradientCase is a layer and a batch of input rows to check its backward pass with
+type gradientCase struct {
+	name  string
+	layer layer
+	input *mat.Dense
+}
+
+func TestLayerGradients(t *testing.T) {
+
+	r := rand.New(rand.NewSource(1))
+	cases, err := gradientCases(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if relativeError := checkLayerGradient(c.layer, c.input, r, gradientEpsilon); !(relativeError <= gradientTolerance) {
+				t.Errorf("relative error %.2e", relativeError)
+			}
+		})
+	}
+}
+
+func TestLossGradients(t *testing.T) {
+
+	// Losses are checked against outputs in (0, 1) and labels of 0 or 1
+	r := rand.New(rand.NewSource(1))
+	output := mat.NewDense(4, 3, nil)
+	output.Apply(func(_, _ int, _ float64) float64 { return 0.05 + 0.9*r.Float64() }, output)
+	labels := mat.NewDense(4, 3, nil)
+	labels.Apply(func(_, _ int, _ float64) float64 { return float64(r.Intn(2)) }, labels)
+	weights := mat.NewDense(4, 1, nil)
+	weights.Apply(func(_, _ int, _ float64) float64 { return 0.5 + r.Float64() }, weights)
+
+	// The remaining tape operations, combined into one scalar
+	operations := func(t *tape, output, labels *variable) *variable {
+		rows := t.div(t.exp(t.relu(t.sub(output, t.constant(0.5)))), t.add(t.sumAlong(1, t.softmax(output)), labels))
+		columns := t.square(t.sumAlong(0, t.mul(output, labels)))
+		return t.add(t.mean(rows), t.sum(columns))
+	}
+
+	for _, c := range []struct {
+		name    string
+		loss    lossFunction
+		weights *mat.Dense
+	}{
+		{"squared-error", lossFunctions["squared-error"], nil},
+		{"weighted squared-error", lossFunctions["squared-error"], weights},
+		{"cross-entropy", lossFunctions["cross-entropy"], nil},
+		{"weighted cross-entropy", lossFunctions["cross-entropy"], weights},
+		{"focal", lossFunctions["focal"], nil},
+		{"weighted focal", lossFunctions["focal"], weights},
+		{"tape operations", operations, nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if relativeError := checkLossGradient(c.loss, output, labels, c.weights, gradientEpsilon); !(relativeError <= gradientTolerance) {
+				t.Errorf("relative error %.2e", relativeError)
+			}
+		})
+	}
+}
+
+func TestEmbeddingSparseBackward(t *testing.T) {
+
+	// IDs repeat, so rows share vectors, and some wrap around the vocabularies
+	r := rand.New(rand.NewSource(1))
+	sparse, err := newEmbeddingLayer(4, []int{0, 2}, []int{3, 5}, 2, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tape := &embeddingLayer{width: sparse.width, columns: sparse.columns}
+	for _, table := range sparse.tables {
+		tape.tables = append(tape.tables, mat.DenseCopyOf(table))
+	}
+	x := randomNormalMatrix(8, 4, 1, r)
+	for n := 0; n < 8; n++ {
+		x.Set(n, 0, float64(n%2))
+		x.Set(n, 2, float64(n+1))
+	}
+	gradient := randomNormalMatrix(8, sparse.outputSize(), 1, r)
+
+	sparseGradient := sparse.backward(x, nil, gradient, 0.1)
+	tapeGradient := tapeBackward(tape, x, gradient, 0.1)
+
+	if !mat.EqualApprox(sparseGradient, tapeGradient, 1e-12) {
+		t.Errorf("input gradients differ:\n%v\n%v", mat.Formatted(sparseGradient), mat.Formatted(tapeGradient))
+	}
+	for i := range sparse.tables {
+		if !mat.EqualApprox(sparse.tables[i], tape.tables[i], 1e-12) {
+			t.Errorf("table %d differs:\n%v\n%v", i, mat.Formatted(sparse.tables[i]), mat.Formatted(tape.tables[i]))
+		}
+	}
+}
+
+func TestTruncatedBackpropagation(t *testing.T) {
+
+	r := rand.New(rand.NewSource(1))
+	sequence := sequenceShape{steps: 6, features: 2}
+	x := randomNormalMatrix(3, sequence.size(), 1, r)
+	for n := 0; n < 3; n++ {
+		x.Set(n, 0, 6)
+	}
+
+	for _, cell := range []string{"rnn", "lstm", "gru"} {
+		t.Run(cell, func(t *testing.T) {
+
+			// Only the last output has a gradient, so with chunks of 4 steps it can't reach the first 4
+			recurrent, err := newRecurrentLayer(cell, sequence, 3, false, 4, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			inputGradient := recurrent.backward(x, nil, randomNormalMatrix(3, 3, 1, r), 0)
+			for n := 0; n < 3; n++ {
+				for j := 1; j < sequence.size(); j++ {
+					if step := (j - 1) / sequence.features; (step < 4) != (inputGradient.At(n, j) == 0) {
+						t.Errorf("row %d step %d has a gradient of %g", n, step, inputGradient.At(n, j))
+					}
+				}
+			}
+		})
+	}
+}
+
+// gradientCases builds a small instance of every kind of layer
+func gradientCases(r *rand.Rand) ([]gradientCase, error) {
+
+	rows := func(n, cols int) *mat.Dense {
+		return randomNormalMatrix(n, cols, 1, r)
+	}
+
+	var cases []gradientCase
+	add := func(name string, layer layer, input *mat.Dense) {
+		cases = append(cases, gradientCase{name: name, layer: layer, input: input})
+	}
+
+	// Dense layers have weights in [0, 1) by default, so use normal weights to exercise the signs
+	add("dense", newNormalDenseLayer(4, 3, r), rows(5, 4))
+	for _, function := range []string{"sigmoid", "relu", "tanh", "softmax"} {
+		add(function, &activationLayer{function: function}, rows(5, 4))
+	}
+
+	image := imageShape{channels: 2, height: 5, width: 5}
+	conv, err := newConvLayer(image, 3, 3, 2, 1, r)
+	if err != nil {
+		return nil, err
+	}
+	add("conv", conv, rows(2, image.size()))
+	for _, mode := range []string{"max", "average"} {
+		pool, err := newPoolLayer(image, mode, 2, 1)
+		if err != nil {
+			return nil, err
+		}
+		add(mode+" pool", pool, rows(2, image.size()))
+	}
+
+	sequence := sequenceShape{steps: 4, features: 2}
+	sequences := rows(3, sequence.size())
+	for n := 0; n < 3; n++ {
+		sequences.Set(n, 0, float64(2+n%3)) // Lengths of 2 to 4 steps
+	}
+	for _, cell := range []string{"rnn", "lstm", "gru"} {
+		for _, returnSequences := range []bool{false, true} {
+			recurrent, err := newRecurrentLayer(cell, sequence, 3, returnSequences, 0, r)
+			if err != nil {
+				return nil, err
+			}
+			add(describeLayer(recurrent), recurrent, sequences)
+		}
+	}
+	add("time distributed dense", &timeDistributedLayer{inner: newNormalDenseLayer(2, 3, r), input: sequence}, sequences)
+
+	add("graph dense", newGraphDenseLayer(4, 3, r), rows(5, 4))
+	for _, function := range []string{"swish", "residual"} {
+		layer, err := newGraphLayer(function, randomNormalMatrix(4, 4, 0.5, r), randomNormalMatrix(1, 4, 0.5, r))
+		if err != nil {
+			return nil, err
+		}
+		add("graph "+function, layer, rows(5, 4))
+	}
+
+	// IDs repeat across rows and the last ones wrap around the vocabularies
+	ids := rows(6, 4)
+	for n := 0; n < 6; n++ {
+		ids.Set(n, 0, float64(n%3))
+		ids.Set(n, 2, float64(n))
+	}
+	embedding, err := newEmbeddingLayer(4, []int{0, 2}, []int{3, 4}, 2, r)
+	if err != nil {
+		return nil, err
+	}
+	add("embedding", embedding, ids)
+
+	return cases, nil
+}
+
+// checkLayerGradient compares a layer's gradients for its input and parameters with finite differences of
+// sum(upstream * output) for a random upstream gradient, returning the largest relative error
+func checkLayerGradient(layer layer, x *mat.Dense, r *rand.Rand, epsilon float64) float64 {
+
+	output := layer.forward(x)
+	outputRows, outputCols := output.Dims()
+	upstream := randomNormalMatrix(outputRows, outputCols, 1, r)
+
+	objective := func() float64 {
+		y := layer.forward(x)
+		y.MulElem(y, upstream)
+		return mat.Sum(y)
+	}
+
+	// A learning rate of 1 makes each parameter's adjustment equal to its gradient
+	parameters := layerParameters(layer)
+	before := make([]*mat.Dense, len(parameters))
+	for i, parameter := range parameters {
+		before[i] = mat.DenseCopyOf(parameter)
+	}
+	inputGradient := layer.backward(x, output, upstream, 1)
+	parameterGradients := make([]*mat.Dense, len(parameters))
+	for i, parameter := range parameters {
+		parameterGradients[i] = new(mat.Dense)
+		parameterGradients[i].Sub(before[i], parameter)
+		parameter.Copy(before[i])
+	}
+
+	worst := compareGradient(x, inputGradient, objective, epsilon)
+	for i, parameter := range parameters {
+		worst = math.Max(worst, compareGradient(parameter, parameterGradients[i], objective, epsilon))
+	}
+
+	return worst
+}
+
+// checkLossGradient compares a loss's gradient for the output with finite differences, returning the largest relative error
+func checkLossGradient(loss lossFunction, output, labels, weights *mat.Dense, epsilon float64) float64 {
+
+	_, gradient := lossGradient(loss, output, labels, weights)
+	objective := func() float64 {
+		value, _ := lossGradient(loss, output, labels, weights)
+		return value
+	}
+
+	return compareGradient(output, gradient, objective, epsilon)
+}
+
+// compareGradient nudges each element of m both ways and compares the central difference of
+// objective with gradient, returning the largest relative error
+func compareGradient(m, gradient *mat.Dense, objective func() float64, epsilon float64) float64 {
+
+	worst := 0.0
+	rows, cols := m.Dims()
+	for i := 0; i < rows; i++ {
+		for j := 0; j < cols; j++ {
+			original := m.At(i, j)
+			m.Set(i, j, original+epsilon)
+			plus := objective()
+			m.Set(i, j, original-epsilon)
+			minus := objective()
+			m.Set(i, j, original)
+
+			numerical := (plus - minus) / (2 * epsilon)
+			analytical := gradient.At(i, j)
+			scale := math.Max(1, math.Abs(numerical)+math.Abs(analytical))
+			worst = math.Max(worst, math.Abs(numerical-analytical)/scale)
+		}
+	}
+
+	return worst
+}
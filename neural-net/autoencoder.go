@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// autoencoderModes are the kinds of autoencoder autoencodeCommand trains
+var autoencoderModes = []string{"plain", "denoising", "sparse"}
+
+// newAutoencoder creates a network that squeezes width inputs through hidden layers of the given
+// sizes, the last of which is the code, and mirrors them back out to a linear reconstruction
+func newAutoencoder(width int, sizes []int, activation string, r *rand.Rand) (*network, error) {
+
+	if len(sizes) == 0 {
+		return nil, errors.New("an autoencoder needs at least 1 hidden layer")
+	}
+	if !isActivation(activation) || activation == "softmax" {
+		return nil, fmt.Errorf("unknown activation %q", activation)
+	}
+
+	network := &network{config: networkConf{
+		numberOfInputNodes:  width,
+		numberOfOutputNodes: width,
+		numberOfHiddenNodes: sizes[len(sizes)-1],
+		codeLayers:          2 * len(sizes),
+	}}
+
+	// The encoder, then the decoder back through the same sizes
+	inputSize := width
+	for _, size := range sizes {
+		if size < 1 {
+			return nil, fmt.Errorf("hidden layers need at least 1 node, got %d", size)
+		}
+		network.layers = append(network.layers, newNormalDenseLayer(inputSize, size, r), &activationLayer{function: activation})
+		inputSize = size
+	}
+	for i := len(sizes) - 2; i >= 0; i-- {
+		network.layers = append(network.layers, newNormalDenseLayer(inputSize, sizes[i], r), &activationLayer{function: activation})
+		inputSize = sizes[i]
+	}
+	network.layers = append(network.layers, newNormalDenseLayer(inputSize, width, r))
+
+	return network, nil
+}
+
+// isAutoencoder reports whether the network has an encoder to take codes from
+func (network *network) isAutoencoder() bool {
+	return network.config.codeLayers > 0 && network.config.codeLayers <= len(network.layers)
+}
+
+// codes passes rows through the encoder of an autoencoder
+func (network *network) codes(x *mat.Dense) (*mat.Dense, error) {
+
+	if !network.isAutoencoder() {
+		return nil, errors.New("the network isn't an autoencoder")
+	}
+
+	output := x
+	for _, layer := range network.layers[:network.config.codeLayers] {
+		output = layer.forward(output)
+	}
+
+	return output, nil
+}
+
+// reconstructionErrors returns the mean squared error of each row's reconstruction, its anomaly score
+func (network *network) reconstructionErrors(x *mat.Dense) ([]float64, error) {
+
+	reconstructed, err := network.predict(x)
+	if err != nil {
+		return nil, err
+	}
+
+	numberOfRows, width := x.Dims()
+	scores := make([]float64, numberOfRows)
+	difference := make([]float64, width)
+	for i := range scores {
+		floats.SubTo(difference, x.RawRowView(i), reconstructed.RawRowView(i))
+		scores[i] = floats.Dot(difference, difference) / float64(width)
+	}
+
+	return scores, nil
+}
+
+// reconstructStep adjusts the weights and biases once to reconstruct a batch of rows, and returns
+// the batch's squared reconstruction error. Denoising autoencoders see the rows with Gaussian noise
+// added, and sparse autoencoders pay an L1 penalty on their codes.
+func (network *network) reconstructStep(inputs *mat.Dense, r *rand.Rand) float64 {
+
+	corrupted := inputs
+	if network.config.noise > 0 {
+		corrupted = mat.DenseCopyOf(inputs)
+		corrupted.Apply(func(_, _ int, v float64) float64 { return v + network.config.noise*r.NormFloat64() }, corrupted)
+	}
+
+	activations := []*mat.Dense{corrupted}
+	for _, layer := range network.layers {
+		activations = append(activations, layer.forward(activations[len(activations)-1]))
+	}
+	output := activations[len(activations)-1]
+
+	// The targets are the clean rows
+	_, gradient := lossGradient(network.lossFunction(), output, inputs, nil)
+
+	for j := len(network.layers) - 1; j >= 0; j-- {
+		if j == network.config.codeLayers-1 && network.config.sparsity > 0 {
+			penalty := mat.DenseCopyOf(activations[j+1])
+			penalty.Apply(func(_, _ int, v float64) float64 { return network.config.sparsity * math.Copysign(1, v) }, penalty)
+			gradient.Add(gradient, penalty)
+		}
+		gradient = network.layers[j].backward(activations[j], activations[j+1], gradient, network.config.learningRate)
+	}
+
+	difference := new(mat.Dense)
+	difference.Sub(inputs, output)
+	return floats.Dot(difference.RawMatrix().Data, difference.RawMatrix().Data)
+}
+
+// autoencode trains an autoencoder on the rows of inputs, or on batches from a stream if stream has files
+func (network *network) autoencode(inputs *mat.Dense, stream streamConfig, r *rand.Rand) error {
+
+	if !network.isAutoencoder() {
+		return errors.New("the network isn't an autoencoder")
+	}
+	if err := network.checkLoss(); err != nil {
+		return err
+	}
+	batchSize := network.config.batchSize
+	if batchSize < 1 {
+		return errors.New("batches need at least 1 row")
+	}
+
+	for i := network.epoch; i < network.config.numberOfEpochs; i++ {
+
+		squaredError, values := 0.0, 0
+		if len(stream.files) > 0 {
+			batches := stream.open(r)
+			for {
+				batch, _, ok := batches.next()
+				if !ok {
+					break
+				}
+				squaredError += network.reconstructStep(batch, r)
+				rows, cols := batch.Dims()
+				values += rows * cols
+			}
+			if err := batches.close(); err != nil {
+				return err
+			}
+		} else {
+			numberOfRows, width := inputs.Dims()
+			shuffled := gatherRows(inputs, r.Perm(numberOfRows))
+			for start := 0; start < numberOfRows; start += batchSize {
+				end := min(start+batchSize, numberOfRows)
+				squaredError += network.reconstructStep(shuffled.Slice(start, end, 0, width).(*mat.Dense), r)
+			}
+			values = numberOfRows * width
+		}
+		if values == 0 {
+			return errors.New("no rows to train on")
+		}
+
+		network.epoch = i + 1
+		meanSquaredError := squaredError / float64(values)
+		if !network.quiet {
+			fmt.Printf("Epoch %d: reconstruction mean squared error %.6f\n", i+1, meanSquaredError)
+		}
+
+		if network.afterEpoch != nil {
+			if err := network.afterEpoch(meanSquaredError); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// newPretrainedClassifier creates a classifier from the encoder of an autoencoder, followed by a sigmoid output layer
+func newPretrainedClassifier(autoencoder *network, width, numberOfOutputs int, r *rand.Rand) (*network, error) {
+
+	if !autoencoder.isAutoencoder() {
+		return nil, errors.New("the pretrained network isn't an autoencoder")
+	}
+	if autoencoder.config.numberOfInputNodes != width {
+		return nil, fmt.Errorf("the autoencoder takes %d inputs, the rows have %d", autoencoder.config.numberOfInputNodes, width)
+	}
+
+	codes, err := autoencoder.codes(mat.NewDense(1, width, nil))
+	if err != nil {
+		return nil, err
+	}
+	_, codeSize := codes.Dims()
+
+	network := &network{config: networkConf{
+		numberOfInputNodes:  width,
+		numberOfOutputNodes: numberOfOutputs,
+		numberOfHiddenNodes: codeSize,
+	}}
+	network.layers = append(network.layers, autoencoder.layers[:autoencoder.config.codeLayers]...)
+	network.layers = append(network.layers, newNormalDenseLayer(codeSize, numberOfOutputs, r), &activationLayer{function: "sigmoid"})
+
+	return network, nil
+}
+
+// parseSizes parses a comma separated list of layer sizes
+func parseSizes(list string) ([]int, error) {
+
+	var sizes []int
+	for _, field := range strings.Split(list, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || size < 1 {
+			return nil, fmt.Errorf("bad layer size %q", field)
+		}
+		sizes = append(sizes, size)
+	}
+
+	return sizes, nil
+}
+
+// autoencodeCommand trains an autoencoder on rows of CSV or shard files, ignoring any labels
+func autoencodeCommand(args []string) error {
+
+	flags := flag.NewFlagSet("autoencode", flag.ExitOnError)
+	data := flags.String("data", "trainingData.csv", "comma separated CSV or .shard files or patterns of rows to reconstruct")
+	labelColumns := flags.Int("labels", 3, "number of trailing label columns to ignore (0 for unlabeled rows)")
+	stream := flags.Bool("stream", false, "read -data in batches instead of loading it")
+	shuffleBuffer := flags.Int("shuffle-buffer", 10000, "rows held back to shuffle streamed data")
+	prefetch := flags.Int("prefetch", 4, "batches of streamed data prepared ahead of training")
+	readers := flags.Int("readers", 1, "streamed files read at once, more than 1 makes runs unrepeatable")
+	mode := flags.String("mode", "plain", "kind of autoencoder: "+strings.Join(autoencoderModes, ", "))
+	noise := flags.Float64("noise", 0.1, "standard deviation of the noise added to the inputs of denoising autoencoders")
+	sparsity := flags.Float64("sparsity", 0.001, "weight of the L1 penalty on the codes of sparse autoencoders")
+	hidden := flags.String("hidden", "8,2", "comma separated sizes of the encoder's hidden layers, the last one is the code")
+	activation := flags.String("activation", "tanh", "activation of the hidden layers: sigmoid, relu or tanh")
+	epochs := flags.Int("epochs", 50, "number of passes over the rows")
+	batchSize := flags.Int("batch-size", 16, "rows per gradient step")
+	learningRate := flags.Float64("learning-rate", 0.1, "learning rate")
+	seed := flags.Int64("seed", 0, "random seed for the weights, row order and noise (0 for the time)")
+	modelFile := flags.String("model", "autoencoder.json", "file to save the trained autoencoder to")
+	flags.Parse(args)
+
+	if *labelColumns < 0 {
+		return errors.New("-labels can't be negative")
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	r := rand.New(rand.NewSource(*seed))
+
+	sizes, err := parseSizes(*hidden)
+	if err != nil {
+		return err
+	}
+
+	// Load the rows, or find their width and set up a stream over them
+	files, err := dataFiles(*data)
+	if err != nil {
+		return err
+	}
+	rows := streamConfig{files: files, labelColumns: *labelColumns, batchSize: *batchSize, shuffleBuffer: *shuffleBuffer, prefetch: *prefetch, readers: *readers}
+	var inputs *mat.Dense
+	var width int
+	if *stream {
+		if width, rows.outputs, err = rows.shape(); err != nil {
+			return err
+		}
+		rows.width = width
+	} else {
+		if inputs, err = rows.load(); err != nil {
+			return err
+		}
+		_, width = inputs.Dims()
+		rows.files = nil
+	}
+
+	network, err := newAutoencoder(width, sizes, *activation, r)
+	if err != nil {
+		return err
+	}
+	network.config.numberOfEpochs = *epochs
+	network.config.learningRate = *learningRate / float64(*batchSize)
+	network.config.batchSize = *batchSize
+	switch *mode {
+	case "plain":
+	case "denoising":
+		network.config.noise = *noise
+	case "sparse":
+		network.config.sparsity = *sparsity
+	default:
+		return fmt.Errorf("unknown mode %q, expected one of %s", *mode, strings.Join(autoencoderModes, ", "))
+	}
+
+	if err := network.autoencode(inputs, rows, r); err != nil {
+		return err
+	}
+
+	return network.save(*modelFile)
+}
+
+// load reads every row of the files into one matrix of inputs
+func (config streamConfig) load() (*mat.Dense, error) {
+
+	config.shuffleBuffer = 0
+	stream := config.open(nil)
+	var data []float64
+	width := 0
+	for {
+		inputs, _, ok := stream.next()
+		if !ok {
+			break
+		}
+		_, width = inputs.Dims()
+		data = append(data, inputs.RawMatrix().Data...)
+	}
+	if err := stream.close(); err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("the data files have no rows")
+	}
+
+	return mat.NewDense(len(data)/width, width, data), nil
+}
+
+// encodeCommand writes the codes and anomaly scores a saved autoencoder gives rows of CSV or shard files
+func encodeCommand(args []string) error {
+
+	flags := flag.NewFlagSet("encode", flag.ExitOnError)
+	modelFile := flags.String("model", "autoencoder.json", "saved autoencoder")
+	data := flags.String("data", "testingData.csv", "comma separated CSV or .shard files or patterns of rows to encode")
+	labelColumns := flags.Int("labels", 3, "number of trailing label columns to ignore (0 for unlabeled rows)")
+	embeddings := flags.String("embeddings", "", "CSV file to write each row's code to (optional)")
+	scores := flags.String("scores", "", "CSV file to write each row's anomaly score, its reconstruction error, to (optional)")
+	top := flags.Int("top", 10, "number of the most anomalous rows to list")
+	batchSize := flags.Int("batch-size", 1000, "rows encoded at a time")
+	flags.Parse(args)
+
+	if *labelColumns < 0 || *batchSize < 1 {
+		return errors.New("-labels can't be negative and -batch-size must be at least 1")
+	}
+
+	network, err := loadNetwork(*modelFile)
+	if err != nil {
+		return err
+	}
+	if !network.isAutoencoder() {
+		return fmt.Errorf("%s isn't an autoencoder", *modelFile)
+	}
+
+	files, err := dataFiles(*data)
+	if err != nil {
+		return err
+	}
+	rows := streamConfig{files: files, labelColumns: *labelColumns, batchSize: *batchSize, readers: 1, width: network.config.numberOfInputNodes}
+
+	var embeddingsFile, scoresFile *os.File
+	var embeddingsWriter, scoresWriter *bufio.Writer
+	if *embeddings != "" {
+		if embeddingsFile, err = os.Create(*embeddings); err != nil {
+			return err
+		}
+		defer embeddingsFile.Close()
+		embeddingsWriter = bufio.NewWriter(embeddingsFile)
+	}
+	if *scores != "" {
+		if scoresFile, err = os.Create(*scores); err != nil {
+			return err
+		}
+		defer scoresFile.Close()
+		scoresWriter = bufio.NewWriter(scoresFile)
+	}
+
+	// Rows are read in file order, so each output line matches its input row
+	stream := rows.open(nil)
+	var allScores []float64
+	for {
+		inputs, _, ok := stream.next()
+		if !ok {
+			break
+		}
+		batchScores, err := network.reconstructionErrors(inputs)
+		if err != nil {
+			stream.close()
+			return err
+		}
+		allScores = append(allScores, batchScores...)
+
+		if embeddingsWriter != nil {
+			codes, err := network.codes(inputs)
+			if err != nil {
+				stream.close()
+				return err
+			}
+			numberOfRows, _ := codes.Dims()
+			for i := 0; i < numberOfRows; i++ {
+				writeCSVRow(embeddingsWriter, codes.RawRowView(i))
+			}
+		}
+		if scoresWriter != nil {
+			for _, score := range batchScores {
+				writeCSVRow(scoresWriter, []float64{score})
+			}
+		}
+	}
+	if err := stream.close(); err != nil {
+		return err
+	}
+	for _, writer := range []*bufio.Writer{embeddingsWriter, scoresWriter} {
+		if writer == nil {
+			continue
+		}
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+	}
+	if len(allScores) == 0 {
+		return errors.New("the data files have no rows")
+	}
+
+	// Summarize the scores and list the rows least like the training rows
+	sorted := append([]float64(nil), allScores...)
+	sort.Float64s(sorted)
+	quantile := func(q float64) float64 { return sorted[min(int(q*float64(len(sorted))), len(sorted)-1)] }
+	fmt.Printf("%d rows, anomaly score mean %.6f, median %.6f, 95th percentile %.6f, 99th percentile %.6f, max %.6f\n",
+		len(allScores), floats.Sum(allScores)/float64(len(allScores)), quantile(0.5), quantile(0.95), quantile(0.99), sorted[len(sorted)-1])
+
+	order := make([]int, len(allScores))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return allScores[order[i]] > allScores[order[j]] })
+	fmt.Printf("\n%-8s %12s\n", "row", "score")
+	for _, i := range order[:min(*top, len(order))] {
+		fmt.Printf("%-8d %12.6f\n", i, allScores[i])
+	}
+
+	return nil
+}
+
+// writeCSVRow writes a row of numbers as a line of CSV
+func writeCSVRow(writer *bufio.Writer, row []float64) {
+	for j, v := range row {
+		if j > 0 {
+			writer.WriteByte(',')
+		}
+		writer.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	}
+	writer.WriteByte('\n')
+}
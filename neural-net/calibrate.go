@@ -0,0 +1,485 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// calibration maps a network's outputs to probabilities that match how often they're right
+type calibration struct {
+	method      string      // "platt", "isotonic" or "temperature"
+	softmax     bool        // The outputs sum to 1, so temperature scaling divides their logs and renormalizes
+	a, b        []float64   // Platt scaling of each output's log odds: sigmoid(a*logit(p) + b)
+	scores      [][]float64 // Isotonic regression of each output: increasing scores ...
+	values      [][]float64 // ... and the probabilities they map to, interpolated in between
+	temperature float64     // Divides the log odds, or log probabilities, of every output
+}
+
+// calibrationMethods are the ways fitCalibration can calibrate outputs
+var calibrationMethods = []string{"platt", "isotonic", "temperature"}
+
+// fitCalibration fits a calibration from a network's outputs and the labels for the same rows
+func fitCalibration(method string, outputs, labels *mat.Dense, softmax bool) (*calibration, error) {
+
+	numberOfRows, numberOfOutputs := outputs.Dims()
+	if labelRows, labelCols := labels.Dims(); labelRows != numberOfRows || labelCols != numberOfOutputs {
+		return nil, fmt.Errorf("%dx%d outputs but %dx%d labels", numberOfRows, numberOfOutputs, labelRows, labelCols)
+	}
+	if numberOfRows == 0 {
+		return nil, errors.New("no rows to calibrate with")
+	}
+
+	c := &calibration{method: method, softmax: softmax}
+	switch method {
+	case "platt":
+		for j := 0; j < numberOfOutputs; j++ {
+			a, b := fitPlatt(mat.Col(nil, j, outputs), mat.Col(nil, j, labels))
+			c.a, c.b = append(c.a, a), append(c.b, b)
+		}
+	case "isotonic":
+		for j := 0; j < numberOfOutputs; j++ {
+			scores, values := fitIsotonic(mat.Col(nil, j, outputs), mat.Col(nil, j, labels))
+			c.scores, c.values = append(c.scores, scores), append(c.values, values)
+		}
+	case "temperature":
+		c.temperature = fitTemperature(outputs, labels, softmax)
+	default:
+		return nil, fmt.Errorf("unknown calibration %q, expected one of %s", method, strings.Join(calibrationMethods, ", "))
+	}
+
+	return c, nil
+}
+
+// check makes sure a loaded calibration has parameters for numberOfOutputs outputs
+func (c *calibration) check(numberOfOutputs int) error {
+
+	switch c.method {
+	case "platt":
+		if len(c.a) != numberOfOutputs || len(c.b) != numberOfOutputs {
+			return fmt.Errorf("%d and %d Platt parameters for %d outputs", len(c.a), len(c.b), numberOfOutputs)
+		}
+	case "isotonic":
+		if len(c.scores) != numberOfOutputs || len(c.values) != numberOfOutputs {
+			return fmt.Errorf("%d and %d isotonic regressions for %d outputs", len(c.scores), len(c.values), numberOfOutputs)
+		}
+		for j := range c.scores {
+			if len(c.scores[j]) == 0 || len(c.scores[j]) != len(c.values[j]) || !sort.Float64sAreSorted(c.scores[j]) {
+				return fmt.Errorf("output %d has a bad isotonic regression", j)
+			}
+		}
+	case "temperature":
+		if c.temperature <= 0 {
+			return fmt.Errorf("temperature %v isn't positive", c.temperature)
+		}
+	default:
+		return fmt.Errorf("unknown calibration %q", c.method)
+	}
+
+	return nil
+}
+
+// apply returns the calibrated probabilities for a batch of outputs
+func (c *calibration) apply(outputs *mat.Dense) *mat.Dense {
+
+	numberOfRows, numberOfOutputs := outputs.Dims()
+	calibrated := mat.NewDense(numberOfRows, numberOfOutputs, nil)
+	for i := 0; i < numberOfRows; i++ {
+		row, calibratedRow := outputs.RawRowView(i), calibrated.RawRowView(i)
+		switch c.method {
+		case "platt":
+			for j, p := range row {
+				calibratedRow[j] = sigmoid(c.a[j]*logit(p) + c.b[j])
+			}
+		case "isotonic":
+			for j, p := range row {
+				calibratedRow[j] = interpolate(c.scores[j], c.values[j], p)
+			}
+		case "temperature":
+			scaleTemperature(calibratedRow, row, c.temperature, c.softmax)
+		}
+	}
+
+	return calibrated
+}
+
+// logit is the inverse of the sigmoid, with p clipped away from 0 and 1
+func logit(p float64) float64 {
+	p = clamp(p, 1e-7, 1-1e-7)
+	return math.Log(p / (1 - p))
+}
+
+// fitPlatt fits sigmoid(a*logit(p) + b) to the labels by Newton's method on the cross-entropy. As in
+// Platt's method, the labels are moved slightly away from 0 and 1 so a separable output still gets
+// finite parameters.
+func fitPlatt(p, labels []float64) (a, b float64) {
+
+	positives := 0.0
+	for _, label := range labels {
+		if label > 0.5 {
+			positives++
+		}
+	}
+	negatives := float64(len(labels)) - positives
+	high, low := (positives+1)/(positives+2), 1/(negatives+2)
+
+	x := make([]float64, len(p))
+	targets := make([]float64, len(p))
+	for i := range p {
+		x[i] = logit(p[i])
+		targets[i] = low
+		if labels[i] > 0.5 {
+			targets[i] = high
+		}
+	}
+
+	loss := func(a, b float64) float64 {
+		sum := 0.0
+		for i := range x {
+			q := clamp(sigmoid(a*x[i]+b), 1e-15, 1-1e-15)
+			sum -= targets[i]*math.Log(q) + (1-targets[i])*math.Log(1-q)
+		}
+		return sum
+	}
+
+	a, b = 1, 0
+	current := loss(a, b)
+	for iteration := 0; iteration < 100; iteration++ {
+
+		// Gradient and Hessian of the loss, with a little damping to keep the Hessian invertible
+		var ga, gb, haa, hab, hbb float64
+		for i := range x {
+			q := sigmoid(a*x[i] + b)
+			d, w := q-targets[i], q*(1-q)
+			ga += d * x[i]
+			gb += d
+			haa += w * x[i] * x[i]
+			hab += w * x[i]
+			hbb += w
+		}
+		haa, hbb = haa+1e-12, hbb+1e-12
+		determinant := haa*hbb - hab*hab
+		if math.Abs(ga)+math.Abs(gb) < 1e-10 || determinant <= 0 {
+			break
+		}
+		da, db := (hbb*ga-hab*gb)/determinant, (haa*gb-hab*ga)/determinant
+
+		// Halve the step until it lowers the loss
+		step := 1.0
+		for ; step > 1e-10; step /= 2 {
+			if next := loss(a-step*da, b-step*db); next < current {
+				a, b, current = a-step*da, b-step*db, next
+				break
+			}
+		}
+		if step <= 1e-10 {
+			break
+		}
+	}
+
+	return a, b
+}
+
+// fitIsotonic fits an increasing function of p to the labels with the pool adjacent violators
+// algorithm. It returns the mean score and value of each pooled block.
+func fitIsotonic(p, labels []float64) (scores, values []float64) {
+
+	order := make([]int, len(p))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return p[order[i]] < p[order[j]] })
+
+	// Rows with equal scores start in the same block, so the scores of the blocks are distinct
+	var sums, weights []float64
+	for k, i := range order {
+		if k > 0 && p[i] == p[order[k-1]] {
+			last := len(sums) - 1
+			sums[last] += labels[i]
+			weights[last]++
+			continue
+		}
+		scores = append(scores, p[i])
+		sums = append(sums, labels[i])
+		weights = append(weights, 1)
+	}
+	scoreSums := make([]float64, len(scores))
+	for k := range scores {
+		scoreSums[k] = scores[k] * weights[k]
+	}
+
+	// Merge each block into the one before it while their means decrease
+	n := 0
+	for k := range sums {
+		sums[n], weights[n], scoreSums[n] = sums[k], weights[k], scoreSums[k]
+		for n > 0 && sums[n-1]/weights[n-1] >= sums[n]/weights[n] {
+			sums[n-1] += sums[n]
+			weights[n-1] += weights[n]
+			scoreSums[n-1] += scoreSums[n]
+			n--
+		}
+		n++
+	}
+
+	scores, values = make([]float64, n), make([]float64, n)
+	for k := 0; k < n; k++ {
+		scores[k] = scoreSums[k] / weights[k]
+		values[k] = sums[k] / weights[k]
+	}
+
+	return scores, values
+}
+
+// interpolate returns the value at x of the line through the points (xs, ys), flat beyond its ends
+func interpolate(xs, ys []float64, x float64) float64 {
+
+	k := sort.SearchFloat64s(xs, x)
+	switch {
+	case k == 0:
+		return ys[0]
+	case k == len(xs):
+		return ys[len(ys)-1]
+	}
+
+	t := (x - xs[k-1]) / (xs[k] - xs[k-1])
+	return ys[k-1] + t*(ys[k]-ys[k-1])
+}
+
+// scaleTemperature divides the log odds of each output by temperature, or the log probabilities
+// followed by a softmax if the outputs come from one
+func scaleTemperature(dst, outputs []float64, temperature float64, softmax bool) {
+
+	if !softmax {
+		for j, p := range outputs {
+			dst[j] = sigmoid(logit(p) / temperature)
+		}
+		return
+	}
+
+	for j, p := range outputs {
+		dst[j] = math.Log(math.Max(p, 1e-300)) / temperature
+	}
+	largest := floats.Max(dst)
+	for j := range dst {
+		dst[j] = math.Exp(dst[j] - largest)
+	}
+	floats.Scale(1/floats.Sum(dst), dst)
+}
+
+// fitTemperature finds the temperature with the lowest cross-entropy by a golden section search over its log
+func fitTemperature(outputs, labels *mat.Dense, softmax bool) float64 {
+
+	numberOfRows, numberOfOutputs := outputs.Dims()
+	scaled := make([]float64, numberOfOutputs)
+	loss := func(logTemperature float64) float64 {
+		sum := 0.0
+		for i := 0; i < numberOfRows; i++ {
+			scaleTemperature(scaled, outputs.RawRowView(i), math.Exp(logTemperature), softmax)
+			for j, label := range labels.RawRowView(i) {
+				q := clamp(scaled[j], 1e-15, 1-1e-15)
+				sum -= label * math.Log(q)
+				if !softmax {
+					sum -= (1 - label) * math.Log(1-q)
+				}
+			}
+		}
+		return sum
+	}
+
+	ratio := (math.Sqrt(5) - 1) / 2
+	low, high := math.Log(0.01), math.Log(100)
+	x1, x2 := high-ratio*(high-low), low+ratio*(high-low)
+	f1, f2 := loss(x1), loss(x2)
+	for high-low > 1e-6 {
+		if f1 < f2 {
+			high, x2, f2 = x2, x1, f1
+			x1 = high - ratio*(high-low)
+			f1 = loss(x1)
+		} else {
+			low, x1, f1 = x1, x2, f2
+			x2 = low + ratio*(high-low)
+			f2 = loss(x2)
+		}
+	}
+
+	return math.Exp((low + high) / 2)
+}
+
+// reliabilityBin is one bar of a reliability diagram
+type reliabilityBin struct {
+	low, high  float64 // Range of the confidences in the bin
+	count      int     // Predictions in the bin
+	confidence float64 // Mean confidence of the predictions
+	accuracy   float64 // Fraction of the predictions that were right
+}
+
+// reliability bins each row's top prediction by its confidence, and returns the bins and the expected
+// calibration error: the mean gap between confidence and accuracy, weighted by the predictions in each bin
+func reliability(outputs, labels *mat.Dense, numberOfBins int) ([]reliabilityBin, float64) {
+
+	numberOfRows, _ := outputs.Dims()
+	confidences, hits := make([]float64, numberOfRows), make([]float64, numberOfRows)
+	for i := 0; i < numberOfRows; i++ {
+		row := outputs.RawRowView(i)
+		prediction := floats.MaxIdx(row)
+		confidences[i] = row[prediction]
+		if prediction == labelClass(labels.RawRowView(i)) {
+			hits[i] = 1
+		}
+	}
+
+	return binReliability(confidences, hits, numberOfBins)
+}
+
+// classwiseReliability treats every output of every row as a separate prediction that its label is 1,
+// which suits outputs that don't sum to 1
+func classwiseReliability(outputs, labels *mat.Dense, numberOfBins int) ([]reliabilityBin, float64) {
+
+	confidences := outputs.RawMatrix().Data
+	hits := make([]float64, len(confidences))
+	for k, label := range labels.RawMatrix().Data {
+		if label > 0.5 {
+			hits[k] = 1
+		}
+	}
+
+	return binReliability(confidences, hits, numberOfBins)
+}
+
+// binReliability sorts predictions into numberOfBins equal bins of confidence between 0 and 1
+func binReliability(confidences, hits []float64, numberOfBins int) ([]reliabilityBin, float64) {
+
+	bins := make([]reliabilityBin, numberOfBins)
+	for k := range bins {
+		bins[k].low, bins[k].high = float64(k)/float64(numberOfBins), float64(k+1)/float64(numberOfBins)
+	}
+	for i, confidence := range confidences {
+		k := min(int(clamp(confidence, 0, 1)*float64(numberOfBins)), numberOfBins-1)
+		bins[k].count++
+		bins[k].confidence += confidence
+		bins[k].accuracy += hits[i]
+	}
+
+	calibrationError := 0.0
+	for k := range bins {
+		if bins[k].count == 0 {
+			continue
+		}
+		bins[k].confidence /= float64(bins[k].count)
+		bins[k].accuracy /= float64(bins[k].count)
+		calibrationError += float64(bins[k].count) / float64(len(confidences)) * math.Abs(bins[k].accuracy-bins[k].confidence)
+	}
+
+	return bins, calibrationError
+}
+
+// printReliability prints a reliability diagram as a table with a bar for the accuracy of each bin
+func printReliability(title string, bins []reliabilityBin, calibrationError float64) {
+
+	fmt.Printf("%s (expected calibration error %.4f)\n", title, calibrationError)
+	fmt.Printf("%-11s %7s %10s %9s  %s\n", "confidence", "count", "mean conf", "accuracy", "accuracy (|) against confidence (+)")
+	for _, bin := range bins {
+		if bin.count == 0 {
+			fmt.Printf("%.2f-%.2f  %7d\n", bin.low, bin.high, 0)
+			continue
+		}
+		bar := []byte(strings.Repeat(" ", 41))
+		for k := 0; k < int(math.Round(bin.accuracy*40)); k++ {
+			bar[k] = '|'
+		}
+		bar[int(math.Round(bin.confidence*40))] = '+'
+		fmt.Printf("%.2f-%.2f  %7d %10.4f %9.4f  %s\n", bin.low, bin.high, bin.count, bin.confidence, bin.accuracy, strings.TrimRight(string(bar), " "))
+	}
+}
+
+// endsInSoftmax reports whether the network's last layer is a softmax
+func (network *network) endsInSoftmax() bool {
+	if len(network.layers) == 0 {
+		return false
+	}
+	last, ok := network.layers[len(network.layers)-1].(*activationLayer)
+	return ok && last.function == "softmax"
+}
+
+// calibrateCommand fits a calibration to a saved model's outputs on validation rows and saves it with the model
+func calibrateCommand(args []string) error {
+
+	flags := flag.NewFlagSet("calibrate", flag.ExitOnError)
+	modelFile := flags.String("model", "", "saved model to calibrate")
+	data := flags.String("data", "testingData.csv", "CSV file of validation rows to fit the calibration on, with the labels in the last columns")
+	evaluationData := flags.String("evaluation-data", "", "CSV file of rows to report the calibration on (defaults to -data)")
+	labelColumns := flags.Int("labels", 3, "number of label columns, 1 for a single column holding a class number")
+	method := flags.String("method", "temperature", "calibration to fit: "+strings.Join(calibrationMethods, ", ")+" or none to remove it")
+	numberOfBins := flags.Int("bins", 10, "bins of the reliability diagrams")
+	output := flags.String("output", "", "file to save the calibrated model to (defaults to -model)")
+	flags.Parse(args)
+
+	if *modelFile == "" {
+		return errors.New("-model is needed")
+	}
+	if *numberOfBins < 1 {
+		return errors.New("-bins must be at least 1")
+	}
+	if *evaluationData == "" {
+		*evaluationData = *data
+	}
+	if *output == "" {
+		*output = *modelFile
+	}
+
+	network, err := loadNetwork(*modelFile)
+	if err != nil {
+		return err
+	}
+
+	// Fit to the network's own outputs, replacing any calibration it has
+	network.calibration = nil
+	inputs, labels, _, err := loadCategorical(*data, nil, *labelColumns, network.config.numberOfOutputNodes)
+	if err != nil {
+		return err
+	}
+	outputs, err := network.predict(inputs)
+	if err != nil {
+		return err
+	}
+	if *method != "none" {
+		if network.calibration, err = fitCalibration(*method, outputs, labels, network.endsInSoftmax()); err != nil {
+			return err
+		}
+	}
+
+	// Report on the evaluation rows before and after calibrating
+	evaluationInputs, evaluationLabels, _, err := loadCategorical(*evaluationData, nil, *labelColumns, network.config.numberOfOutputNodes)
+	if err != nil {
+		return err
+	}
+	calibration := network.calibration
+	network.calibration = nil
+	before, err := network.predict(evaluationInputs)
+	if err != nil {
+		return err
+	}
+	network.calibration = calibration
+	after, err := network.predict(evaluationInputs)
+	if err != nil {
+		return err
+	}
+
+	for _, report := range []struct {
+		name    string
+		outputs *mat.Dense
+	}{{"Before calibrating", before}, {"After calibrating with " + *method, after}} {
+		bins, calibrationError := reliability(report.outputs, evaluationLabels, *numberOfBins)
+		printReliability(report.name+", top prediction", bins, calibrationError)
+		_, classwiseError := classwiseReliability(report.outputs, evaluationLabels, *numberOfBins)
+		fmt.Printf("Classwise expected calibration error %.4f\n\n", classwiseError)
+	}
+
+	return network.save(*output)
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// checkpointFormat identifies the checkpoint files written during nn train
+const checkpointFormat = "neural-net/checkpoint/v1"
+
+// checkpoint is the JSON file format of a training run part way through
+type checkpoint struct {
+	Format     string                 `json:"format"`               // Always checkpointFormat
+	Flags      map[string]string      `json:"flags"`                // Settings of the train command
+	Model      savedModel             `json:"model"`                // The network and its config
+	Velocities map[string]savedMatrix `json:"velocities,omitempty"` // Momentum of each parameter by its index
+	Epoch      int                    `json:"epoch"`                // Number of epochs trained
+	Seed       int64                  `json:"seed"`                 // Seed of the random source
+	Draws      int64                  `json:"draws"`                // Values taken from the random source so far
+	History    []epochMetrics         `json:"history"`              // Metrics of every epoch so far
+	Best       epochMetrics           `json:"best"`                 // Metrics of the epoch with the lowest validation error
+}
+
+// epochMetrics are measured after each epoch
+type epochMetrics struct {
+	Epoch              int     `json:"epoch"`
+	TrainingError      float64 `json:"trainingError"`      // Mean squared error over the epoch's batches
+	ValidationError    float64 `json:"validationError"`    // Mean squared error on the validation rows
+	ValidationAccuracy float64 `json:"validationAccuracy"` // Accuracy on the validation rows
+	BalancedAccuracy   float64 `json:"balancedAccuracy"`   // Mean accuracy over the validation rows of each class
+}
+
+// countingSource is a random source that counts the values taken from it, so its state can be saved and restored
+type countingSource struct {
+	source rand.Source64
+	seed   int64
+	draws  int64
+}
+
+// newCountingSource creates a source from seed that has already had draws values taken from it
+func newCountingSource(seed, draws int64) *countingSource {
+	s := &countingSource{source: rand.NewSource(seed).(rand.Source64), seed: seed}
+	for s.draws < draws {
+		s.Int63()
+	}
+	return s
+}
+
+// Int63 returns a non-negative 63 bit value
+func (s *countingSource) Int63() int64 {
+	s.draws++
+	return s.source.Int63()
+}
+
+// Uint64 returns a 64 bit value
+func (s *countingSource) Uint64() uint64 {
+	s.draws++
+	return s.source.Uint64()
+}
+
+// Seed restarts the source from a seed
+func (s *countingSource) Seed(seed int64) {
+	s.source.Seed(seed)
+	s.seed, s.draws = seed, 0
+}
+
+// trainCommand trains a classifier on CSV files, writing checkpoints it can be resumed from
+func trainCommand(args []string) error {
+
+	flags := flag.NewFlagSet("train", flag.ExitOnError)
+	data := flags.String("data", "trainingData.csv", "CSV file of training rows, with the labels in the last columns")
+	validationData := flags.String("validation-data", "testingData.csv", "CSV file of validation rows (\"none\" for none)")
+	labelColumns := flags.Int("labels", 3, "number of label columns, 1 for a single column holding a class number")
+	categorical := flags.String("categorical", "", "comma separated columns (from 0) holding integer IDs to embed")
+	dimensions := flags.Int("dimensions", 8, "length of each embedding vector")
+	stream := flags.Bool("stream", false, "read -data and -validation-data in batches instead of loading them, both may list several CSV or .shard files and patterns")
+	classes := flags.Int("classes", 0, "number of classes when streaming with -labels 1")
+	vocabulary := flags.Int("vocabulary", 0, "vectors per ID column when streaming with -categorical")
+	shuffleBuffer := flags.Int("shuffle-buffer", 10000, "rows held back to shuffle streamed data")
+	prefetch := flags.Int("prefetch", 4, "batches of streamed data prepared ahead of training")
+	readers := flags.Int("readers", 1, "streamed files read at once, more than 1 makes runs unrepeatable")
+	hidden := flags.Int("hidden", 8, "number of hidden nodes")
+	activation := flags.String("activation", "sigmoid", "activation of the hidden layer: sigmoid, relu or tanh")
+	epochs := flags.Int("epochs", 100, "number of passes over the training rows")
+	batchSize := flags.Int("batch-size", 16, "rows per gradient step")
+	learningRate := flags.Float64("learning-rate", 0.5, "learning rate")
+	momentum := flags.Float64("momentum", 0, "fraction of the previous adjustment added to each adjustment")
+	loss := flags.String("loss", "squared-error", "loss to train with: squared-error, cross-entropy or focal")
+	focalGamma := flags.Float64("focal-gamma", 2, "focusing parameter of the focal loss, higher values ignore easy rows more")
+	classWeights := flags.String("class-weights", "", "comma separated loss weight of each class, or \"balanced\" to weight classes by the inverse of their size")
+	sampler := flags.String("sampler", "none", "rows used per epoch: none, oversample to repeat rows of smaller classes or undersample to drop rows of larger classes")
+	sampleWeightsFile := flags.String("sample-weights", "", "file with a loss weight for each training row, one per line (optional)")
+	seed := flags.Int64("seed", 0, "random seed for the weights and the row order (0 for the time)")
+	checkpointDir := flags.String("checkpoint-dir", "checkpoints", "directory to write checkpoints to (\"none\" for none)")
+	checkpointEvery := flags.Int("checkpoint-every", 1, "epochs between checkpoints")
+	keepLast := flags.Int("keep-last", 3, "number of most recent checkpoints to keep (0 for all)")
+	keepBest := flags.Int("keep-best", 1, "number of checkpoints with the lowest validation error to keep as well")
+	pretrained := flags.String("pretrained", "", "autoencoder whose encoder replaces the hidden layer (optional)")
+	resume := flags.String("resume", "", "checkpoint file, or directory of checkpoints, to continue training from")
+	modelFile := flags.String("model", "", "file to save the trained model to (optional)")
+	flags.Parse(args)
+
+	// Resumed runs take their settings from the checkpoint, except for flags given again
+	var resumed *checkpoint
+	if *resume != "" {
+		fileName, err := findCheckpoint(*resume)
+		if err != nil {
+			return err
+		}
+		if resumed, err = readCheckpoint(fileName); err != nil {
+			return err
+		}
+
+		given := make(map[string]bool)
+		flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+		for name, value := range resumed.Flags {
+			if !given[name] && flags.Lookup(name) != nil {
+				if err := flags.Set(name, value); err != nil {
+					return fmt.Errorf("%s: flag -%s: %v", fileName, name, err)
+				}
+			}
+		}
+		fmt.Printf("Resuming from %s after epoch %d\n", fileName, resumed.Epoch)
+	}
+
+	if *labelColumns < 1 {
+		return errors.New("-labels must be at least 1, use nn autoencode for unlabeled rows")
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	settings := make(map[string]string)
+	flags.VisitAll(func(f *flag.Flag) {
+		if f.Name != "resume" {
+			settings[f.Name] = f.Value.String()
+		}
+	})
+
+	columns, err := parseColumns(*categorical)
+	if err != nil {
+		return err
+	}
+
+	// Load the data, or find its shape and set up streams over it
+	var inputs, labels *mat.Dense
+	var vocabularies []int
+	var width, numberOfOutputs int
+	var streamed, validationStreamed streamConfig
+	var sampleWeights *mat.Dense
+	var counts []float64                                                   // Training rows of each class, if needed
+	var validate func(network *network) (float64, float64, float64, error) // Validation error, accuracy and balanced accuracy
+	if *stream {
+		if *sampleWeightsFile != "" {
+			return errors.New("-sample-weights can't be used with -stream")
+		}
+		if *labelColumns == 1 && *classes < 1 {
+			return errors.New("-classes is needed to stream with -labels 1")
+		}
+		if len(columns) > 0 && *vocabulary < 1 {
+			return errors.New("-vocabulary is needed to stream with -categorical")
+		}
+		for range columns {
+			vocabularies = append(vocabularies, *vocabulary)
+		}
+
+		files, err := dataFiles(*data)
+		if err != nil {
+			return err
+		}
+		streamed = streamConfig{files: files, labelColumns: *labelColumns, classes: *classes, batchSize: *batchSize, shuffleBuffer: *shuffleBuffer, prefetch: *prefetch, readers: *readers}
+		if width, numberOfOutputs, err = streamed.shape(); err != nil {
+			return err
+		}
+		streamed.width, streamed.outputs = width, numberOfOutputs
+
+		if *validationData != "none" {
+			validationStreamed = streamed
+			if validationStreamed.files, err = dataFiles(*validationData); err != nil {
+				return err
+			}
+			validate = func(network *network) (float64, float64, float64, error) {
+				return network.evaluateStream(validationStreamed)
+			}
+		}
+
+		// Balancing the classes takes a pass over the files to count them
+		if *classWeights == "balanced" || (*sampler != "" && *sampler != "none") {
+			if counts, err = streamed.classCounts(); err != nil {
+				return err
+			}
+			if streamed.rates, err = samplingRates(counts, *sampler); err != nil {
+				return err
+			}
+		}
+	} else {
+		if inputs, labels, vocabularies, err = loadCategorical(*data, columns, *labelColumns, 0); err != nil {
+			return err
+		}
+		_, width = inputs.Dims()
+		_, numberOfOutputs = labels.Dims()
+		counts = classCounts(labels)
+
+		if *sampleWeightsFile != "" {
+			rows, _ := inputs.Dims()
+			if sampleWeights, err = loadSampleWeights(*sampleWeightsFile, rows); err != nil {
+				return err
+			}
+		}
+
+		if *validationData != "none" {
+			validationInputs, validationLabels, _, err := loadCategorical(*validationData, columns, *labelColumns, numberOfOutputs)
+			if err != nil {
+				return err
+			}
+			if _, validationOutputs := validationLabels.Dims(); validationOutputs != numberOfOutputs {
+				return fmt.Errorf("validation rows have %d outputs, training rows have %d", validationOutputs, numberOfOutputs)
+			}
+			validate = func(network *network) (float64, float64, float64, error) {
+				outputs, err := network.predict(validationInputs)
+				if err != nil {
+					return 0, 0, 0, err
+				}
+				difference := new(mat.Dense)
+				difference.Sub(validationLabels, outputs)
+				rows, cols := difference.Dims()
+				return floats.Dot(difference.RawMatrix().Data, difference.RawMatrix().Data) / float64(rows*cols), calcAccuracy(outputs, validationLabels), calcBalancedAccuracy(outputs, validationLabels), nil
+			}
+		}
+	}
+
+	// Build the network, or restore it and the random source from the checkpoint
+	var network *network
+	var source *countingSource
+	var history []epochMetrics
+	if resumed != nil {
+		if network, source, err = resumed.restore(); err != nil {
+			return err
+		}
+		history = resumed.History
+	} else {
+		source = newCountingSource(*seed, 0)
+		if *pretrained != "" {
+			if len(columns) > 0 {
+				return errors.New("-pretrained can't be used with -categorical")
+			}
+			autoencoder, err := loadNetwork(*pretrained)
+			if err != nil {
+				return err
+			}
+			if network, err = newPretrainedClassifier(autoencoder, width, numberOfOutputs, rand.New(source)); err != nil {
+				return fmt.Errorf("%s: %v", *pretrained, err)
+			}
+		} else if network, err = newClassifier(width, numberOfOutputs, *hidden, *activation, columns, vocabularies, *dimensions, rand.New(source)); err != nil {
+			return err
+		}
+	}
+	network.config.numberOfEpochs = *epochs
+	network.config.learningRate = *learningRate / float64(*batchSize)
+	network.config.batchSize = *batchSize
+	network.config.momentum = *momentum
+	network.config.loss = *loss
+	network.config.focalGamma = *focalGamma
+	network.config.sampler = *sampler
+	if network.config.classWeights, err = parseClassWeights(*classWeights, counts); err != nil {
+		return err
+	}
+	network.shuffle = rand.New(source)
+
+	// Measure each epoch and write the checkpoints
+	network.afterEpoch = func(trainingError float64) error {
+
+		metrics := epochMetrics{Epoch: network.epoch, TrainingError: trainingError, ValidationError: trainingError}
+		if validate != nil {
+			var err error
+			if metrics.ValidationError, metrics.ValidationAccuracy, metrics.BalancedAccuracy, err = validate(network); err != nil {
+				return err
+			}
+			fmt.Printf("Epoch %d: validation mean squared error %.6f, accuracy %.4f, balanced accuracy %.4f\n", network.epoch, metrics.ValidationError, metrics.ValidationAccuracy, metrics.BalancedAccuracy)
+		}
+		history = append(history, metrics)
+
+		if *checkpointDir == "none" || (network.epoch%*checkpointEvery != 0 && network.epoch != *epochs) {
+			return nil
+		}
+		if err := writeCheckpoint(*checkpointDir, network, source, settings, history); err != nil {
+			return err
+		}
+		return pruneCheckpoints(*checkpointDir, history, *keepLast, *keepBest)
+	}
+
+	// Train the neural network
+	if *stream {
+		err = network.propagateStream(streamed)
+	} else {
+		err = network.train(inputs, labels, sampleWeights, 0)
+	}
+	if err != nil {
+		return err
+	}
+
+	if best := bestEpoch(history); best.Epoch > 0 {
+		fmt.Printf("\nBest epoch %d: validation mean squared error %.6f, accuracy %.4f, balanced accuracy %.4f\n", best.Epoch, best.ValidationError, best.ValidationAccuracy, best.BalancedAccuracy)
+	}
+
+	if *modelFile != "" {
+		return network.save(*modelFile)
+	}
+
+	return nil
+}
+
+// newClassifier creates a network with an optional embedding layer, one hidden layer and a sigmoid output layer
+func newClassifier(width, numberOfOutputs, hidden int, activation string, columns, vocabularies []int, dimensions int, r *rand.Rand) (*network, error) {
+
+	if !isActivation(activation) {
+		return nil, fmt.Errorf("unknown activation %q", activation)
+	}
+
+	network := &network{config: networkConf{
+		numberOfInputNodes:  width,
+		numberOfOutputNodes: numberOfOutputs,
+		numberOfHiddenNodes: hidden,
+	}}
+
+	inputSize := width
+	if len(columns) > 0 {
+		embedding, err := newEmbeddingLayer(width, columns, vocabularies, dimensions, r)
+		if err != nil {
+			return nil, err
+		}
+		network.layers = append(network.layers, embedding)
+		inputSize = embedding.outputSize()
+	}
+
+	network.layers = append(network.layers,
+		newNormalDenseLayer(inputSize, hidden, r),
+		&activationLayer{function: activation},
+		newNormalDenseLayer(hidden, numberOfOutputs, r),
+		&activationLayer{function: "sigmoid"},
+	)
+
+	return network, nil
+}
+
+// bestEpoch returns the metrics of the epoch with the lowest validation error
+func bestEpoch(history []epochMetrics) epochMetrics {
+	var best epochMetrics
+	for _, metrics := range history {
+		if best.Epoch == 0 || metrics.ValidationError < best.ValidationError {
+			best = metrics
+		}
+	}
+	return best
+}
+
+// checkpointName returns the file name of the checkpoint after an epoch
+func checkpointName(dir string, epoch int) string {
+	return filepath.Join(dir, fmt.Sprintf("epoch-%06d.json", epoch))
+}
+
+// writeCheckpoint writes the state of a training run to the directory. The file is written under a
+// temporary name and then renamed, so an interrupted write can't leave a broken checkpoint.
+func writeCheckpoint(dir string, network *network, source *countingSource, settings map[string]string, history []epochMetrics) error {
+
+	model, err := network.encode()
+	if err != nil {
+		return err
+	}
+
+	saved := checkpoint{
+		Format:  checkpointFormat,
+		Flags:   settings,
+		Model:   model,
+		Epoch:   network.epoch,
+		Seed:    source.seed,
+		Draws:   source.draws,
+		History: history,
+		Best:    bestEpoch(history),
+	}
+	if len(network.velocities) > 0 {
+		saved.Velocities = make(map[string]savedMatrix)
+		for i, velocity := range network.velocities {
+			saved.Velocities[fmt.Sprint(i)] = encodeMatrix(velocity)
+		}
+	}
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "checkpoint-*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), checkpointName(dir, network.epoch))
+}
+
+// readCheckpoint reads a checkpoint written by writeCheckpoint
+func readCheckpoint(fileName string) (*checkpoint, error) {
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var saved checkpoint
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	if saved.Format != checkpointFormat {
+		return nil, fmt.Errorf("%s: unknown checkpoint format %q", fileName, saved.Format)
+	}
+
+	return &saved, nil
+}
+
+// restore rebuilds the network, its momentum and the random source of a checkpoint, ready to train on from its epoch
+func (saved *checkpoint) restore() (*network, *countingSource, error) {
+
+	network, err := decodeNetwork(saved.Model)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := 0; i < len(saved.Velocities); i++ {
+		velocity, err := decodeMatrix(saved.Velocities, fmt.Sprint(i))
+		if err != nil {
+			return nil, nil, err
+		}
+		network.velocities = append(network.velocities, velocity)
+	}
+	network.epoch = saved.Epoch
+
+	return network, newCountingSource(saved.Seed, saved.Draws), nil
+}
+
+// checkpointEpochs returns the epochs of the checkpoints in a directory, in increasing order
+func checkpointEpochs(dir string) ([]int, error) {
+
+	fileNames, err := filepath.Glob(filepath.Join(dir, "epoch-*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var epochs []int
+	for _, fileName := range fileNames {
+		var epoch int
+		if _, err := fmt.Sscanf(filepath.Base(fileName), "epoch-%d.json", &epoch); err == nil {
+			epochs = append(epochs, epoch)
+		}
+	}
+	sort.Ints(epochs)
+
+	return epochs, nil
+}
+
+// findCheckpoint returns path if it's a file, or the latest checkpoint in it if it's a directory
+func findCheckpoint(path string) (string, error) {
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return path, nil
+	}
+
+	epochs, err := checkpointEpochs(path)
+	if err != nil {
+		return "", err
+	}
+	if len(epochs) == 0 {
+		return "", fmt.Errorf("no checkpoints in %s", path)
+	}
+
+	return checkpointName(path, epochs[len(epochs)-1]), nil
+}
+
+// pruneCheckpoints removes every checkpoint except the keepLast most recent and the keepBest with
+// the lowest validation error. Nothing is removed if keepLast is 0.
+func pruneCheckpoints(dir string, history []epochMetrics, keepLast, keepBest int) error {
+
+	if keepLast <= 0 {
+		return nil
+	}
+
+	epochs, err := checkpointEpochs(dir)
+	if err != nil {
+		return err
+	}
+
+	keep := make(map[int]bool)
+	for _, epoch := range epochs[max(0, len(epochs)-keepLast):] {
+		keep[epoch] = true
+	}
+
+	// Rank the checkpointed epochs by their validation error
+	validationErrors := make(map[int]float64)
+	for _, metrics := range history {
+		validationErrors[metrics.Epoch] = metrics.ValidationError
+	}
+	ranked := append([]int(nil), epochs...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return validationErrors[ranked[i]] < validationErrors[ranked[j]]
+	})
+	for _, epoch := range ranked[:min(keepBest, len(ranked))] {
+		keep[epoch] = true
+	}
+
+	for _, epoch := range epochs {
+		if !keep[epoch] {
+			if err := os.Remove(checkpointName(dir, epoch)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
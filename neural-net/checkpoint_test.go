@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestResumeMatchesUninterrupted(t *testing.T) {
+
+	const epochs = 6
+
+	d, err := generate("blobs", generatorConf{rows: 60, features: 3, classes: 3, spread: 1}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs, labels := d.inputs, d.labels()
+
+	for _, momentum := range []float64{0, 0.9} {
+		for _, shuffle := range []bool{false, true} {
+			t.Run(fmt.Sprintf("momentum=%g/shuffle=%v", momentum, shuffle), func(t *testing.T) {
+
+				// train runs a network on to the given epoch, drawing from its own source to shuffle if needed
+				train := func(network *network, source *countingSource, epoch int) {
+					network.config.numberOfEpochs = epoch
+					network.quiet = true
+					if shuffle {
+						network.shuffle = rand.New(source)
+					}
+					if err := network.train(inputs, labels, nil, 0); err != nil {
+						t.Fatal(err)
+					}
+				}
+				start := func() (*network, *countingSource) {
+					source := newCountingSource(1, 0)
+					network, err := newClassifier(3, 3, 5, "tanh", nil, nil, 0, rand.New(source))
+					if err != nil {
+						t.Fatal(err)
+					}
+					network.config.learningRate, network.config.batchSize, network.config.momentum = 0.05, 8, momentum
+					return network, source
+				}
+
+				straight, straightSource := start()
+				train(straight, straightSource, epochs)
+
+				// Stop half way, go through a checkpoint file and carry on
+				interrupted, interruptedSource := start()
+				train(interrupted, interruptedSource, epochs/2)
+				dir := t.TempDir()
+				if err := writeCheckpoint(dir, interrupted, interruptedSource, nil, nil); err != nil {
+					t.Fatal(err)
+				}
+				saved, err := readCheckpoint(checkpointName(dir, epochs/2))
+				if err != nil {
+					t.Fatal(err)
+				}
+				resumed, resumedSource, err := saved.restore()
+				if err != nil {
+					t.Fatal(err)
+				}
+				train(resumed, resumedSource, epochs)
+
+				if (len(straight.velocities) > 0) != (momentum > 0) {
+					t.Fatalf("%d velocities with a momentum of %g", len(straight.velocities), momentum)
+				}
+				if resumedSource.draws != straightSource.draws || resumedSource.Int63() != straightSource.Int63() {
+					t.Errorf("the resumed source is at draw %d, the uninterrupted one at %d", resumedSource.draws, straightSource.draws)
+				}
+
+				// The final checkpoints hold the weights, velocities, epoch and random source position
+				straightFile, resumedFile := checkpointBytes(t, straight, straightSource), checkpointBytes(t, resumed, resumedSource)
+				if !bytes.Equal(straightFile, resumedFile) {
+					t.Error("resuming from a checkpoint gives a different final checkpoint than training straight through")
+				}
+			})
+		}
+	}
+}
+
+func TestPruneCheckpoints(t *testing.T) {
+
+	// Validation errors of epochs 1 to 8: epochs 2 and 5 are the best
+	validationErrors := []float64{0.9, 0.2, 0.7, 0.6, 0.1, 0.5, 0.4, 0.3}
+	var history []epochMetrics
+	for i, validationError := range validationErrors {
+		history = append(history, epochMetrics{Epoch: i + 1, ValidationError: validationError})
+	}
+
+	for _, test := range []struct {
+		keepLast, keepBest int
+		want               []int
+	}{
+		{0, 1, []int{1, 2, 3, 4, 5, 6, 7, 8}},
+		{3, 0, []int{6, 7, 8}},
+		{3, 1, []int{5, 6, 7, 8}},
+		{2, 2, []int{2, 5, 7, 8}},
+		{1, 3, []int{2, 5, 8}}, // Epoch 8 is both the last and the third best
+		{10, 10, []int{1, 2, 3, 4, 5, 6, 7, 8}},
+	} {
+		t.Run(fmt.Sprintf("last=%d/best=%d", test.keepLast, test.keepBest), func(t *testing.T) {
+
+			dir := t.TempDir()
+			for epoch := 1; epoch <= len(validationErrors); epoch++ {
+				if err := os.WriteFile(checkpointName(dir, epoch), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := pruneCheckpoints(dir, history, test.keepLast, test.keepBest); err != nil {
+				t.Fatal(err)
+			}
+			epochs, err := checkpointEpochs(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(epochs, test.want) {
+				t.Errorf("kept epochs %v, want %v", epochs, test.want)
+			}
+
+			// Resuming from the directory picks the latest checkpoint left
+			latest, err := findCheckpoint(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := checkpointName(dir, test.want[len(test.want)-1]); latest != want {
+				t.Errorf("resuming from %s, want %s", filepath.Base(latest), filepath.Base(want))
+			}
+		})
+	}
+}
+
+// checkpointBytes returns the checkpoint file written for a network
+func checkpointBytes(t *testing.T, network *network, source *countingSource) []byte {
+
+	dir := t.TempDir()
+	if err := writeCheckpoint(dir, network, source, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(checkpointName(dir, network.epoch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
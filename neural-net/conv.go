@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// Images are stored one per matrix row, flattened channel by channel and then
+// row by row, so an image of shape (channels, height, width) takes up
+// channels*height*width columns.
+
+// imageShape is the shape of an image held in a matrix row
+type imageShape struct {
+	channels int
+	height   int
+	width    int
+}
+
+// size is the number of values in an image of this shape
+func (shape imageShape) size() int {
+	return shape.channels * shape.height * shape.width
+}
+
+func (shape imageShape) String() string {
+	return fmt.Sprintf("%dx%dx%d", shape.channels, shape.height, shape.width)
+}
+
+// convLayer is a 2D convolution with stride and zero padding
+type convLayer struct {
+	input   imageShape // Shape of each input image
+	filters int        // Number of output channels
+	kernel  int        // Height & width of each filter
+	stride  int        // Step between filter positions
+	padding int        // Zeros added around each side of the input
+	weights *mat.Dense // Filters, one per column (channels*kernel*kernel x filters)
+	biases  *mat.Dense // One bias per filter (1 x filters)
+}
+
+// poolLayer takes the max or average of each window of each channel
+type poolLayer struct {
+	input  imageShape // Shape of each input image
+	mode   string     // "max" or "average"
+	size   int        // Height & width of each window
+	stride int        // Step between windows
+}
+
+// flattenLayer marks the change from images to plain rows of features. Images
+// are already stored flat so it leaves the values as they are.
+type flattenLayer struct {
+	input imageShape // Shape of each input image
+}
+
+// newConvLayer creates a convolution with He initialized weights
+func newConvLayer(input imageShape, filters, kernel, stride, padding int, r *rand.Rand) (*convLayer, error) {
+
+	layer := &convLayer{input: input, filters: filters, kernel: kernel, stride: stride, padding: padding}
+	if filters < 1 || kernel < 1 || stride < 1 || padding < 0 {
+		return nil, errors.New("conv: filters, kernel and stride must be positive and padding can't be negative")
+	}
+	if output := layer.output(); output.height < 1 || output.width < 1 {
+		return nil, fmt.Errorf("conv: a %dx%d kernel doesn't fit a %s input", kernel, kernel, input)
+	}
+
+	fanIn := input.channels * kernel * kernel
+	layer.weights = randomNormalMatrix(fanIn, filters, math.Sqrt(2/float64(fanIn)), r)
+	layer.biases = mat.NewDense(1, filters, nil)
+
+	return layer, nil
+}
+
+// newPoolLayer creates a max or average pooling layer
+func newPoolLayer(input imageShape, mode string, size, stride int) (*poolLayer, error) {
+
+	layer := &poolLayer{input: input, mode: mode, size: size, stride: stride}
+	if mode != "max" && mode != "average" {
+		return nil, fmt.Errorf("pool: unknown mode %q", mode)
+	}
+	if size < 1 || stride < 1 {
+		return nil, errors.New("pool: size and stride must be positive")
+	}
+	if output := layer.output(); output.height < 1 || output.width < 1 {
+		return nil, fmt.Errorf("pool: a %dx%d window doesn't fit a %s input", size, size, input)
+	}
+
+	return layer, nil
+}
+
+// output is the shape of each output image
+func (layer *convLayer) output() imageShape {
+	return imageShape{
+		channels: layer.filters,
+		height:   (layer.input.height+2*layer.padding-layer.kernel)/layer.stride + 1,
+		width:    (layer.input.width+2*layer.padding-layer.kernel)/layer.stride + 1,
+	}
+}
+
+// record convolves each image with the filters and adds the biases, multiplying a row for every
+// patch the filters see by the filters at once
+func (layer *convLayer) record(t *tape, x *variable, parameters []*variable) *variable {
+
+	numberOfRows, _ := x.value.Dims()
+	input, output := layer.input, layer.output()
+	positions := output.height * output.width
+	area := layer.kernel * layer.kernel
+
+	// Patches of every image (rows*positions x channels*kernel*kernel), zero where they cover the padding
+	patches := t.gather(x, numberOfRows*positions, input.channels*area, func(i, j int) int {
+		n, p := i/positions, i%positions
+		c, k := j/area, j%area
+		row := p/output.width*layer.stride - layer.padding + k/layer.kernel
+		column := p%output.width*layer.stride - layer.padding + k%layer.kernel
+		if row < 0 || row >= input.height || column < 0 || column >= input.width {
+			return -1
+		}
+		return n*input.size() + (c*input.height+row)*input.width + column
+	})
+	product := t.add(t.matMul(patches, parameters[0]), parameters[1]) // rows*positions x filters
+
+	// Back to one image per row, channel by channel
+	return t.gather(product, numberOfRows, output.size(), func(n, j int) int {
+		return (n*positions+j%positions)*layer.filters + j/positions
+	})
+}
+
+// forward convolves each image with the filters and adds the biases
+func (layer *convLayer) forward(x *mat.Dense) *mat.Dense {
+	return tapeForward(layer, x)
+}
+
+// backward adjusts the filters and biases and returns the gradient for the input images
+func (layer *convLayer) backward(x, _, gradient *mat.Dense, learningRate float64) *mat.Dense {
+	return tapeBackward(layer, x, gradient, learningRate)
+}
+
+// output is the shape of each output image
+func (layer *poolLayer) output() imageShape {
+	return imageShape{
+		channels: layer.input.channels,
+		height:   (layer.input.height-layer.size)/layer.stride + 1,
+		width:    (layer.input.width-layer.size)/layer.stride + 1,
+	}
+}
+
+// record pools each window of each channel, taking a row for every window
+func (layer *poolLayer) record(t *tape, x *variable, _ []*variable) *variable {
+
+	numberOfRows, _ := x.value.Dims()
+	input, output := layer.input, layer.output()
+
+	// Windows of every image (rows*outputs x size*size), in the order of the outputs
+	windows := t.gather(x, numberOfRows*output.size(), layer.size*layer.size, func(i, j int) int {
+		n, o := i/output.size(), i%output.size()
+		c, oy, ox := o/(output.height*output.width), o/output.width%output.height, o%output.width
+		row, column := oy*layer.stride+j/layer.size, ox*layer.stride+j%layer.size
+		return n*input.size() + (c*input.height+row)*input.width + column
+	})
+
+	var pooled *variable
+	if layer.mode == "max" {
+		pooled = t.rowMax(windows)
+	} else {
+		pooled = t.scale(1/float64(layer.size*layer.size), t.sumAlong(1, windows))
+	}
+
+	return t.reshape(pooled, numberOfRows, output.size())
+}
+
+// forward pools each window of each channel
+func (layer *poolLayer) forward(x *mat.Dense) *mat.Dense {
+	return tapeForward(layer, x)
+}
+
+// backward routes the gradient to the max of each window, or spreads it evenly for average pooling
+func (layer *poolLayer) backward(x, _, gradient *mat.Dense, _ float64) *mat.Dense {
+	return tapeBackward(layer, x, gradient, 0)
+}
+
+// forward leaves the values as they are
+func (layer *flattenLayer) forward(x *mat.Dense) *mat.Dense {
+	return x
+}
+
+// backward leaves the gradient as it is
+func (layer *flattenLayer) backward(_, _, gradient *mat.Dense, _ float64) *mat.Dense {
+	return gradient
+}
+
+// newNormalDenseLayer creates a dense layer with He initialized weights and zero biases
+func newNormalDenseLayer(numberOfInputs, numberOfOutputs int, r *rand.Rand) *denseLayer {
+	return &denseLayer{
+		weights: randomNormalMatrix(numberOfInputs, numberOfOutputs, math.Sqrt(2/float64(numberOfInputs)), r),
+		biases:  mat.NewDense(1, numberOfOutputs, nil),
+	}
+}
+
+// randomNormalMatrix creates a matrix of normally distributed values with a standard deviation of scale
+func randomNormalMatrix(rows, cols int, scale float64, r *rand.Rand) *mat.Dense {
+	data := make([]float64, rows*cols)
+	for i := range data {
+		data[i] = r.NormFloat64() * scale
+	}
+	return mat.NewDense(rows, cols, data)
+}
+
+// convCommand runs `nn conv`, training a small convolutional classifier on IDX image files:
+// conv -> relu -> pool -> flatten -> dense -> sigmoid
+func convCommand(args []string) error {
+
+	flags := flag.NewFlagSet("conv", flag.ExitOnError)
+	images := flags.String("images", "train-images-idx3-ubyte", "IDX file of training images")
+	labels := flags.String("labels", "train-labels-idx1-ubyte", "IDX file of training labels")
+	testImages := flags.String("test-images", "t10k-images-idx3-ubyte", "IDX file of testing images")
+	testLabels := flags.String("test-labels", "t10k-labels-idx1-ubyte", "IDX file of testing labels")
+	limit := flags.Int("limit", 0, "use at most this many images from each file (0 for all)")
+	filters := flags.Int("filters", 8, "number of convolution filters")
+	kernel := flags.Int("kernel", 3, "height & width of the convolution filters")
+	stride := flags.Int("stride", 1, "convolution stride")
+	padding := flags.Int("padding", 1, "convolution zero padding")
+	pool := flags.String("pool", "max", "pooling mode, max or average")
+	poolSize := flags.Int("pool-size", 2, "height, width & stride of the pooling windows")
+	epochs := flags.Int("epochs", 3, "number of passes over the training images")
+	batchSize := flags.Int("batch-size", 32, "images per gradient step")
+	learningRate := flags.Float64("learning-rate", 0.05, "learning rate")
+	loss := flags.String("loss", "squared-error", "loss to train with: squared-error, cross-entropy or focal")
+	modelFile := flags.String("model", "", "file to save the trained model to (optional)")
+	flags.Parse(args)
+
+	// Load the images & labels
+	inputs, shape, err := loadIDXImages(*images, *limit)
+	if err != nil {
+		return err
+	}
+	trainingLabels, err := loadIDXLabels(*labels, *limit, 0)
+	if err != nil {
+		return err
+	}
+	numberOfImages, _ := inputs.Dims()
+	numberOfLabels, numberOfClasses := trainingLabels.Dims()
+	if numberOfImages != numberOfLabels {
+		return fmt.Errorf("%d training images but %d labels", numberOfImages, numberOfLabels)
+	}
+
+	// Build the network
+	r1 := rand.New(rand.NewSource(time.Now().UnixNano()))
+	conv, err := newConvLayer(shape, *filters, *kernel, *stride, *padding, r1)
+	if err != nil {
+		return err
+	}
+	pooling, err := newPoolLayer(conv.output(), *pool, *poolSize, *poolSize)
+	if err != nil {
+		return err
+	}
+
+	network := network{
+		config: networkConf{
+			numberOfInputNodes:  shape.size(),
+			numberOfOutputNodes: numberOfClasses,
+			numberOfEpochs:      *epochs,
+			learningRate:        *learningRate / float64(*batchSize),
+			batchSize:           *batchSize,
+			loss:                *loss,
+		},
+		layers: []layer{
+			conv,
+			&activationLayer{function: "relu"},
+			pooling,
+			&flattenLayer{input: pooling.output()},
+			newNormalDenseLayer(pooling.output().size(), numberOfClasses, r1),
+			&activationLayer{function: "sigmoid"},
+		},
+	}
+
+	// Train the neural network
+	if err := network.train(inputs, trainingLabels, nil, 0); err != nil {
+		return err
+	}
+
+	// Check the accuracy on the testing images
+	testInputs, testShape, err := loadIDXImages(*testImages, *limit)
+	if err != nil {
+		return err
+	}
+	if testShape != shape {
+		return fmt.Errorf("testing images are %s, training images are %s", testShape, shape)
+	}
+	testingLabels, err := loadIDXLabels(*testLabels, *limit, numberOfClasses)
+	if err != nil {
+		return err
+	}
+	if numberOfImages, _ := testInputs.Dims(); numberOfImages != testingLabels.RawMatrix().Rows {
+		return fmt.Errorf("%d testing images but %d labels", numberOfImages, testingLabels.RawMatrix().Rows)
+	}
+	if _, columns := testingLabels.Dims(); columns != numberOfClasses {
+		return fmt.Errorf("testing labels have %d classes, training labels have %d", columns, numberOfClasses)
+	}
+	outputs, err := network.predictInBatches(testInputs, 1000)
+	if err != nil {
+		return err
+	}
+	fmt.Println("\nFinal accuracy:", calcAccuracy(outputs, testingLabels))
+	fmt.Println("Final balanced accuracy:", calcBalancedAccuracy(outputs, testingLabels))
+
+	if *modelFile != "" {
+		return network.save(*modelFile)
+	}
+
+	return nil
+}
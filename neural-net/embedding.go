@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// embeddingLayer replaces integer ID columns of its input with learned vectors, passing the other
+// columns through. IDs outside a column's vocabulary wrap around it, like hash buckets.
+type embeddingLayer struct {
+	width   int          // Number of input columns
+	columns []int        // Input columns holding IDs, in increasing order
+	tables  []*mat.Dense // Vectors for each ID column (vocabulary x dimensions)
+}
+
+// newEmbeddingLayer creates an embedding layer with a table of small random vectors for each ID column
+func newEmbeddingLayer(width int, columns, vocabularies []int, dimensions int, r *rand.Rand) (*embeddingLayer, error) {
+
+	if len(columns) == 0 || len(columns) != len(vocabularies) {
+		return nil, fmt.Errorf("%d ID columns with %d vocabularies", len(columns), len(vocabularies))
+	}
+	if dimensions < 1 {
+		return nil, fmt.Errorf("embeddings need at least 1 dimension, got %d", dimensions)
+	}
+
+	layer := &embeddingLayer{width: width, columns: columns}
+	for i, column := range columns {
+		if column < 0 || column >= width || (i > 0 && column <= columns[i-1]) {
+			return nil, fmt.Errorf("ID columns %v must be increasing and within %d columns", columns, width)
+		}
+		if vocabularies[i] < 1 {
+			return nil, fmt.Errorf("ID column %d has an empty vocabulary", column)
+		}
+		layer.tables = append(layer.tables, randomNormalMatrix(vocabularies[i], dimensions, 1/math.Sqrt(float64(dimensions)), r))
+	}
+
+	return layer, nil
+}
+
+// dimensions returns the length of each embedding vector
+func (layer *embeddingLayer) dimensions() int {
+	_, dimensions := layer.tables[0].Dims()
+	return dimensions
+}
+
+// outputSize returns the number of output columns: the other columns followed by the embeddings
+func (layer *embeddingLayer) outputSize() int {
+	return layer.width - len(layer.columns) + len(layer.columns)*layer.dimensions()
+}
+
+// lookup returns the row of table i for an ID value
+func (layer *embeddingLayer) lookup(i int, v float64) int {
+	vocabulary, _ := layer.tables[i].Dims()
+	id := int(math.Round(v)) % vocabulary
+	if id < 0 {
+		id += vocabulary
+	}
+	return id
+}
+
+// record copies the other columns and appends the vector of each ID
+func (layer *embeddingLayer) record(t *tape, x *variable, parameters []*variable) *variable {
+
+	numberOfRows, width := x.value.Dims()
+	dimensions := layer.dimensions()
+
+	var parts []*variable
+	if others := layer.otherColumns(); len(others) > 0 {
+		parts = append(parts, t.gather(x, numberOfRows, len(others), func(n, j int) int { return n*width + others[j] }))
+	}
+	for i, column := range layer.columns {
+		parts = append(parts, t.gather(parameters[i], numberOfRows, dimensions, func(n, d int) int {
+			return layer.lookup(i, x.value.At(n, column))*dimensions + d
+		}))
+	}
+
+	return t.concat(parts...)
+}
+
+// otherColumns returns the input columns that don't hold IDs, in order
+func (layer *embeddingLayer) otherColumns() []int {
+	var others []int
+	next := 0 // Next ID column
+	for j := 0; j < layer.width; j++ {
+		if next < len(layer.columns) && j == layer.columns[next] {
+			next++
+			continue
+		}
+		others = append(others, j)
+	}
+	return others
+}
+
+// forward copies the other columns and appends the vector of each ID
+func (layer *embeddingLayer) forward(x *mat.Dense) *mat.Dense {
+	return tapeForward(layer, x)
+}
+
+// backward adjusts only the vectors of the IDs in the batch and passes the gradient of the other columns back.
+// It is written out rather than taken from the tape on purpose: the tape's gradient for a table is as big as
+// the table, and subtracting it touches every vector, while a batch only uses a few of them. With vocabularies
+// far larger than a batch, as hashed IDs give, that would make each step cost the size of the vocabularies.
+// TestEmbeddingSparseBackward checks that it adjusts the layer like the tape does.
+func (layer *embeddingLayer) backward(x, _, gradient *mat.Dense, learningRate float64) *mat.Dense {
+
+	numberOfRows, _ := x.Dims()
+	dimensions := layer.dimensions()
+	inputGradient := mat.NewDense(numberOfRows, layer.width, nil) // IDs have no gradient
+
+	for n := 0; n < numberOfRows; n++ {
+		row, gradientRow, inputGradientRow := x.RawRowView(n), gradient.RawRowView(n), inputGradient.RawRowView(n)
+
+		next, k := 0, 0
+		for j := range row {
+			if next < len(layer.columns) && j == layer.columns[next] {
+				next++
+				continue
+			}
+			inputGradientRow[j] = gradientRow[k]
+			k++
+		}
+
+		// The gradient for a vector only depends on the rows using it, so each row can adjust it directly
+		for i, column := range layer.columns {
+			vector := layer.tables[i].RawRowView(layer.lookup(i, row[column]))
+			for d, g := range gradientRow[k+i*dimensions : k+(i+1)*dimensions] {
+				vector[d] -= learningRate * g
+			}
+		}
+	}
+
+	return inputGradient
+}
+
+// loadCategorical loads rows of numbers from a CSV file whose last labelColumns columns are labels.
+// A single label column holds a class number, which becomes a one-hot row with at least minClasses
+// classes. The columns listed in categorical must hold integer IDs, and vocabularies gets one more
+// than the largest ID in each of them.
+func loadCategorical(fileName string, categorical []int, labelColumns, minClasses int) (inputs, labels *mat.Dense, vocabularies []int, err error) {
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer f.Close()
+
+	rawCSVData, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(rawCSVData) == 0 {
+		return nil, nil, nil, fmt.Errorf("%s is empty", fileName)
+	}
+
+	width := len(rawCSVData[0]) - labelColumns
+	if labelColumns < 1 || width < 1 {
+		return nil, nil, nil, fmt.Errorf("%s has %d columns, can't take %d as labels", fileName, len(rawCSVData[0]), labelColumns)
+	}
+	isID := make(map[int]bool)
+	for _, column := range categorical {
+		if column < 0 || column >= width {
+			return nil, nil, nil, fmt.Errorf("%s has %d input columns, no column %d", fileName, width, column)
+		}
+		isID[column] = true
+	}
+
+	inputs = mat.NewDense(len(rawCSVData), width, nil)
+	labelsData := make([]float64, 0, len(rawCSVData)*labelColumns)
+	vocabularies = make([]int, len(categorical))
+	classes := make([]int, len(rawCSVData))
+	numberOfClasses := minClasses
+
+	for n, record := range rawCSVData {
+		if len(record) != width+labelColumns {
+			return nil, nil, nil, fmt.Errorf("%s line %d: expected %d columns, got %d", fileName, n+1, width+labelColumns, len(record))
+		}
+
+		for j, val := range record {
+			val = strings.TrimSpace(val)
+
+			if isID[j] || (j == width && labelColumns == 1) {
+				id, err := strconv.Atoi(val)
+				if err != nil || id < 0 {
+					return nil, nil, nil, fmt.Errorf("%s line %d column %d: %q isn't an ID", fileName, n+1, j+1, val)
+				}
+				if j == width {
+					classes[n] = id
+					numberOfClasses = max(numberOfClasses, id+1)
+					continue
+				}
+				inputs.Set(n, j, float64(id))
+				continue
+			}
+
+			parsedVal, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("%s line %d: %v", fileName, n+1, err)
+			}
+			if j >= width {
+				labelsData = append(labelsData, parsedVal)
+				continue
+			}
+			inputs.Set(n, j, parsedVal)
+		}
+	}
+
+	for i, column := range categorical {
+		for n := range rawCSVData {
+			vocabularies[i] = max(vocabularies[i], int(inputs.At(n, column))+1)
+		}
+	}
+
+	if labelColumns > 1 {
+		return inputs, mat.NewDense(len(rawCSVData), labelColumns, labelsData), vocabularies, nil
+	}
+
+	labels = mat.NewDense(len(rawCSVData), numberOfClasses, nil)
+	for n, class := range classes {
+		labels.Set(n, class, 1)
+	}
+
+	return inputs, labels, vocabularies, nil
+}
+
+// parseColumns parses a comma separated list of column numbers, sorting them
+func parseColumns(list string) ([]int, error) {
+
+	var columns []int
+	for _, field := range strings.Split(list, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		column, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("bad column %q", field)
+		}
+		columns = append(columns, column)
+	}
+
+	sort.Ints(columns)
+
+	return columns, nil
+}
+
+// embedCommand trains a classifier with embeddings for integer ID columns of CSV files
+func embedCommand(args []string) error {
+
+	flags := flag.NewFlagSet("embed", flag.ExitOnError)
+	data := flags.String("data", "categorical.csv", "CSV file of training rows, with the class in the last column")
+	testData := flags.String("test-data", "", "CSV file of testing rows (defaults to -data)")
+	categorical := flags.String("categorical", "0", "comma separated columns (from 0) holding integer IDs")
+	vocabulary := flags.Int("vocabulary", 0, "vectors per ID column (0 for one more than the largest ID), larger IDs wrap around")
+	dimensions := flags.Int("dimensions", 8, "length of each embedding vector")
+	hidden := flags.Int("hidden", 16, "number of hidden nodes")
+	epochs := flags.Int("epochs", 30, "number of passes over the training rows")
+	batchSize := flags.Int("batch-size", 32, "rows per gradient step")
+	learningRate := flags.Float64("learning-rate", 1, "learning rate")
+	loss := flags.String("loss", "squared-error", "loss to train with: squared-error, cross-entropy or focal")
+	modelFile := flags.String("model", "", "file to save the trained model to (optional)")
+	flags.Parse(args)
+
+	if *testData == "" {
+		*testData = *data
+	}
+
+	columns, err := parseColumns(*categorical)
+	if err != nil {
+		return err
+	}
+
+	inputs, labels, vocabularies, err := loadCategorical(*data, columns, 1, 0)
+	if err != nil {
+		return err
+	}
+	if *vocabulary > 0 {
+		for i := range vocabularies {
+			vocabularies[i] = *vocabulary
+		}
+	}
+	_, width := inputs.Dims()
+	_, numberOfClasses := labels.Dims()
+
+	// Build the network
+	r1 := rand.New(rand.NewSource(time.Now().UnixNano()))
+	embedding, err := newEmbeddingLayer(width, columns, vocabularies, *dimensions, r1)
+	if err != nil {
+		return err
+	}
+	fmt.Println(describeLayer(embedding))
+
+	network := network{
+		config: networkConf{
+			numberOfInputNodes:  width,
+			numberOfOutputNodes: numberOfClasses,
+			numberOfHiddenNodes: *hidden,
+			numberOfEpochs:      *epochs,
+			learningRate:        *learningRate / float64(*batchSize),
+			batchSize:           *batchSize,
+			loss:                *loss,
+		},
+		layers: []layer{
+			embedding,
+			newNormalDenseLayer(embedding.outputSize(), *hidden, r1),
+			&activationLayer{function: "relu"},
+			newNormalDenseLayer(*hidden, numberOfClasses, r1),
+			&activationLayer{function: "sigmoid"},
+		},
+	}
+
+	// Train the neural network
+	if err := network.train(inputs, labels, nil, 0); err != nil {
+		return err
+	}
+
+	// Check the accuracy on the testing rows
+	testInputs, testLabels, _, err := loadCategorical(*testData, columns, 1, numberOfClasses)
+	if err != nil {
+		return err
+	}
+	if _, testWidth := testInputs.Dims(); testWidth != width {
+		return fmt.Errorf("testing rows have %d input columns, training rows have %d", testWidth, width)
+	}
+	if _, testClasses := testLabels.Dims(); testClasses != numberOfClasses {
+		return fmt.Errorf("testing rows have %d classes, training rows have %d", testClasses, numberOfClasses)
+	}
+	outputs, err := network.predict(testInputs)
+	if err != nil {
+		return err
+	}
+	fmt.Println("\nFinal accuracy:", calcAccuracy(outputs, testLabels))
+	fmt.Println("Final balanced accuracy:", calcBalancedAccuracy(outputs, testLabels))
+
+	if *modelFile != "" {
+		return network.save(*modelFile)
+	}
+
+	return nil
+}
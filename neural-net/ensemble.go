@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+	"gonum.org/v1/gonum/stat"
+)
+
+// ensembleFormat identifies the JSON ensemble files written by ensemble.save
+const ensembleFormat = "neural-net/ensemble/v1"
+
+// ensembleMethods are the ways trainEnsemble can make members differ
+var ensembleMethods = []string{"bagging", "seeds", "snapshot"}
+
+// ensemble combines the predictions of several networks
+type ensemble struct {
+	members []*network
+	combine string // "average" for the mean of the members' outputs, or "vote" for the fraction of members predicting each class
+}
+
+// savedEnsemble is the JSON file format of an ensemble
+type savedEnsemble struct {
+	Format  string       `json:"format"` // Always ensembleFormat
+	Combine string       `json:"combine"`
+	Members []savedModel `json:"members"`
+}
+
+// ensembleConf are the settings of trainEnsemble
+type ensembleConf struct {
+	members   int                                  // Number of networks, or snapshots of one network
+	method    string                               // One of ensembleMethods
+	seed      int64                                // Member i gets seed + i
+	newMember func(r *rand.Rand) (*network, error) // Builds an untrained member
+}
+
+// trainEnsemble trains the members of an ensemble. Bagging trains each member on its own bootstrap
+// sample of the rows and seeds only changes the initial weights and row order, both training the
+// members in parallel. Snapshot trains one network with a learning rate that falls and restarts in
+// cycles, keeping a copy at the end of each cycle.
+func trainEnsemble(config ensembleConf, inputs, labels *mat.Dense) ([]*network, error) {
+
+	if config.members < 1 {
+		return nil, errors.New("an ensemble needs at least 1 member")
+	}
+
+	if config.method == "snapshot" {
+		return trainSnapshots(config, inputs, labels)
+	}
+	if config.method != "bagging" && config.method != "seeds" {
+		return nil, fmt.Errorf("unknown ensemble method %q, expected one of %s", config.method, strings.Join(ensembleMethods, ", "))
+	}
+
+	members := make([]*network, config.members)
+	errs := make([]error, config.members)
+	var wait sync.WaitGroup
+	for i := range members {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+
+			r := rand.New(rand.NewSource(config.seed + int64(i)))
+			member, err := config.newMember(r)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			member.shuffle, member.quiet = r, true
+
+			memberInputs, memberLabels := inputs, labels
+			if config.method == "bagging" {
+				numberOfRows, _ := inputs.Dims()
+				sample := make([]int, numberOfRows)
+				for n := range sample {
+					sample[n] = r.Intn(numberOfRows)
+				}
+				memberInputs, memberLabels = gatherRows(inputs, sample), gatherRows(labels, sample)
+			}
+
+			errs[i] = member.train(memberInputs, memberLabels, nil, 0)
+			members[i] = member
+		}(i)
+	}
+	wait.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("member %d: %v", i, err)
+		}
+	}
+
+	return members, nil
+}
+
+// trainSnapshots trains one network for config.members cycles of cosine annealing, keeping a copy after each cycle
+func trainSnapshots(config ensembleConf, inputs, labels *mat.Dense) ([]*network, error) {
+
+	r := rand.New(rand.NewSource(config.seed))
+	member, err := config.newMember(r)
+	if err != nil {
+		return nil, err
+	}
+	member.shuffle, member.quiet = r, true
+
+	epochs := member.config.numberOfEpochs
+	cycle := epochs / config.members
+	if cycle < 1 {
+		return nil, fmt.Errorf("%d epochs can't make %d snapshots", epochs, config.members)
+	}
+
+	// The learning rate of each epoch falls from the full rate towards 0 over its cycle
+	learningRate := member.config.learningRate
+	annealed := func(epoch int) float64 {
+		return learningRate / 2 * (1 + math.Cos(math.Pi*float64(epoch%cycle)/float64(cycle)))
+	}
+	member.config.numberOfEpochs = cycle * config.members
+	member.config.learningRate = annealed(0)
+
+	var snapshots []*network
+	member.afterEpoch = func(float64) error {
+		if member.epoch%cycle == 0 {
+			snapshot, err := member.clone()
+			if err != nil {
+				return err
+			}
+			snapshot.config.learningRate = learningRate
+			snapshots = append(snapshots, snapshot)
+		}
+		member.config.learningRate = annealed(member.epoch)
+		return nil
+	}
+
+	if err := member.train(inputs, labels, nil, 0); err != nil {
+		return nil, err
+	}
+
+	return snapshots, nil
+}
+
+// clone returns a copy of the network's layers and settings
+func (network *network) clone() (*network, error) {
+	model, err := network.encode()
+	if err != nil {
+		return nil, err
+	}
+	return decodeNetwork(model)
+}
+
+// memberOutputs returns every member's predictions for x
+func (e *ensemble) memberOutputs(x *mat.Dense) ([]*mat.Dense, error) {
+
+	if len(e.members) == 0 {
+		return nil, errors.New("the ensemble has no members")
+	}
+
+	outputs := make([]*mat.Dense, len(e.members))
+	for i, member := range e.members {
+		output, err := member.predict(x)
+		if err != nil {
+			return nil, fmt.Errorf("member %d: %v", i, err)
+		}
+		outputs[i] = output
+	}
+
+	return outputs, nil
+}
+
+// predict combines the members' predictions for x
+func (e *ensemble) predict(x *mat.Dense) (*mat.Dense, error) {
+	combined, _, err := e.predictWithSpread(x)
+	return combined, err
+}
+
+// predictWithSpread combines the members' predictions for x, and also returns the standard
+// deviation of each output across the members as a measure of the ensemble's uncertainty
+func (e *ensemble) predictWithSpread(x *mat.Dense) (combined, spread *mat.Dense, err error) {
+
+	outputs, err := e.memberOutputs(x)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	numberOfRows, numberOfOutputs := outputs[0].Dims()
+	combined = mat.NewDense(numberOfRows, numberOfOutputs, nil)
+	spread = mat.NewDense(numberOfRows, numberOfOutputs, nil)
+	values := make([]float64, len(outputs))
+	for i := 0; i < numberOfRows; i++ {
+		for j := 0; j < numberOfOutputs; j++ {
+			for m, output := range outputs {
+				values[m] = output.At(i, j)
+			}
+			mean, std := stat.MeanStdDev(values, nil)
+			if len(values) == 1 {
+				std = 0
+			}
+			combined.Set(i, j, mean)
+			spread.Set(i, j, std)
+		}
+
+		if e.combine == "vote" {
+			votes := combined.RawRowView(i)
+			for j := range votes {
+				votes[j] = 0
+			}
+			for _, output := range outputs {
+				votes[floats.MaxIdx(output.RawRowView(i))] += 1 / float64(len(outputs))
+			}
+		}
+	}
+
+	return combined, spread, nil
+}
+
+// save writes the ensemble and all of its members to one JSON file
+func (e *ensemble) save(fileName string) error {
+
+	saved := savedEnsemble{Format: ensembleFormat, Combine: e.combine}
+	for i, member := range e.members {
+		model, err := member.encode()
+		if err != nil {
+			return fmt.Errorf("member %d: %v", i, err)
+		}
+		saved.Members = append(saved.Members, model)
+	}
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(fileName, data, 0644)
+}
+
+// loadEnsemble reads an ensemble written by save
+func loadEnsemble(fileName string) (*ensemble, error) {
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var saved savedEnsemble
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	if saved.Format != ensembleFormat {
+		return nil, fmt.Errorf("%s: unknown ensemble format %q", fileName, saved.Format)
+	}
+	if saved.Combine != "average" && saved.Combine != "vote" {
+		return nil, fmt.Errorf("%s: unknown combination %q", fileName, saved.Combine)
+	}
+
+	e := &ensemble{combine: saved.Combine}
+	for i, model := range saved.Members {
+		member, err := decodeNetwork(model)
+		if err != nil {
+			return nil, fmt.Errorf("%s: member %d: %v", fileName, i, err)
+		}
+		e.members = append(e.members, member)
+	}
+	if len(e.members) == 0 {
+		return nil, fmt.Errorf("%s: the ensemble has no members", fileName)
+	}
+
+	return e, nil
+}
+
+// ensembleCommand trains an ensemble of classifiers on CSV files, or evaluates a saved one
+func ensembleCommand(args []string) error {
+
+	flags := flag.NewFlagSet("ensemble", flag.ExitOnError)
+	data := flags.String("data", "trainingData.csv", "CSV file of training rows, with the labels in the last columns")
+	testData := flags.String("test-data", "testingData.csv", "CSV file of testing rows")
+	labelColumns := flags.Int("labels", 3, "number of label columns, 1 for a single column holding a class number")
+	members := flags.Int("members", 5, "number of networks, or snapshots with -method snapshot")
+	method := flags.String("method", "bagging", "how members differ: "+strings.Join(ensembleMethods, ", "))
+	combine := flags.String("combine", "average", "how predictions are combined: average or vote")
+	hidden := flags.Int("hidden", 8, "number of hidden nodes")
+	activation := flags.String("activation", "sigmoid", "activation of the hidden layer: sigmoid, relu or tanh")
+	epochs := flags.Int("epochs", 100, "number of passes over the training rows, shared between the snapshots")
+	batchSize := flags.Int("batch-size", 16, "rows per gradient step")
+	learningRate := flags.Float64("learning-rate", 0.5, "learning rate")
+	loss := flags.String("loss", "squared-error", "loss to train with: squared-error, cross-entropy or focal")
+	seed := flags.Int64("seed", 0, "random seed of the first member (0 for the time)")
+	modelFile := flags.String("model", "", "file to save the ensemble to (optional)")
+	load := flags.String("load", "", "saved ensemble to evaluate instead of training one")
+	flags.Parse(args)
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	var e *ensemble
+	if *load != "" {
+		var err error
+		if e, err = loadEnsemble(*load); err != nil {
+			return err
+		}
+		if flagGiven(flags, "combine") {
+			e.combine = *combine
+		}
+	} else {
+		inputs, labels, _, err := loadCategorical(*data, nil, *labelColumns, 0)
+		if err != nil {
+			return err
+		}
+		_, width := inputs.Dims()
+		_, numberOfOutputs := labels.Dims()
+
+		config := ensembleConf{members: *members, method: *method, seed: *seed}
+		config.newMember = func(r *rand.Rand) (*network, error) {
+			member, err := newClassifier(width, numberOfOutputs, *hidden, *activation, nil, nil, 0, r)
+			if err != nil {
+				return nil, err
+			}
+			member.config.numberOfEpochs = *epochs
+			member.config.learningRate = *learningRate / float64(*batchSize)
+			member.config.batchSize = *batchSize
+			member.config.loss = *loss
+			return member, nil
+		}
+
+		fmt.Printf("Training %d members by %s\n", *members, *method)
+		trained, err := trainEnsemble(config, inputs, labels)
+		if err != nil {
+			return err
+		}
+		e = &ensemble{members: trained, combine: *combine}
+	}
+	if e.combine != "average" && e.combine != "vote" {
+		return fmt.Errorf("unknown combination %q, expected average or vote", e.combine)
+	}
+
+	// Compare the members with the ensemble on the testing rows
+	testInputs, testLabels, _, err := loadCategorical(*testData, nil, *labelColumns, e.members[0].config.numberOfOutputNodes)
+	if err != nil {
+		return err
+	}
+	outputs, err := e.memberOutputs(testInputs)
+	if err != nil {
+		return err
+	}
+	accuracies := make([]float64, len(outputs))
+	for i, output := range outputs {
+		accuracies[i] = calcAccuracy(output, testLabels)
+		fmt.Printf("Member %d: accuracy %.4f\n", i, accuracies[i])
+	}
+	mean, std := stat.MeanStdDev(accuracies, nil)
+	if len(accuracies) == 1 {
+		std = 0
+	}
+	fmt.Printf("Members: accuracy %.4f ± %.4f\n", mean, std)
+
+	combined, spread, err := e.predictWithSpread(testInputs)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Ensemble (%s of %d): accuracy %.4f\n", e.combine, len(e.members), calcAccuracy(combined, testLabels))
+
+	// The spread of the predicted class is the uncertainty, which should be higher for wrong predictions
+	var right, wrong []float64
+	numberOfRows, _ := combined.Dims()
+	for i := 0; i < numberOfRows; i++ {
+		prediction := floats.MaxIdx(combined.RawRowView(i))
+		if prediction == labelClass(testLabels.RawRowView(i)) {
+			right = append(right, spread.At(i, prediction))
+		} else {
+			wrong = append(wrong, spread.At(i, prediction))
+		}
+	}
+	fmt.Printf("Uncertainty (spread of the predicted output across members): %.4f when right, %.4f when wrong\n", meanOrZero(right), meanOrZero(wrong))
+
+	if *modelFile != "" {
+		return e.save(*modelFile)
+	}
+
+	return nil
+}
+
+// meanOrZero returns the mean of values, or 0 if there are none
+func meanOrZero(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	return stat.Mean(values, nil)
+}
+
+// flagGiven reports whether a flag was set on the command line
+func flagGiven(flags *flag.FlagSet, name string) bool {
+	given := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+	"gonum.org/v1/gonum/stat"
+)
+
+// explanation holds the attributions of a model's inputs, as written to JSON
+type explanation struct {
+	Model                 string               `json:"model"`
+	Features              []string             `json:"features"`
+	Accuracy              float64              `json:"accuracy"`              // Accuracy on the held-out rows before permuting
+	PermutationImportance []featureImportance  `json:"permutationImportance"` // Drop in accuracy when each column is shuffled
+	Samples               []sampleAttributions `json:"samples"`
+}
+
+// featureImportance is the mean and standard deviation of a column's permutation importance over the repeats
+type featureImportance struct {
+	Feature    string  `json:"feature"`
+	Importance float64 `json:"importance"`
+	Std        float64 `json:"std"`
+}
+
+// sampleAttributions splits one row's output for a class between its columns in three ways
+type sampleAttributions struct {
+	Row                 int       `json:"row"`
+	Class               int       `json:"class"`
+	Output              float64   `json:"output"`
+	Inputs              []float64 `json:"inputs"`
+	Saliency            []float64 `json:"saliency"`            // Gradient of the output for each input
+	IntegratedGradients []float64 `json:"integratedGradients"` // Sums to Output - BaselineOutput
+	BaselineOutput      float64   `json:"baselineOutput"`      // Output for the baseline row
+	SHAP                []float64 `json:"shap"`                // Sums to Output - ExpectedOutput
+	ExpectedOutput      float64   `json:"expectedOutput"`      // Mean output over the background rows
+}
+
+// explainCommand reports which input columns drive a saved model's predictions
+func explainCommand(args []string) error {
+
+	flags := flag.NewFlagSet("explain", flag.ExitOnError)
+	modelFile := flags.String("model", "", "saved model to explain")
+	data := flags.String("data", "testingData.csv", "CSV file of held-out rows, with the labels in the last columns")
+	labelColumns := flags.Int("labels", 3, "number of label columns, 1 for a single column holding a class number")
+	names := flags.String("names", "", "comma separated names of the input columns (defaults to column numbers)")
+	rows := flags.String("rows", "0,1,2", "comma separated rows (from 0) to attribute")
+	class := flags.Int("class", -1, "output to attribute (-1 for each row's predicted class)")
+	repeats := flags.Int("repeats", 10, "shuffles of each column for permutation importance")
+	steps := flags.Int("steps", 50, "steps along the path from the baseline for integrated gradients")
+	baseline := flags.String("baseline", "mean", "baseline row for integrated gradients: mean or zero")
+	background := flags.Int("background", 50, "held-out rows the missing columns are drawn from for SHAP")
+	samples := flags.Int("samples", 256, "column subsets evaluated for SHAP, all of them are used if there are fewer")
+	seed := flags.Int64("seed", 0, "random seed for the shuffles and subsets (0 for the time)")
+	jsonFile := flags.String("json", "", "file to write the attributions to as JSON (optional)")
+	flags.Parse(args)
+
+	if *modelFile == "" {
+		return errors.New("-model is needed")
+	}
+	if *repeats < 1 || *steps < 1 || *background < 1 || *samples < 1 {
+		return errors.New("-repeats, -steps, -background and -samples must be at least 1")
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	r := rand.New(rand.NewSource(*seed))
+
+	network, err := loadNetwork(*modelFile)
+	if err != nil {
+		return err
+	}
+	network.calibration = nil // Attributions are of the network's own outputs, which the gradients are for
+	inputs, labels, _, err := loadCategorical(*data, nil, *labelColumns, network.config.numberOfOutputNodes)
+	if err != nil {
+		return err
+	}
+	numberOfRows, width := inputs.Dims()
+
+	features := make([]string, width)
+	for j := range features {
+		features[j] = fmt.Sprintf("column %d", j)
+	}
+	if *names != "" {
+		given := strings.Split(*names, ",")
+		if len(given) != width {
+			return fmt.Errorf("%d names for %d input columns", len(given), width)
+		}
+		for j, name := range given {
+			features[j] = strings.TrimSpace(name)
+		}
+	}
+	sampleRows, err := parseColumns(*rows)
+	if err != nil {
+		return err
+	}
+
+	result := explanation{Model: *modelFile, Features: features}
+
+	// Permutation importance over every held-out row
+	if result.Accuracy, result.PermutationImportance, err = network.permutationImportance(inputs, labels, *repeats, r); err != nil {
+		return err
+	}
+	for j, importance := range result.PermutationImportance {
+		importance.Feature = features[j]
+		result.PermutationImportance[j] = importance
+	}
+
+	// The baseline for integrated gradients and the background for SHAP come from the held-out rows
+	baselineRow := make([]float64, width)
+	if *baseline == "mean" {
+		for j := range baselineRow {
+			baselineRow[j] = stat.Mean(mat.Col(nil, j, inputs), nil)
+		}
+	} else if *baseline != "zero" {
+		return fmt.Errorf("unknown baseline %q", *baseline)
+	}
+	backgroundRows := gatherRows(inputs, r.Perm(numberOfRows)[:min(*background, numberOfRows)])
+
+	for _, row := range sampleRows {
+		if row < 0 || row >= numberOfRows {
+			return fmt.Errorf("%s has %d rows, no row %d", *data, numberOfRows, row)
+		}
+		x := inputs.RawRowView(row)
+
+		output, err := network.predict(mat.NewDense(1, width, x))
+		if err != nil {
+			return err
+		}
+		target := *class
+		if target < 0 {
+			target = floats.MaxIdx(output.RawRowView(0))
+		}
+		if _, numberOfOutputs := output.Dims(); target >= numberOfOutputs {
+			return fmt.Errorf("the model has %d outputs, no output %d", numberOfOutputs, target)
+		}
+
+		sample := sampleAttributions{Row: row, Class: target, Output: output.At(0, target), Inputs: append([]float64(nil), x...)}
+		sample.Saliency = network.saliency(x, target)
+		if sample.IntegratedGradients, sample.BaselineOutput, err = network.integratedGradients(x, baselineRow, target, *steps); err != nil {
+			return err
+		}
+		if sample.SHAP, sample.ExpectedOutput, err = network.kernelSHAP(x, backgroundRows, target, *samples, r); err != nil {
+			return err
+		}
+		result.Samples = append(result.Samples, sample)
+	}
+
+	printExplanation(result)
+
+	if *jsonFile != "" {
+		data, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(*jsonFile, data, 0644)
+	}
+
+	return nil
+}
+
+// permutationImportance shuffles each input column in turn and measures how much the accuracy drops
+func (network *network) permutationImportance(inputs, labels *mat.Dense, repeats int, r *rand.Rand) (float64, []featureImportance, error) {
+
+	outputs, err := network.predict(inputs)
+	if err != nil {
+		return 0, nil, err
+	}
+	accuracy := calcAccuracy(outputs, labels)
+
+	numberOfRows, width := inputs.Dims()
+	shuffled := mat.DenseCopyOf(inputs)
+	importances := make([]featureImportance, width)
+	for j := 0; j < width; j++ {
+		drops := make([]float64, repeats)
+		for i := range drops {
+			for n, m := range r.Perm(numberOfRows) {
+				shuffled.Set(n, j, inputs.At(m, j))
+			}
+			outputs, err := network.predict(shuffled)
+			if err != nil {
+				return 0, nil, err
+			}
+			drops[i] = accuracy - calcAccuracy(outputs, labels)
+		}
+		shuffled.SetCol(j, mat.Col(nil, j, inputs))
+
+		importances[j].Importance, importances[j].Std = stat.MeanStdDev(drops, nil)
+		if repeats == 1 {
+			importances[j].Std = 0
+		}
+	}
+
+	return accuracy, importances, nil
+}
+
+// inputGradient returns the gradient of sum(upstream * output) for each input, leaving the parameters alone
+func (network *network) inputGradient(x, upstream *mat.Dense) *mat.Dense {
+
+	activations := []*mat.Dense{x}
+	for _, layer := range network.layers {
+		activations = append(activations, layer.forward(activations[len(activations)-1]))
+	}
+
+	// A learning rate of 0 passes the gradient back without adjusting anything
+	gradient := upstream
+	for j := len(network.layers) - 1; j >= 0; j-- {
+		gradient = network.layers[j].backward(activations[j], activations[j+1], gradient, 0)
+	}
+
+	return gradient
+}
+
+// targetGradient returns the gradient of output target for each row of x
+func (network *network) targetGradient(x *mat.Dense, target int) *mat.Dense {
+
+	numberOfRows, _ := x.Dims()
+	upstream := mat.NewDense(numberOfRows, network.config.numberOfOutputNodes, nil)
+	for n := 0; n < numberOfRows; n++ {
+		upstream.Set(n, target, 1)
+	}
+
+	return network.inputGradient(x, upstream)
+}
+
+// saliency returns the gradient of output target for each input of a row. ID columns of embeddings get 0.
+func (network *network) saliency(x []float64, target int) []float64 {
+	gradient := network.targetGradient(mat.NewDense(1, len(x), append([]float64(nil), x...)), target)
+	return gradient.RawRowView(0)
+}
+
+// integratedGradients averages the gradient of output target over steps points on the straight path
+// from baseline to x and scales it by x - baseline, so the attributions add up to the change in the
+// output. It also returns the output for the baseline.
+func (network *network) integratedGradients(x, baseline []float64, target, steps int) ([]float64, float64, error) {
+
+	// Every point is a row of one batch, at the middle of its step
+	path := mat.NewDense(steps+1, len(x), nil)
+	for k := 0; k < steps; k++ {
+		alpha := (float64(k) + 0.5) / float64(steps)
+		for j := range x {
+			path.Set(k, j, baseline[j]+alpha*(x[j]-baseline[j]))
+		}
+	}
+	path.SetRow(steps, baseline)
+
+	outputs, err := network.predict(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	gradient := network.targetGradient(path.Slice(0, steps, 0, len(x)).(*mat.Dense), target)
+
+	attributions := make([]float64, len(x))
+	for j := range attributions {
+		attributions[j] = (x[j] - baseline[j]) * stat.Mean(mat.Col(nil, j, gradient), nil)
+	}
+
+	return attributions, outputs.At(steps, target), nil
+}
+
+// kernelSHAP approximates the Shapley values of a row's inputs for output target. A subset of the
+// columns is valued at the mean output with the other columns taken from each background row, and a
+// weighted least squares fit over subsets gives values adding up to the row's output minus the
+// expected output. Every subset is used if there are at most samples of them, otherwise subsets are
+// drawn in proportion to the Shapley kernel.
+func (network *network) kernelSHAP(x []float64, background *mat.Dense, target, samples int, r *rand.Rand) ([]float64, float64, error) {
+
+	width := len(x)
+	numberOfBackground, _ := background.Dims()
+
+	// value returns the mean output with the columns in subset taken from x
+	value := func(subsets [][]bool) ([]float64, error) {
+		rows := mat.NewDense(len(subsets)*numberOfBackground, width, nil)
+		for s, subset := range subsets {
+			for b := 0; b < numberOfBackground; b++ {
+				row := rows.RawRowView(s*numberOfBackground + b)
+				copy(row, background.RawRowView(b))
+				for j, in := range subset {
+					if in {
+						row[j] = x[j]
+					}
+				}
+			}
+		}
+		outputs, err := network.predict(rows)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]float64, len(subsets))
+		for s := range subsets {
+			for b := 0; b < numberOfBackground; b++ {
+				values[s] += outputs.At(s*numberOfBackground+b, target)
+			}
+			values[s] /= float64(numberOfBackground)
+		}
+		return values, nil
+	}
+
+	full := make([]bool, width)
+	for j := range full {
+		full[j] = true
+	}
+	ends, err := value([][]bool{make([]bool, width), full})
+	if err != nil {
+		return nil, 0, err
+	}
+	expected, total := ends[0], ends[1]-ends[0]
+	if width == 1 {
+		return []float64{total}, expected, nil
+	}
+
+	// Choose the subsets other than none and all of the columns, with their weights
+	var subsets [][]bool
+	var weights []float64
+	if width < 31 && 1<<width-2 <= samples {
+		for mask := 1; mask < 1<<width-1; mask++ {
+			subset := make([]bool, width)
+			size := 0
+			for j := range subset {
+				if mask&(1<<j) != 0 {
+					subset[j] = true
+					size++
+				}
+			}
+			subsets = append(subsets, subset)
+			weights = append(weights, shapleyKernel(width, size))
+		}
+	} else {
+		// Drawing a size in proportion to its kernel weight and then columns uniformly weights every subset equally
+		sizeWeights := make([]float64, width-1)
+		for size := 1; size < width; size++ {
+			sizeWeights[size-1] = shapleyKernel(width, size) * binomial(width, size)
+		}
+		cumulative := make([]float64, len(sizeWeights))
+		floats.CumSum(cumulative, sizeWeights)
+		for i := 0; i < samples; i++ {
+			size := 1 + floats.Within(append([]float64{0}, cumulative...), r.Float64()*cumulative[len(cumulative)-1])
+			subset := make([]bool, width)
+			for _, j := range r.Perm(width)[:size] {
+				subset[j] = true
+			}
+			subsets = append(subsets, subset)
+			weights = append(weights, 1)
+		}
+	}
+
+	values, err := value(subsets)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// The last column's value is whatever the others leave of the total, so fit the others to
+	// value - expected - z_last*total = sum over j of (z_j - z_last) * phi_j
+	design := mat.NewDense(len(subsets), width-1, nil)
+	targets := mat.NewVecDense(len(subsets), nil)
+	for s, subset := range subsets {
+		last := boolValue(subset[width-1])
+		for j := 0; j < width-1; j++ {
+			design.Set(s, j, math.Sqrt(weights[s])*(boolValue(subset[j])-last))
+		}
+		targets.SetVec(s, math.Sqrt(weights[s])*(values[s]-expected-last*total))
+	}
+
+	var fitted mat.VecDense
+	if err := fitted.SolveVec(design, targets); err != nil {
+		return nil, 0, fmt.Errorf("fitting SHAP values: %v", err)
+	}
+	attributions := make([]float64, width)
+	for j := 0; j < width-1; j++ {
+		attributions[j] = fitted.AtVec(j)
+	}
+	attributions[width-1] = total - floats.Sum(attributions[:width-1])
+
+	return attributions, expected, nil
+}
+
+// shapleyKernel is the weight KernelSHAP gives a subset of size of the width columns
+func shapleyKernel(width, size int) float64 {
+	return float64(width-1) / (binomial(width, size) * float64(size*(width-size)))
+}
+
+// binomial returns n choose k
+func binomial(n, k int) float64 {
+	result := 1.0
+	for i := 1; i <= k; i++ {
+		result = result * float64(n-k+i) / float64(i)
+	}
+	return result
+}
+
+// boolValue returns 1 for true and 0 for false
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// printExplanation prints the attributions as tables
+func printExplanation(result explanation) {
+
+	fmt.Printf("Permutation importance (accuracy %.4f before shuffling)\n", result.Accuracy)
+	fmt.Printf("%-16s %12s %12s\n", "feature", "importance", "std")
+	for _, importance := range result.PermutationImportance {
+		fmt.Printf("%-16s %12.4f %12.4f\n", importance.Feature, importance.Importance, importance.Std)
+	}
+
+	for _, sample := range result.Samples {
+		fmt.Printf("\nRow %d, output %d = %.4f (baseline %.4f, expected %.4f)\n", sample.Row, sample.Class, sample.Output, sample.BaselineOutput, sample.ExpectedOutput)
+		fmt.Printf("%-16s %12s %12s %12s %12s\n", "feature", "value", "saliency", "integrated", "shap")
+		for j, feature := range result.Features {
+			fmt.Printf("%-16s %12.4f %12.4f %12.4f %12.4f\n", feature, sample.Inputs[j], sample.Saliency[j], sample.IntegratedGradients[j], sample.SHAP[j])
+		}
+		fmt.Printf("%-16s %12s %12s %12.4f %12.4f\n", "sum", "", "", floats.Sum(sample.IntegratedGradients), floats.Sum(sample.SHAP))
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// dataset is a generated dataset: rows of inputs with either a class or a target value for each
+type dataset struct {
+	inputs          *mat.Dense
+	classes         []int     // Class of each row, nil for regression
+	numberOfClasses int       // Number of classes, 0 for regression
+	targets         []float64 // Target of each row, nil for classification
+}
+
+// generatorConf are the settings shared by the generators
+type generatorConf struct {
+	rows     int     // Number of rows
+	features int     // Number of inputs per row, for generators that aren't 2D
+	classes  int     // Number of classes, for generators that can have more than 2
+	noise    float64 // Standard deviation of the Gaussian noise added to the inputs, or to the targets of regressions
+	spread   float64 // Standard deviation of each blob or mixture component
+	degree   int     // Degree of polynomial regressions
+}
+
+// generator makes a dataset from its settings and a random source
+type generator func(config generatorConf, r *rand.Rand) (dataset, error)
+
+// generators are the datasets generate can make
+var generators = map[string]generator{
+	"blobs":      generateBlobs,
+	"moons":      generateMoons,
+	"circles":    generateCircles,
+	"spirals":    generateSpirals,
+	"xor":        generateXOR,
+	"linear":     generateLinear,
+	"polynomial": generatePolynomial,
+	"mixture":    generateMixture,
+}
+
+// generate makes a dataset of the named kind, with the same rows for the same seed
+func generate(kind string, config generatorConf, seed int64) (dataset, error) {
+
+	generator, ok := generators[kind]
+	if !ok {
+		return dataset{}, fmt.Errorf("unknown dataset %q, expected one of %s", kind, strings.Join(generatorNames(), ", "))
+	}
+	if config.rows < 1 {
+		return dataset{}, errors.New("datasets need at least 1 row")
+	}
+
+	return generator(config, rand.New(rand.NewSource(seed)))
+}
+
+// generatorNames returns the names of the generators in order
+func generatorNames() []string {
+	var names []string
+	for name := range generators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newClassification creates a dataset with room for rows of width inputs, giving row i the class i % classes
+func newClassification(rows, width, classes int) dataset {
+	d := dataset{inputs: mat.NewDense(rows, width, nil), classes: make([]int, rows), numberOfClasses: classes}
+	for i := range d.classes {
+		d.classes[i] = i % classes
+	}
+	return d
+}
+
+// addNoise adds Gaussian noise with a standard deviation of noise to every input
+func (d dataset) addNoise(noise float64, r *rand.Rand) {
+	if noise > 0 {
+		d.inputs.Apply(func(_, _ int, v float64) float64 { return v + noise*r.NormFloat64() }, d.inputs)
+	}
+}
+
+// generateBlobs places a Gaussian blob for each class at a random centre in [-5, 5] in every dimension
+func generateBlobs(config generatorConf, r *rand.Rand) (dataset, error) {
+
+	if config.classes < 1 || config.features < 1 {
+		return dataset{}, errors.New("blobs need at least 1 class and 1 feature")
+	}
+
+	centres := randomUniformMatrix(config.classes, config.features, -5, 5, r)
+	d := newClassification(config.rows, config.features, config.classes)
+	for i, class := range d.classes {
+		for j := 0; j < config.features; j++ {
+			d.inputs.Set(i, j, centres.At(class, j)+config.spread*r.NormFloat64())
+		}
+	}
+
+	return d, nil
+}
+
+// generateMoons makes two interleaving half circles in 2D
+func generateMoons(config generatorConf, r *rand.Rand) (dataset, error) {
+
+	d := newClassification(config.rows, 2, 2)
+	for i, class := range d.classes {
+		t := math.Pi * r.Float64()
+		if class == 0 {
+			d.inputs.SetRow(i, []float64{math.Cos(t), math.Sin(t)})
+		} else {
+			d.inputs.SetRow(i, []float64{1 - math.Cos(t), 0.5 - math.Sin(t)})
+		}
+	}
+	d.addNoise(config.noise, r)
+
+	return d, nil
+}
+
+// generateCircles makes a ring in 2D for each class, the first class outermost
+func generateCircles(config generatorConf, r *rand.Rand) (dataset, error) {
+
+	if config.classes < 2 {
+		return dataset{}, errors.New("circles need at least 2 classes")
+	}
+
+	d := newClassification(config.rows, 2, config.classes)
+	for i, class := range d.classes {
+		radius := float64(config.classes-class) / float64(config.classes)
+		t := 2 * math.Pi * r.Float64()
+		d.inputs.SetRow(i, []float64{radius * math.Cos(t), radius * math.Sin(t)})
+	}
+	d.addNoise(config.noise, r)
+
+	return d, nil
+}
+
+// generateSpirals makes an arm in 2D for each class, each turning one and a half times around the origin
+func generateSpirals(config generatorConf, r *rand.Rand) (dataset, error) {
+
+	if config.classes < 1 {
+		return dataset{}, errors.New("spirals need at least 1 class")
+	}
+
+	d := newClassification(config.rows, 2, config.classes)
+	for i, class := range d.classes {
+		t := r.Float64()
+		angle := 3*math.Pi*t + 2*math.Pi*float64(class)/float64(config.classes)
+		d.inputs.SetRow(i, []float64{t * math.Cos(angle), t * math.Sin(angle)})
+	}
+	d.addNoise(config.noise, r)
+
+	return d, nil
+}
+
+// generateXOR spreads rows uniformly over [-1, 1] in every dimension, each in class 1 if an odd number
+// of its inputs are positive. In 2D that's the XOR of the signs of the two inputs.
+func generateXOR(config generatorConf, r *rand.Rand) (dataset, error) {
+
+	if config.features < 2 {
+		return dataset{}, errors.New("xor needs at least 2 features")
+	}
+
+	d := dataset{inputs: randomUniformMatrix(config.rows, config.features, -1, 1, r), classes: make([]int, config.rows), numberOfClasses: 2}
+	for i := range d.classes {
+		for _, v := range d.inputs.RawRowView(i) {
+			if v > 0 {
+				d.classes[i] ^= 1
+			}
+		}
+	}
+	d.addNoise(config.noise, r)
+
+	return d, nil
+}
+
+// generateLinear spreads rows uniformly over [0, 10] in every dimension, with targets from a random
+// linear function of the inputs plus noise
+func generateLinear(config generatorConf, r *rand.Rand) (dataset, error) {
+
+	if config.features < 1 {
+		return dataset{}, errors.New("linear regressions need at least 1 feature")
+	}
+
+	weights := randomUniformMatrix(1, config.features, -2, 2, r).RawRowView(0)
+	bias := 10 * r.Float64()
+	d := dataset{inputs: randomUniformMatrix(config.rows, config.features, 0, 10, r), targets: make([]float64, config.rows)}
+	for i := range d.targets {
+		d.targets[i] = bias + config.noise*r.NormFloat64()
+		for j, v := range d.inputs.RawRowView(i) {
+			d.targets[i] += weights[j] * v
+		}
+	}
+
+	return d, nil
+}
+
+// generatePolynomial spreads single inputs uniformly over [-2, 2], with targets from a random
+// polynomial of the input plus noise
+func generatePolynomial(config generatorConf, r *rand.Rand) (dataset, error) {
+
+	if config.degree < 1 {
+		return dataset{}, errors.New("polynomials need a degree of at least 1")
+	}
+
+	coefficients := randomUniformMatrix(1, config.degree+1, -2, 2, r).RawRowView(0)
+	d := dataset{inputs: randomUniformMatrix(config.rows, 1, -2, 2, r), targets: make([]float64, config.rows)}
+	for i := range d.targets {
+		x := d.inputs.At(i, 0)
+		power := 1.0
+		for _, coefficient := range coefficients {
+			d.targets[i] += coefficient * power
+			power *= x
+		}
+		d.targets[i] += config.noise * r.NormFloat64()
+	}
+
+	return d, nil
+}
+
+// generateMixture draws each class from a mixture of 3 Gaussians, with random weights, centres in
+// [-5, 5] in every dimension, and standard deviations between half and one and a half times spread
+func generateMixture(config generatorConf, r *rand.Rand) (dataset, error) {
+
+	if config.classes < 1 || config.features < 1 {
+		return dataset{}, errors.New("mixtures need at least 1 class and 1 feature")
+	}
+
+	const components = 3
+	type component struct {
+		weight      float64
+		centre, std []float64
+	}
+	mixtures := make([][]component, config.classes)
+	for c := range mixtures {
+		total := 0.0
+		for k := 0; k < components; k++ {
+			comp := component{weight: 0.2 + r.Float64(), centre: make([]float64, config.features), std: make([]float64, config.features)}
+			for j := range comp.centre {
+				comp.centre[j] = -5 + 10*r.Float64()
+				comp.std[j] = config.spread * (0.5 + r.Float64())
+			}
+			total += comp.weight
+			mixtures[c] = append(mixtures[c], comp)
+		}
+		for k := range mixtures[c] {
+			mixtures[c][k].weight /= total
+		}
+	}
+
+	d := newClassification(config.rows, config.features, config.classes)
+	for i, class := range d.classes {
+
+		// Choose a component by its weight
+		comp := mixtures[class][components-1]
+		u := r.Float64()
+		for _, candidate := range mixtures[class] {
+			if u < candidate.weight {
+				comp = candidate
+				break
+			}
+			u -= candidate.weight
+		}
+
+		for j := range comp.centre {
+			d.inputs.Set(i, j, comp.centre[j]+comp.std[j]*r.NormFloat64())
+		}
+	}
+
+	return d, nil
+}
+
+// randomUniformMatrix creates a matrix of values spread uniformly between low and high
+func randomUniformMatrix(rows, cols int, low, high float64, r *rand.Rand) *mat.Dense {
+	data := make([]float64, rows*cols)
+	for i := range data {
+		data[i] = low + (high-low)*r.Float64()
+	}
+	return mat.NewDense(rows, cols, data)
+}
+
+// labels returns the one-hot labels of a classification, or the targets of a regression as one column
+func (d dataset) labels() *mat.Dense {
+
+	rows, _ := d.inputs.Dims()
+	if d.classes == nil {
+		return mat.NewDense(rows, 1, append([]float64(nil), d.targets...))
+	}
+
+	labels := mat.NewDense(rows, d.numberOfClasses, nil)
+	for i, class := range d.classes {
+		labels.Set(i, class, 1)
+	}
+	return labels
+}
+
+// slice returns the rows from start to end
+func (d dataset) slice(start, end int) dataset {
+	_, width := d.inputs.Dims()
+	part := dataset{inputs: d.inputs.Slice(start, end, 0, width).(*mat.Dense), numberOfClasses: d.numberOfClasses}
+	if d.classes != nil {
+		part.classes = d.classes[start:end]
+	}
+	if d.targets != nil {
+		part.targets = d.targets[start:end]
+	}
+	return part
+}
+
+// shuffle puts the rows in a random order, so a slice of them has every class
+func (d dataset) shuffle(r *rand.Rand) dataset {
+	rows, _ := d.inputs.Dims()
+	order := r.Perm(rows)
+	shuffled := dataset{inputs: gatherRows(d.inputs, order), numberOfClasses: d.numberOfClasses}
+	for _, i := range order {
+		if d.classes != nil {
+			shuffled.classes = append(shuffled.classes, d.classes[i])
+		}
+		if d.targets != nil {
+			shuffled.targets = append(shuffled.targets, d.targets[i])
+		}
+	}
+	return shuffled
+}
+
+// writeCSV writes each row's inputs followed by its labels: "onehot" for a column per class, "class"
+// for the class number, "target" for the target of a regression, or "none" for no labels
+func (d dataset) writeCSV(fileName, labels string) error {
+
+	switch {
+	case labels == "none":
+	case d.classes == nil && labels != "target":
+		return fmt.Errorf("regressions have target labels, not %s", labels)
+	case d.classes != nil && labels != "onehot" && labels != "class":
+		return fmt.Errorf("classifications have onehot or class labels, not %s", labels)
+	}
+
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	writer := bufio.NewWriter(f)
+
+	rows, _ := d.inputs.Dims()
+	labelRows := d.labels()
+	for i := 0; i < rows; i++ {
+		row := d.inputs.RawRowView(i)
+		switch labels {
+		case "onehot", "target":
+			row = append(append([]float64(nil), row...), labelRows.RawRowView(i)...)
+		case "class":
+			row = append(append([]float64(nil), row...), float64(d.classes[i]))
+		}
+		writeCSVRow(writer, row)
+	}
+
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// generateCommand writes a generated dataset to CSV files. The other programs read them too: kmeans
+// clusters blobs written with -labels none, and linear-regression fits linear rows with -features 1.
+func generateCommand(args []string) error {
+
+	flags := flag.NewFlagSet("generate", flag.ExitOnError)
+	kind := flags.String("kind", "mixture", "dataset to generate: "+strings.Join(generatorNames(), ", "))
+	rows := flags.Int("rows", 100, "number of rows to write to -out")
+	testRows := flags.Int("test-rows", 0, "number of rows from the same distribution to write to -test-out")
+	features := flags.Int("features", 2, "inputs per row for blobs, xor, linear and mixture (the others are 1D or 2D)")
+	classes := flags.Int("classes", 3, "number of classes for blobs, circles, spirals and mixture (moons and xor have 2)")
+	noise := flags.Float64("noise", 0.1, "standard deviation of the noise added to the inputs, or to the targets of linear and polynomial")
+	spread := flags.Float64("spread", 1, "standard deviation of each blob or mixture component")
+	degree := flags.Int("degree", 3, "degree of polynomial regressions")
+	labels := flags.String("labels", "", "label columns: onehot, class, target or none (defaults to onehot, or target for regressions)")
+	seed := flags.Int64("seed", 0, "random seed, the same seed gives the same rows (0 for the time)")
+	out := flags.String("out", "data.csv", "CSV file to write the rows to")
+	testOut := flags.String("test-out", "", "CSV file to write the -test-rows rows to")
+	flags.Parse(args)
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	if *testRows > 0 && *testOut == "" {
+		return errors.New("-test-out is needed with -test-rows")
+	}
+
+	config := generatorConf{rows: *rows + *testRows, features: *features, classes: *classes, noise: *noise, spread: *spread, degree: *degree}
+	d, err := generate(*kind, config, *seed)
+	if err != nil {
+		return err
+	}
+	if *labels == "" {
+		*labels = "onehot"
+		if d.classes == nil {
+			*labels = "target"
+		}
+	}
+
+	// Both files come from one shuffled dataset, so they share its distribution
+	d = d.shuffle(rand.New(rand.NewSource(*seed)))
+	if err := d.slice(0, *rows).writeCSV(*out, *labels); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d %s rows to %s\n", *rows, *kind, *out)
+	if *testRows > 0 {
+		if err := d.slice(*rows, *rows+*testRows).writeCSV(*testOut, *labels); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %d %s rows to %s\n", *testRows, *kind, *testOut)
+	}
+
+	return nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// testGeneratorConf is used for every generator, each taking the settings it needs
+var testGeneratorConf = generatorConf{rows: 60, features: 3, classes: 4, noise: 0.1, spread: 1, degree: 3}
+
+func TestGenerateIsDeterministic(t *testing.T) {
+
+	for _, kind := range generatorNames() {
+		t.Run(kind, func(t *testing.T) {
+
+			first, err := generate(kind, testGeneratorConf, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := generate(kind, testGeneratorConf, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !mat.Equal(first.inputs, second.inputs) || !reflect.DeepEqual(first.classes, second.classes) || !reflect.DeepEqual(first.targets, second.targets) {
+				t.Error("the same seed gave different rows")
+			}
+
+			other, err := generate(kind, testGeneratorConf, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mat.Equal(first.inputs, other.inputs) {
+				t.Error("different seeds gave the same rows")
+			}
+		})
+	}
+}
+
+func TestGenerateShapes(t *testing.T) {
+
+	tests := map[string]struct {
+		width, classes int  // Inputs per row and number of classes, 0 for regressions
+		balanced       bool // Whether the rows are dealt out to the classes in turn
+	}{
+		"blobs":      {3, 4, true},
+		"moons":      {2, 2, true},
+		"circles":    {2, 4, true},
+		"spirals":    {2, 4, true},
+		"xor":        {3, 2, false},
+		"linear":     {3, 0, false},
+		"polynomial": {1, 0, false},
+		"mixture":    {3, 4, true},
+	}
+	if len(tests) != len(generators) {
+		t.Fatalf("%d generators but %d tests", len(generators), len(tests))
+	}
+
+	for kind, test := range tests {
+		t.Run(kind, func(t *testing.T) {
+
+			d, err := generate(kind, testGeneratorConf, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows, width := d.inputs.Dims()
+			if rows != testGeneratorConf.rows || width != test.width {
+				t.Fatalf("inputs are %dx%d, want %dx%d", rows, width, testGeneratorConf.rows, test.width)
+			}
+			if d.numberOfClasses != test.classes {
+				t.Fatalf("%d classes, want %d", d.numberOfClasses, test.classes)
+			}
+			labels := d.labels()
+
+			// Regressions have a target per row and no classes
+			if test.classes == 0 {
+				if d.classes != nil || len(d.targets) != rows {
+					t.Fatalf("%d classes and %d targets for %d rows", len(d.classes), len(d.targets), rows)
+				}
+				if !mat.Equal(labels, mat.NewDense(rows, 1, d.targets)) {
+					t.Error("the labels aren't the targets")
+				}
+				return
+			}
+
+			// Classifications have a one-hot label for each row, and every class has rows
+			if d.targets != nil || len(d.classes) != rows {
+				t.Fatalf("%d classes and %d targets for %d rows", len(d.classes), len(d.targets), rows)
+			}
+			counts := make([]int, test.classes)
+			for i, class := range d.classes {
+				if class < 0 || class >= test.classes {
+					t.Fatalf("row %d is in class %d of %d", i, class, test.classes)
+				}
+				counts[class]++
+				if mat.Sum(labels.RowView(i)) != 1 || labels.At(i, class) != 1 {
+					t.Fatalf("row %d of class %d has the labels %v", i, class, labels.RawRowView(i))
+				}
+			}
+			for class, count := range counts {
+				if count == 0 || test.balanced && count != rows/test.classes {
+					t.Errorf("class %d has %d rows, want %d", class, count, rows/test.classes)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateXORLabels(t *testing.T) {
+
+	config := testGeneratorConf
+	config.noise = 0
+	d, err := generate("xor", config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, class := range d.classes {
+		positive := 0
+		for _, v := range d.inputs.RawRowView(i) {
+			if v > 0 {
+				positive++
+			}
+		}
+		if class != positive%2 {
+			t.Errorf("row %v is in class %d", d.inputs.RawRowView(i), class)
+		}
+	}
+}
+
+func TestGenerateRejectsBadSettings(t *testing.T) {
+
+	if _, err := generate("unknown", testGeneratorConf, 1); err == nil {
+		t.Error("an unknown kind was accepted")
+	}
+	config := testGeneratorConf
+	config.rows = 0
+	if _, err := generate("blobs", config, 1); err == nil {
+		t.Error("0 rows were accepted")
+	}
+	config = testGeneratorConf
+	config.features = 1
+	if _, err := generate("xor", config, 1); err == nil {
+		t.Error("xor with 1 feature was accepted")
+	}
+}
+
+func TestGenerateCommand(t *testing.T) {
+
+	dir := t.TempDir()
+	write := func(name string) (string, string) {
+		out, testOut := filepath.Join(dir, name+".csv"), filepath.Join(dir, name+"-test.csv")
+		args := []string{"-kind", "blobs", "-features", "2", "-classes", "3", "-rows", "40", "-test-rows", "10", "-labels", "class", "-seed", "7", "-out", out, "-test-out", testOut}
+		if err := generateCommand(args); err != nil {
+			t.Fatal(err)
+		}
+		return out, testOut
+	}
+	out, testOut := write("first")
+	againOut, againTestOut := write("again")
+
+	for _, files := range [][2]string{{out, againOut}, {testOut, againTestOut}} {
+		first, err := os.ReadFile(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := os.ReadFile(files[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(first, again) {
+			t.Errorf("%s and %s differ for the same seed", filepath.Base(files[0]), filepath.Base(files[1]))
+		}
+	}
+
+	// 2 coordinates and a class on every row
+	for fileName, want := range map[string]int{out: 40, testOut: 10} {
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(lines) != want {
+			t.Errorf("%s has %d rows, want %d", filepath.Base(fileName), len(lines), want)
+		}
+		for _, line := range lines {
+			fields := strings.Split(line, ",")
+			if len(fields) != 3 {
+				t.Fatalf("%s has the row %q, want 2 coordinates and a class", filepath.Base(fileName), line)
+			}
+			if class, err := strconv.Atoi(fields[2]); err != nil || class < 0 || class > 2 {
+				t.Fatalf("%s has the class %q", filepath.Base(fileName), fields[2])
+			}
+		}
+	}
+}
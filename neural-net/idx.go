@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// IDX magic numbers for unsigned byte data with 1 and 3 dimensions
+const (
+	idxLabelsMagic = 0x00000801
+	idxImagesMagic = 0x00000803
+)
+
+// openIDX opens an IDX file, decompressing it if the name ends in .gz, and reads its dimensions
+func openIDX(fileName string, magic uint32) (io.ReadCloser, io.Reader, []int, error) {
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var reader io.Reader = bufio.NewReader(f)
+	if strings.HasSuffix(fileName, ".gz") {
+		if reader, err = gzip.NewReader(reader); err != nil {
+			f.Close()
+			return nil, nil, nil, fmt.Errorf("%s: %v", fileName, err)
+		}
+	}
+
+	// Header: the magic number and then one 32 bit size for each dimension
+	var header uint32
+	if err := binary.Read(reader, binary.BigEndian, &header); err != nil {
+		f.Close()
+		return nil, nil, nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	if header != magic {
+		f.Close()
+		return nil, nil, nil, fmt.Errorf("%s: expected IDX magic number %#x, got %#x", fileName, magic, header)
+	}
+
+	dims := make([]int, magic&0xff)
+	for i := range dims {
+		var dim uint32
+		if err := binary.Read(reader, binary.BigEndian, &dim); err != nil {
+			f.Close()
+			return nil, nil, nil, fmt.Errorf("%s: %v", fileName, err)
+		}
+		dims[i] = int(dim)
+	}
+
+	return f, reader, dims, nil
+}
+
+// loadIDXImages loads up to limit greyscale images (0 for all) from an IDX file, one image per row scaled to [0, 1]
+func loadIDXImages(fileName string, limit int) (*mat.Dense, imageShape, error) {
+
+	f, reader, dims, err := openIDX(fileName, idxImagesMagic)
+	if err != nil {
+		return nil, imageShape{}, err
+	}
+	defer f.Close()
+
+	numberOfImages := dims[0]
+	if limit > 0 && limit < numberOfImages {
+		numberOfImages = limit
+	}
+	shape := imageShape{channels: 1, height: dims[1], width: dims[2]}
+
+	pixels := make([]byte, numberOfImages*shape.size())
+	if _, err := io.ReadFull(reader, pixels); err != nil {
+		return nil, imageShape{}, fmt.Errorf("%s: %v", fileName, err)
+	}
+
+	data := make([]float64, len(pixels))
+	for i, pixel := range pixels {
+		data[i] = float64(pixel) / 255
+	}
+
+	return mat.NewDense(numberOfImages, shape.size(), data), shape, nil
+}
+
+// loadIDXLabels loads up to limit labels (0 for all) from an IDX file as one-hot rows. The
+// number of classes is one more than the largest label, but at least minClasses.
+func loadIDXLabels(fileName string, limit, minClasses int) (*mat.Dense, error) {
+
+	f, reader, dims, err := openIDX(fileName, idxLabelsMagic)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	numberOfLabels := dims[0]
+	if limit > 0 && limit < numberOfLabels {
+		numberOfLabels = limit
+	}
+
+	labels := make([]byte, numberOfLabels)
+	if _, err := io.ReadFull(reader, labels); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+
+	numberOfClasses := minClasses
+	for _, label := range labels {
+		numberOfClasses = max(numberOfClasses, int(label)+1)
+	}
+
+	oneHot := mat.NewDense(numberOfLabels, numberOfClasses, nil)
+	for i, label := range labels {
+		oneHot.Set(i, int(label), 1)
+	}
+
+	return oneHot, nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// labelClass returns the class of a row of labels, the column of its largest label
+func labelClass(labels []float64) int {
+	return floats.MaxIdx(labels)
+}
+
+// classCounts counts the rows of each class
+func classCounts(labels *mat.Dense) []float64 {
+
+	numberOfRows, numberOfClasses := labels.Dims()
+	counts := make([]float64, numberOfClasses)
+	for i := 0; i < numberOfRows; i++ {
+		counts[labelClass(labels.RawRowView(i))]++
+	}
+
+	return counts
+}
+
+// balancedClassWeights weights each class by the inverse of its share of the rows, so every class
+// adds the same total weight. Classes without rows get a weight of 0.
+func balancedClassWeights(counts []float64) []float64 {
+
+	total := floats.Sum(counts)
+	present := 0.0
+	for _, count := range counts {
+		if count > 0 {
+			present++
+		}
+	}
+
+	weights := make([]float64, len(counts))
+	for c, count := range counts {
+		if count > 0 {
+			weights[c] = total / (present * count)
+		}
+	}
+
+	return weights
+}
+
+// parseClassWeights parses a comma separated weight for each class, or "balanced" to find them from counts
+func parseClassWeights(list string, counts []float64) ([]float64, error) {
+
+	if list == "" {
+		return nil, nil
+	}
+	if list == "balanced" {
+		return balancedClassWeights(counts), nil
+	}
+
+	var weights []float64
+	for _, field := range strings.Split(list, ",") {
+		weight, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("bad class weight %q", field)
+		}
+		weights = append(weights, weight)
+	}
+	if len(weights) != len(counts) {
+		return nil, fmt.Errorf("%d class weights for %d classes", len(weights), len(counts))
+	}
+
+	return weights, nil
+}
+
+// loadSampleWeights reads a loss weight for each of numberOfRows rows from a file with one weight per line
+func loadSampleWeights(fileName string, numberOfRows int) (*mat.Dense, error) {
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var weights []float64
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		field := strings.TrimSpace(scanner.Text())
+		if field == "" {
+			continue
+		}
+		weight, err := strconv.ParseFloat(field, 64)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("%s line %d: bad weight %q", fileName, line, field)
+		}
+		weights = append(weights, weight)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(weights) != numberOfRows {
+		return nil, fmt.Errorf("%s has %d weights for %d rows", fileName, len(weights), numberOfRows)
+	}
+
+	return mat.NewDense(numberOfRows, 1, weights), nil
+}
+
+// samplingRates returns how many times each class's rows are used per epoch on average. The
+// "oversample" sampler repeats rows of smaller classes to match the largest class, and the
+// "undersample" sampler drops rows of larger classes to match the smallest class.
+func samplingRates(counts []float64, sampler string) ([]float64, error) {
+
+	largest, smallest := 0.0, math.Inf(1)
+	for _, count := range counts {
+		if count > 0 {
+			largest, smallest = math.Max(largest, count), math.Min(smallest, count)
+		}
+	}
+
+	var target float64
+	switch sampler {
+	case "", "none":
+		return nil, nil
+	case "oversample":
+		target = largest
+	case "undersample":
+		target = smallest
+	default:
+		return nil, fmt.Errorf("unknown sampler %q", sampler)
+	}
+
+	rates := make([]float64, len(counts))
+	for c, count := range counts {
+		if count > 0 {
+			rates[c] = target / count
+		}
+	}
+
+	return rates, nil
+}
+
+// repeats returns how many times to use a row with a sampling rate: the whole part of the rate,
+// plus one more with the probability of its fraction
+func repeats(rate float64, r *rand.Rand) int {
+	n := math.Floor(rate)
+	if r.Float64() < rate-n {
+		n++
+	}
+	return int(n)
+}
+
+// epochOrder returns the rows to train on in one epoch, in a random order. Each row is used as
+// many times as its class's sampling rate gives, or once if rates is nil.
+func epochOrder(labels *mat.Dense, rates []float64, r *rand.Rand) []int {
+
+	numberOfRows, _ := labels.Dims()
+	if rates == nil {
+		return r.Perm(numberOfRows)
+	}
+
+	var order []int
+	for i := 0; i < numberOfRows; i++ {
+		for n := repeats(rates[labelClass(labels.RawRowView(i))], r); n > 0; n-- {
+			order = append(order, i)
+		}
+	}
+	r.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+
+	return order
+}
+
+// gatherRows returns a copy of the listed rows of m, or nil if m is nil
+func gatherRows(m *mat.Dense, order []int) *mat.Dense {
+
+	if m == nil {
+		return nil
+	}
+
+	_, cols := m.Dims()
+	gathered := mat.NewDense(len(order), cols, nil)
+	for i, j := range order {
+		gathered.SetRow(i, m.RawRowView(j))
+	}
+
+	return gathered
+}
+
+// rowWeights multiplies each row's sample weight by the weight of its class. It returns nil if the
+// network has no class weights and weights is nil.
+func (network *network) rowWeights(labels, weights *mat.Dense) *mat.Dense {
+
+	if network.config.classWeights == nil {
+		return weights
+	}
+
+	numberOfRows, _ := labels.Dims()
+	combined := mat.NewDense(numberOfRows, 1, nil)
+	for i := 0; i < numberOfRows; i++ {
+		weight := network.config.classWeights[labelClass(labels.RawRowView(i))]
+		if weights != nil {
+			weight *= weights.At(i, 0)
+		}
+		combined.Set(i, 0, weight)
+	}
+
+	return combined
+}
+
+// lossFunction returns the network's loss, using its focusing parameter for the focal loss
+func (network *network) lossFunction() lossFunction {
+	if network.config.loss == "focal" && network.config.focalGamma > 0 {
+		return focalLoss(network.config.focalGamma)
+	}
+	return lossFunctions[network.config.loss]
+}
+
+// classHits counts the rows of each class and how many of them the outputs predict correctly
+func classHits(outputs, labels *mat.Dense) (hits, totals []float64) {
+
+	numberOfRows, numberOfClasses := labels.Dims()
+	hits, totals = make([]float64, numberOfClasses), make([]float64, numberOfClasses)
+	for i := 0; i < numberOfRows; i++ {
+		class := labelClass(labels.RawRowView(i))
+		totals[class]++
+		if floats.MaxIdx(outputs.RawRowView(i)) == class {
+			hits[class]++
+		}
+	}
+
+	return hits, totals
+}
+
+// balancedAccuracy is the mean over the classes with rows of the fraction predicted correctly
+func balancedAccuracy(hits, totals []float64) float64 {
+
+	sum, present := 0.0, 0
+	for c, total := range totals {
+		if total > 0 {
+			sum += hits[c] / total
+			present++
+		}
+	}
+	if present == 0 {
+		return 0
+	}
+
+	return sum / float64(present)
+}
+
+// calcBalancedAccuracy finds the mean over the classes of the fraction of rows predicted correctly,
+// which unlike calcAccuracy isn't dominated by the largest classes
+func calcBalancedAccuracy(outputs, labels *mat.Dense) float64 {
+	return balancedAccuracy(classHits(outputs, labels))
+}
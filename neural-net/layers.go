@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// layer is one step of the network's forward pass
+type layer interface {
+	forward(x *mat.Dense) *mat.Dense                                     // Computes the layer output for a batch of rows
+	backward(x, y, gradient *mat.Dense, learningRate float64) *mat.Dense // Adjusts the layer and returns the gradient for its input
+}
+
+// denseLayer multiplies its input by a weight matrix and adds a bias to each column
+type denseLayer struct {
+	weights *mat.Dense // Matrix of weights (inputs x outputs)
+	biases  *mat.Dense // Matrix of biases (1 x outputs)
+}
+
+// activationLayer applies an activation function to its input
+type activationLayer struct {
+	function string // One of "sigmoid", "relu", "tanh" or "softmax"
+}
+
+// newDenseLayer creates a dense layer with random weights and every bias set to bias
+func newDenseLayer(numberOfInputs, numberOfOutputs int, bias float64, r *rand.Rand) *denseLayer {
+
+	weightsRaw := make([]float64, numberOfInputs*numberOfOutputs)
+	for i := range weightsRaw {
+		weightsRaw[i] = r.Float64()
+	}
+
+	biasesRaw := make([]float64, numberOfOutputs)
+	for i := range biasesRaw {
+		biasesRaw[i] = bias
+	}
+
+	return &denseLayer{
+		weights: mat.NewDense(numberOfInputs, numberOfOutputs, weightsRaw),
+		biases:  mat.NewDense(1, numberOfOutputs, biasesRaw),
+	}
+}
+
+// record multiplies x by the weights and adds the biases
+func (layer *denseLayer) record(t *tape, x *variable, parameters []*variable) *variable {
+	return t.add(t.matMul(x, parameters[0]), parameters[1])
+}
+
+// forward multiplies x by the weights and adds the biases
+func (layer *denseLayer) forward(x *mat.Dense) *mat.Dense {
+	return tapeForward(layer, x)
+}
+
+// backward adjusts the weights and biases against the gradient
+func (layer *denseLayer) backward(x, _, gradient *mat.Dense, learningRate float64) *mat.Dense {
+	return tapeBackward(layer, x, gradient, learningRate)
+}
+
+// layerParameters returns the matrices a layer adjusts in its backward pass
+func layerParameters(layer layer) []*mat.Dense {
+
+	switch layer := layer.(type) {
+	case *denseLayer:
+		return []*mat.Dense{layer.weights, layer.biases}
+	case *convLayer:
+		return []*mat.Dense{layer.weights, layer.biases}
+	case *recurrentLayer:
+		return []*mat.Dense{layer.inputWeights, layer.hiddenWeights, layer.biases}
+	case *timeDistributedLayer:
+		return layerParameters(layer.inner)
+	case *graphLayer:
+		return layer.parameters
+	case *embeddingLayer:
+		return layer.tables
+	}
+
+	return nil
+}
+
+// isActivation reports whether name is a supported activation function
+func isActivation(name string) bool {
+	switch name {
+	case "sigmoid", "relu", "tanh", "softmax":
+		return true
+	}
+	return false
+}
+
+// elementwise reports whether the activation works on each element independently
+func (layer *activationLayer) elementwise() bool {
+	return layer.function != "softmax"
+}
+
+// activate applies an element-wise activation function to a single value
+func (layer *activationLayer) activate(v float64) float64 {
+	switch layer.function {
+	case "sigmoid":
+		return sigmoid(v)
+	case "relu":
+		return math.Max(0, v)
+	case "tanh":
+		return math.Tanh(v)
+	}
+	panic(fmt.Sprintf("activation %q is not element-wise", layer.function))
+}
+
+// record applies the activation function
+func (layer *activationLayer) record(t *tape, x *variable, _ []*variable) *variable {
+	switch layer.function {
+	case "sigmoid":
+		return t.sigmoid(x)
+	case "relu":
+		return t.relu(x)
+	case "tanh":
+		return t.tanh(x)
+	}
+	return t.softmax(x)
+}
+
+// forward applies the activation function
+func (layer *activationLayer) forward(x *mat.Dense) *mat.Dense {
+	return tapeForward(layer, x)
+}
+
+// backward multiplies the gradient by the derivative of the activation
+func (layer *activationLayer) backward(x, _, gradient *mat.Dense, _ float64) *mat.Dense {
+	return tapeBackward(layer, x, gradient, 0)
+}
+
+// softmax replaces the values of a row with their softmax in place
+func softmax(row []float64) {
+
+	max := math.Inf(-1)
+	for _, v := range row {
+		max = math.Max(max, v)
+	}
+
+	sum := 0.0
+	for j, v := range row {
+		row[j] = math.Exp(v - max) // Subtract the max so exp can't overflow
+		sum += row[j]
+	}
+	for j := range row {
+		row[j] /= sum
+	}
+}
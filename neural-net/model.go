@@ -0,0 +1,530 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// modelFormat identifies the JSON model files written by save
+const modelFormat = "neural-net/v1"
+
+// savedModel is the JSON file format of a trained network
+type savedModel struct {
+	Format      string            `json:"format"`                // Always modelFormat
+	Config      savedConfig       `json:"config"`                // The networkConf
+	Layers      []savedLayer      `json:"layers"`                // Layers in order
+	Calibration *savedCalibration `json:"calibration,omitempty"` // Applied to the outputs if set
+}
+
+// savedCalibration is the file representation of a calibration
+type savedCalibration struct {
+	Method      string      `json:"method"`
+	Softmax     bool        `json:"softmax,omitempty"`
+	A           []float64   `json:"a,omitempty"`
+	B           []float64   `json:"b,omitempty"`
+	Scores      [][]float64 `json:"scores,omitempty"`
+	Values      [][]float64 `json:"values,omitempty"`
+	Temperature float64     `json:"temperature,omitempty"`
+}
+
+// savedConfig is the file representation of networkConf
+type savedConfig struct {
+	NumberOfInputNodes  int       `json:"numberOfInputNodes"`
+	NumberOfOutputNodes int       `json:"numberOfOutputNodes"`
+	NumberOfHiddenNodes int       `json:"numberOfHiddenNodes"`
+	NumberOfEpochs      int       `json:"numberOfEpochs"`
+	LearningRate        float64   `json:"learningRate"`
+	BatchSize           int       `json:"batchSize,omitempty"`
+	Loss                string    `json:"loss,omitempty"`
+	Momentum            float64   `json:"momentum,omitempty"`
+	ClassWeights        []float64 `json:"classWeights,omitempty"`
+	FocalGamma          float64   `json:"focalGamma,omitempty"`
+	Sampler             string    `json:"sampler,omitempty"`
+	CodeLayers          int       `json:"codeLayers,omitempty"`
+	Noise               float64   `json:"noise,omitempty"`
+	Sparsity            float64   `json:"sparsity,omitempty"`
+}
+
+// savedLayer is the file representation of a layer
+type savedLayer struct {
+	Type     string                 `json:"type"`               // "dense", "activation", "conv", "pool", "flatten", "recurrent", "timeDistributed", "graph" or "embedding"
+	Function string                 `json:"function,omitempty"` // Activation function, pooling mode, recurrent cell or graph function
+	Sizes    map[string]int         `json:"sizes,omitempty"`    // Shape settings by name
+	Matrices map[string]savedMatrix `json:"matrices,omitempty"` // Parameters by name
+	Inner    *savedLayer            `json:"inner,omitempty"`    // Layer wrapped by a timeDistributed layer
+}
+
+// savedMatrix is the file representation of a mat.Dense
+type savedMatrix struct {
+	Rows int       `json:"rows"`
+	Cols int       `json:"cols"`
+	Data []float64 `json:"data"`
+}
+
+// save writes the network to a file, as ONNX if the file name ends in .onnx and as JSON otherwise
+func (network *network) save(fileName string) error {
+
+	if filepath.Ext(fileName) == ".onnx" {
+		return network.exportONNX(fileName)
+	}
+
+	model, err := network.encode()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(model)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(fileName, data, 0644)
+}
+
+// encode converts the network to its file representation
+func (network *network) encode() (savedModel, error) {
+
+	if len(network.layers) == 0 {
+		return savedModel{}, errors.New("the network has no layers")
+	}
+
+	model := savedModel{
+		Format: modelFormat,
+		Config: savedConfig{
+			NumberOfInputNodes:  network.config.numberOfInputNodes,
+			NumberOfOutputNodes: network.config.numberOfOutputNodes,
+			NumberOfHiddenNodes: network.config.numberOfHiddenNodes,
+			NumberOfEpochs:      network.config.numberOfEpochs,
+			LearningRate:        network.config.learningRate,
+			BatchSize:           network.config.batchSize,
+			Loss:                network.config.loss,
+			Momentum:            network.config.momentum,
+			ClassWeights:        network.config.classWeights,
+			FocalGamma:          network.config.focalGamma,
+			Sampler:             network.config.sampler,
+			CodeLayers:          network.config.codeLayers,
+			Noise:               network.config.noise,
+			Sparsity:            network.config.sparsity,
+		},
+	}
+
+	for i, layer := range network.layers {
+		saved, err := encodeLayer(layer)
+		if err != nil {
+			return savedModel{}, fmt.Errorf("layer %d: %v", i, err)
+		}
+		model.Layers = append(model.Layers, saved)
+	}
+
+	if c := network.calibration; c != nil {
+		model.Calibration = &savedCalibration{Method: c.method, Softmax: c.softmax, A: c.a, B: c.b, Scores: c.scores, Values: c.values, Temperature: c.temperature}
+	}
+
+	return model, nil
+}
+
+// loadNetwork reads a network written by save
+func loadNetwork(fileName string) (*network, error) {
+
+	if filepath.Ext(fileName) == ".onnx" {
+		return importONNX(fileName)
+	}
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var model savedModel
+	if err := json.Unmarshal(data, &model); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+
+	network, err := decodeNetwork(model)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+
+	return network, nil
+}
+
+// decodeNetwork converts the file representation of a network back to a network
+func decodeNetwork(model savedModel) (*network, error) {
+
+	if model.Format != modelFormat {
+		return nil, fmt.Errorf("unknown model format %q", model.Format)
+	}
+
+	network := &network{config: networkConf{
+		numberOfInputNodes:  model.Config.NumberOfInputNodes,
+		numberOfOutputNodes: model.Config.NumberOfOutputNodes,
+		numberOfHiddenNodes: model.Config.NumberOfHiddenNodes,
+		numberOfEpochs:      model.Config.NumberOfEpochs,
+		learningRate:        model.Config.LearningRate,
+		batchSize:           model.Config.BatchSize,
+		loss:                model.Config.Loss,
+		momentum:            model.Config.Momentum,
+		classWeights:        model.Config.ClassWeights,
+		focalGamma:          model.Config.FocalGamma,
+		sampler:             model.Config.Sampler,
+		codeLayers:          model.Config.CodeLayers,
+		noise:               model.Config.Noise,
+		sparsity:            model.Config.Sparsity,
+	}}
+
+	for i, saved := range model.Layers {
+		layer, err := decodeLayer(saved)
+		if err != nil {
+			return nil, fmt.Errorf("layer %d: %v", i, err)
+		}
+		network.layers = append(network.layers, layer)
+	}
+	if err := network.checkSizes(); err != nil {
+		return nil, err
+	}
+
+	if saved := model.Calibration; saved != nil {
+		c := &calibration{method: saved.Method, softmax: saved.Softmax, a: saved.A, b: saved.B, scores: saved.Scores, values: saved.Values, temperature: saved.Temperature}
+		if err := c.check(network.config.numberOfOutputNodes); err != nil {
+			return nil, fmt.Errorf("calibration: %v", err)
+		}
+		network.calibration = c
+	}
+
+	return network, nil
+}
+
+// checkSizes makes sure each layer takes as many values as the layer before it gives and that the
+// first layer takes the config's inputs, filling in the config sizes that are missing
+func (network *network) checkSizes() error {
+
+	inputs, width := 0, 0 // Values taken by the network & given by the layers so far (0 while unknown)
+	for i, layer := range network.layers {
+		layerInputs, layerOutputs, err := layerSizes(layer)
+		if err != nil {
+			return fmt.Errorf("layer %d: %v", i, err)
+		}
+		if layerInputs > 0 {
+			if width > 0 && layerInputs != width {
+				return fmt.Errorf("layer %d takes %d values but the layers before it give %d", i, layerInputs, width)
+			}
+			if inputs == 0 {
+				inputs = layerInputs
+			}
+		}
+		if layerOutputs > 0 {
+			width = layerOutputs
+		}
+	}
+
+	config := &network.config
+	if inputs > 0 && config.numberOfInputNodes > 0 && inputs != config.numberOfInputNodes {
+		return fmt.Errorf("the layers take %d values but the config has %d inputs", inputs, config.numberOfInputNodes)
+	}
+	if config.numberOfInputNodes == 0 {
+		config.numberOfInputNodes = inputs
+	}
+	if config.numberOfOutputNodes == 0 {
+		config.numberOfOutputNodes = width
+	}
+
+	return nil
+}
+
+// layerSizes returns the number of values a layer takes and gives in each row, 0 for layers that
+// work on rows of any width and give the same width back
+func layerSizes(layer layer) (inputs, outputs int, err error) {
+
+	switch layer := layer.(type) {
+	case *denseLayer:
+		rows, cols := layer.weights.Dims()
+		return rows, cols, nil
+	case *convLayer:
+		return layer.input.size(), layer.output().size(), nil
+	case *poolLayer:
+		return layer.input.size(), layer.output().size(), nil
+	case *flattenLayer:
+		return layer.input.size(), layer.input.size(), nil
+	case *recurrentLayer:
+		if layer.returnSequences {
+			return layer.input.size(), layer.output().size(), nil
+		}
+		return layer.input.size(), layer.hidden, nil
+	case *timeDistributedLayer:
+		innerInputs, innerOutputs, err := layerSizes(layer.inner)
+		if err != nil {
+			return 0, 0, err
+		}
+		if innerInputs > 0 && innerInputs != layer.input.features {
+			return 0, 0, fmt.Errorf("inner layer takes %d values but each step has %d", innerInputs, layer.input.features)
+		}
+		if innerOutputs == 0 {
+			innerOutputs = layer.input.features
+		}
+		return layer.input.size(), sequenceShape{steps: layer.input.steps, features: innerOutputs}.size(), nil
+	case *graphLayer:
+		return graphLayerSizes(layer)
+	case *embeddingLayer:
+		return layer.width, layer.outputSize(), nil
+	}
+
+	return 0, 0, nil
+}
+
+// graphLayerSizes checks the parameters of a graph layer against each other and returns its sizes like layerSizes
+func graphLayerSizes(layer *graphLayer) (inputs, outputs int, err error) {
+
+	switch layer.function {
+	case "dense", "residual":
+		if len(layer.parameters) != 2 {
+			return 0, 0, fmt.Errorf("graph %s layer has %d parameters, expected 2", layer.function, len(layer.parameters))
+		}
+		inputs, outputs = layer.parameters[0].Dims()
+		if biasRows, biasCols := layer.parameters[1].Dims(); biasRows != 1 || biasCols != outputs {
+			return 0, 0, fmt.Errorf("graph %s layer has %dx%d biases for %d outputs", layer.function, biasRows, biasCols, outputs)
+		}
+		if layer.function == "residual" && inputs != outputs {
+			return 0, 0, fmt.Errorf("graph residual layer maps %d values to %d", inputs, outputs)
+		}
+	}
+
+	return inputs, outputs, nil
+}
+
+// encodeLayer converts a layer to its file representation
+func encodeLayer(layer layer) (savedLayer, error) {
+
+	switch layer := layer.(type) {
+	case *denseLayer:
+		return savedLayer{Type: "dense", Matrices: map[string]savedMatrix{
+			"weights": encodeMatrix(layer.weights),
+			"biases":  encodeMatrix(layer.biases),
+		}}, nil
+	case *activationLayer:
+		return savedLayer{Type: "activation", Function: layer.function}, nil
+	case *convLayer:
+		sizes := encodeShape(layer.input)
+		sizes["filters"], sizes["kernel"], sizes["stride"], sizes["padding"] = layer.filters, layer.kernel, layer.stride, layer.padding
+		return savedLayer{Type: "conv", Sizes: sizes, Matrices: map[string]savedMatrix{
+			"weights": encodeMatrix(layer.weights),
+			"biases":  encodeMatrix(layer.biases),
+		}}, nil
+	case *poolLayer:
+		sizes := encodeShape(layer.input)
+		sizes["size"], sizes["stride"] = layer.size, layer.stride
+		return savedLayer{Type: "pool", Function: layer.mode, Sizes: sizes}, nil
+	case *flattenLayer:
+		return savedLayer{Type: "flatten", Sizes: encodeShape(layer.input)}, nil
+	case *recurrentLayer:
+		sizes := map[string]int{"steps": layer.input.steps, "features": layer.input.features, "hidden": layer.hidden, "truncate": layer.truncate}
+		if layer.returnSequences {
+			sizes["returnSequences"] = 1
+		}
+		return savedLayer{Type: "recurrent", Function: layer.cell, Sizes: sizes, Matrices: map[string]savedMatrix{
+			"inputWeights":  encodeMatrix(layer.inputWeights),
+			"hiddenWeights": encodeMatrix(layer.hiddenWeights),
+			"biases":        encodeMatrix(layer.biases),
+		}}, nil
+	case *timeDistributedLayer:
+		inner, err := encodeLayer(layer.inner)
+		if err != nil {
+			return savedLayer{}, err
+		}
+		return savedLayer{Type: "timeDistributed", Sizes: map[string]int{"steps": layer.input.steps, "features": layer.input.features}, Inner: &inner}, nil
+	case *graphLayer:
+		matrices := map[string]savedMatrix{}
+		for i, parameter := range layer.parameters {
+			matrices[fmt.Sprint(i)] = encodeMatrix(parameter)
+		}
+		return savedLayer{Type: "graph", Function: layer.function, Matrices: matrices}, nil
+	case *embeddingLayer:
+		sizes := map[string]int{"width": layer.width, "columns": len(layer.columns)}
+		matrices := map[string]savedMatrix{}
+		for i, column := range layer.columns {
+			sizes[fmt.Sprint("column", i)] = column
+			matrices[fmt.Sprint("table", i)] = encodeMatrix(layer.tables[i])
+		}
+		return savedLayer{Type: "embedding", Sizes: sizes, Matrices: matrices}, nil
+	}
+
+	return savedLayer{}, fmt.Errorf("%T can't be saved", layer)
+}
+
+// decodeLayer converts the file representation of a layer back to a layer
+func decodeLayer(saved savedLayer) (layer, error) {
+
+	switch saved.Type {
+	case "dense":
+		weights, err := decodeMatrix(saved.Matrices, "weights")
+		if err != nil {
+			return nil, err
+		}
+		biases, err := decodeMatrix(saved.Matrices, "biases")
+		if err != nil {
+			return nil, err
+		}
+		if _, cols := weights.Dims(); biases.RawMatrix().Cols != cols {
+			return nil, fmt.Errorf("dense layer has %d biases for %d outputs", biases.RawMatrix().Cols, cols)
+		}
+		return &denseLayer{weights: weights, biases: biases}, nil
+	case "activation":
+		if !isActivation(saved.Function) {
+			return nil, fmt.Errorf("unknown activation %q", saved.Function)
+		}
+		return &activationLayer{function: saved.Function}, nil
+	case "conv":
+		layer, err := newConvLayer(decodeShape(saved.Sizes), saved.Sizes["filters"], saved.Sizes["kernel"], saved.Sizes["stride"], saved.Sizes["padding"], rand.New(rand.NewSource(0)))
+		if err != nil {
+			return nil, err
+		}
+		if layer.weights, err = decodeMatrix(saved.Matrices, "weights"); err != nil {
+			return nil, err
+		}
+		if layer.biases, err = decodeMatrix(saved.Matrices, "biases"); err != nil {
+			return nil, err
+		}
+		if rows, cols := layer.weights.Dims(); rows != layer.input.channels*layer.kernel*layer.kernel || cols != layer.filters || layer.biases.RawMatrix().Cols != layer.filters {
+			return nil, errors.New("conv layer weights don't match its sizes")
+		}
+		return layer, nil
+	case "pool":
+		return newPoolLayer(decodeShape(saved.Sizes), saved.Function, saved.Sizes["size"], saved.Sizes["stride"])
+	case "flatten":
+		return &flattenLayer{input: decodeShape(saved.Sizes)}, nil
+	case "recurrent":
+		input := sequenceShape{steps: saved.Sizes["steps"], features: saved.Sizes["features"]}
+		layer, err := newRecurrentLayer(saved.Function, input, saved.Sizes["hidden"], saved.Sizes["returnSequences"] == 1, saved.Sizes["truncate"], rand.New(rand.NewSource(0)))
+		if err != nil {
+			return nil, err
+		}
+		for name, parameter := range map[string]**mat.Dense{"inputWeights": &layer.inputWeights, "hiddenWeights": &layer.hiddenWeights, "biases": &layer.biases} {
+			matrix, err := decodeMatrix(saved.Matrices, name)
+			if err != nil {
+				return nil, err
+			}
+			if rows, cols := (*parameter).Dims(); matrix.RawMatrix().Rows != rows || matrix.RawMatrix().Cols != cols {
+				return nil, fmt.Errorf("recurrent layer %s don't match its sizes", name)
+			}
+			*parameter = matrix
+		}
+		return layer, nil
+	case "timeDistributed":
+		if saved.Inner == nil {
+			return nil, errors.New("timeDistributed layer has no inner layer")
+		}
+		decoded, err := decodeLayer(*saved.Inner)
+		if err != nil {
+			return nil, err
+		}
+		inner, ok := decoded.(tapeLayer)
+		if !ok {
+			return nil, fmt.Errorf("timeDistributed layer can't wrap a %s layer", saved.Inner.Type)
+		}
+		return &timeDistributedLayer{inner: inner, input: sequenceShape{steps: saved.Sizes["steps"], features: saved.Sizes["features"]}}, nil
+	case "graph":
+		parameters := make([]*mat.Dense, len(saved.Matrices))
+		for i := range parameters {
+			parameter, err := decodeMatrix(saved.Matrices, fmt.Sprint(i))
+			if err != nil {
+				return nil, err
+			}
+			parameters[i] = parameter
+		}
+		return newGraphLayer(saved.Function, parameters...)
+	case "embedding":
+		layer := &embeddingLayer{width: saved.Sizes["width"]}
+		for i := 0; i < saved.Sizes["columns"]; i++ {
+			table, err := decodeMatrix(saved.Matrices, fmt.Sprint("table", i))
+			if err != nil {
+				return nil, err
+			}
+			if i > 0 && table.RawMatrix().Cols != layer.dimensions() {
+				return nil, errors.New("embedding tables have different dimensions")
+			}
+			column := saved.Sizes[fmt.Sprint("column", i)]
+			if column < 0 || column >= layer.width || (i > 0 && column <= layer.columns[i-1]) {
+				return nil, fmt.Errorf("embedding ID columns %v don't fit %d columns", append(layer.columns, column), layer.width)
+			}
+			layer.columns = append(layer.columns, column)
+			layer.tables = append(layer.tables, table)
+		}
+		if len(layer.tables) == 0 {
+			return nil, errors.New("embedding layer has no ID columns")
+		}
+		return layer, nil
+	}
+
+	return nil, fmt.Errorf("unknown layer type %q", saved.Type)
+}
+
+// encodeShape converts an image shape to sizes
+func encodeShape(shape imageShape) map[string]int {
+	return map[string]int{"channels": shape.channels, "height": shape.height, "width": shape.width}
+}
+
+// decodeShape converts sizes back to an image shape
+func decodeShape(sizes map[string]int) imageShape {
+	return imageShape{channels: sizes["channels"], height: sizes["height"], width: sizes["width"]}
+}
+
+// encodeMatrix converts a matrix to its file representation
+func encodeMatrix(m *mat.Dense) savedMatrix {
+	rows, cols := m.Dims()
+	return savedMatrix{Rows: rows, Cols: cols, Data: mat.DenseCopyOf(m).RawMatrix().Data}
+}
+
+// decodeMatrix finds a named matrix and converts it back to a mat.Dense
+func decodeMatrix(matrices map[string]savedMatrix, name string) (*mat.Dense, error) {
+
+	saved, ok := matrices[name]
+	if !ok {
+		return nil, fmt.Errorf("missing %s", name)
+	}
+	if saved.Rows <= 0 || saved.Cols <= 0 || len(saved.Data) != saved.Rows*saved.Cols {
+		return nil, fmt.Errorf("%s: %d values don't fit %dx%d", name, len(saved.Data), saved.Rows, saved.Cols)
+	}
+
+	return mat.NewDense(saved.Rows, saved.Cols, saved.Data), nil
+}
+
+// describeLayer returns a short human readable description of a layer
+func describeLayer(layer layer) string {
+
+	switch layer := layer.(type) {
+	case *denseLayer:
+		rows, cols := layer.weights.Dims()
+		return fmt.Sprintf("dense %dx%d", rows, cols)
+	case *activationLayer:
+		return layer.function
+	case *convLayer:
+		return fmt.Sprintf("conv %s -> %s (%dx%d kernel, stride %d, padding %d)", layer.input, layer.output(), layer.kernel, layer.kernel, layer.stride, layer.padding)
+	case *poolLayer:
+		return fmt.Sprintf("%s pool %s -> %s", layer.mode, layer.input, layer.output())
+	case *flattenLayer:
+		return fmt.Sprintf("flatten %s -> %d", layer.input, layer.input.size())
+	case *recurrentLayer:
+		if layer.returnSequences {
+			return fmt.Sprintf("%s %s -> %s", layer.cell, layer.input, layer.output())
+		}
+		return fmt.Sprintf("%s %s -> %d", layer.cell, layer.input, layer.hidden)
+	case *timeDistributedLayer:
+		return fmt.Sprintf("time distributed %s", describeLayer(layer.inner))
+	case *graphLayer:
+		return fmt.Sprintf("graph %s", layer.function)
+	case *embeddingLayer:
+		var vocabularies []int
+		for _, table := range layer.tables {
+			vocabulary, _ := table.Dims()
+			vocabularies = append(vocabularies, vocabulary)
+		}
+		return fmt.Sprintf("embedding of columns %v (vocabularies %v) -> %d", layer.columns, vocabularies, layer.outputSize())
+	}
+
+	return fmt.Sprintf("%T", layer)
+}
@@ -13,27 +13,38 @@ import (
 	"strings"
 	"time"
 
-	"github.com/kr/pretty"
 	"gonum.org/v1/gonum/floats"
 	"gonum.org/v1/gonum/mat"
 )
 
 // Parameters for network structure
 type networkConf struct {
-	numberOfInputNodes  int     // Number of input nodes
-	numberOfOutputNodes int     // Number of outputs nodes
-	numberOfHiddenNodes int     // Number of hidden nodes
-	numberOfEpochs      int     // Number of iterations to train
-	learningRate        float64 // Learning rate helps the network learning converge faster or slower
+	numberOfInputNodes  int       // Number of input nodes
+	numberOfOutputNodes int       // Number of outputs nodes
+	numberOfHiddenNodes int       // Number of hidden nodes
+	numberOfEpochs      int       // Number of iterations to train
+	learningRate        float64   // Learning rate helps the network learning converge faster or slower
+	batchSize           int       // Number of rows per adjustment (0 for all of them)
+	loss                string    // Name of the loss in lossFunctions ("" for squared-error)
+	momentum            float64   // Fraction of the previous adjustment added to each adjustment (0 for none)
+	classWeights        []float64 // Loss weight of each class (nil for equal weights)
+	focalGamma          float64   // Focusing parameter of the focal loss (0 for 2)
+	sampler             string    // "oversample" or "undersample" to balance the classes in each epoch ("" for neither)
+	codeLayers          int       // Layers of an autoencoder that make up its encoder (0 if it isn't one)
+	noise               float64   // Standard deviation of the noise added to an autoencoder's inputs while training
+	sparsity            float64   // Weight of the L1 penalty on an autoencoder's codes while training
 }
 
 // network structure
 type network struct {
-	config        networkConf // Config struct
-	hiddenWeights *mat.Dense  // Matrix of hiddenWights
-	hiddenBiases  *mat.Dense  // Matrix of hiddenBiases
-	outputWeights *mat.Dense  // Matrix of outputWeights
-	outputBiases  *mat.Dense  // Matrix of outputBiases
+	config      networkConf                          // Config struct
+	layers      []layer                              // Layers of the network, applied in order
+	velocities  []*mat.Dense                         // Momentum of each parameter, in the order of parameters
+	epoch       int                                  // Number of epochs trained so far
+	shuffle     *rand.Rand                           // Shuffles the rows before each epoch if set
+	afterEpoch  func(meanSquaredError float64) error // Called after each epoch if set
+	calibration *calibration                         // Maps the outputs of predict to calibrated probabilities if set
+	quiet       bool                                 // Don't print the error of each epoch
 }
 
 var (
@@ -43,6 +54,14 @@ var (
 
 func main() {
 
+	// Run a subcommand if one is given, otherwise ask for the settings in the terminal
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// // // // // //
 	// TERMINAL INPUT
 
@@ -75,6 +94,15 @@ func main() {
 	}
 	bias := numFloat
 
+	// Ask for the file to save the model to
+	fmt.Print("Model File, .json or .onnx (\"none\" if none): ")
+	input, err = reader.ReadString('\n') // Get the input
+	if err != nil {
+		log.Fatal(err)
+	}
+	input = strings.TrimSpace(input)
+	modelFileName := input
+
 	// // Ask for file name
 	// fmt.Print("File Name (\"none\" if none): ")
 	// input, err = reader.ReadString('\n') // Get the input
@@ -88,9 +116,8 @@ func main() {
 
 	// // //
 
-	// Generate some training & testing data
-	// generateData("trainingData.csv", 100)
-	// generateData("testingData.csv", 100)
+	// The training & testing data come from:
+	// nn generate -kind mixture -features 4 -rows 100 -test-rows 100 -seed 1 -out trainingData.csv -test-out testingData.csv
 
 	// Load the training matrices from a file
 	inputs, labels := load("trainingData.csv", 7)
@@ -105,7 +132,7 @@ func main() {
 	}}
 
 	// Train the neural network
-	err = network.train(inputs, labels, bias)
+	err = network.train(inputs, labels, nil, bias)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -120,171 +147,300 @@ func main() {
 	}
 
 	// Calculate the accuracy
-	var hit int                          // For calculating accuracy
-	numberOfOutputs, _ := outputs.Dims() // Gets the dimension of the outputs AKA number of outputs
+	accuracy := calcAccuracy(outputs, testLabels)
+	balanced := calcBalancedAccuracy(outputs, testLabels)
 
-	for i := 0; i < numberOfOutputs; i++ { // Iterate through number of outputs
+	// Print some stuff
+	hidden := network.layers[0].(*denseLayer)
+	output := network.layers[2].(*denseLayer)
+	fmt.Printf("hiddenWeights: % v\n", mat.Formatted(hidden.weights, mat.Prefix("               ")))
+	fmt.Printf("\nhiddenBiases: % v\n", mat.Formatted(hidden.biases, mat.Prefix("          ")))
+	fmt.Printf("\noutputWeights: % v\n", mat.Formatted(output.weights, mat.Prefix("               ")))
+	fmt.Printf("\noutputBiases: % v\n", mat.Formatted(output.biases, mat.Prefix("        ")))
+	fmt.Printf("\noutputs: % v\n", mat.Formatted(outputs, mat.Prefix("         ")))
+	fmt.Println("\nFinal accuracy:", accuracy)
+	fmt.Println("Final balanced accuracy:", balanced)
 
-		labelRow := mat.Row(nil, i, testLabels) // Get the labels from the test data
-		var prediction int                      // For calculating accuracy
-		for ix, label := range labelRow {       // Get labels == 1.0 and assign them to prediction
-			if label == 1.0 {
-				prediction = ix
-				break
-			}
-		}
+	// Quantize the trained network to int8, calibrating on the training inputs
+	quantized, err := network.quantize(inputs)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		// Total up the values
-		if outputs.At(i, prediction) == floats.Max(mat.Row(nil, i, outputs)) {
-			hit++
-		}
+	// Compare the int8 network against the float network
+	stats, err := quantizationReport(&network, quantized, testInputs, testLabels)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	// Calculates accuracy: hit / total
-	accuracy := float64(hit) / float64(numberOfOutputs)
+	if modelFileName == "none" || modelFileName == "" {
+		return
+	}
 
-	// Print some stuff
-	fmt.Printf("hiddenWeights: % v\n", mat.Formatted(network.hiddenWeights, mat.Prefix("               ")))
-	fmt.Printf("\nhiddenBiases: % v\n", mat.Formatted(network.hiddenBiases, mat.Prefix("          ")))
-	fmt.Printf("\noutputWeights: % v\n", mat.Formatted(network.outputWeights, mat.Prefix("               ")))
-	fmt.Printf("\noutputBiases: % v\n", mat.Formatted(network.outputBiases, mat.Prefix("        ")))
-	fmt.Printf("\noutputs: % v\n", mat.Formatted(outputs, mat.Prefix("         ")))
-	fmt.Println("\nFinal accuracy:", accuracy)
+	// Save the model and read it back to check the round trip
+	if err := network.save(modelFileName); err != nil {
+		log.Fatal(err)
+	}
+	loaded, err := loadNetwork(modelFileName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	difference, err := predictionDifference(&network, loaded, testInputs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("\nSaved to", modelFileName, "- largest round trip difference:", difference)
+
+	// Save the int8 network next to it and check that it still predicts within the reported change
+	quantizedFileName := modelFileName + ".int8"
+	if err := quantized.save(quantizedFileName); err != nil {
+		log.Fatal(err)
+	}
+	loadedQuantized, err := loadQuantizedNetwork(quantizedFileName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	loadedStats, err := compareQuantized(&network, loadedQuantized, testInputs, testLabels)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if loadedStats != stats {
+		log.Fatal("the int8 network read back from ", quantizedFileName, " predicts differently")
+	}
+	fmt.Println("Saved the int8 network to", quantizedFileName)
 }
 
-// train trains a neural network using backpropagation.
-func (network *network) train(inputs *mat.Dense, labels *mat.Dense, bias float64) error {
+// runCommand runs one of the subcommands:
+//
+//	nn serve -model <file>   Serve a saved model over HTTP/JSON and gRPC
+//	nn conv [flags]          Train a convolutional classifier on IDX image files
+//	nn rnn [flags]           Train a recurrent classifier on sequences from CSV files
+//	nn train [flags]         Train a classifier on CSV files with checkpoints, or resume from one
+//	nn shard [flags]         Convert CSV files to binary shard files for streaming
+//	nn embed [flags]         Train a classifier with embeddings for integer ID columns of CSV files
+//	nn explain [flags]       Attribute a saved model's predictions to its input columns
+//	nn calibrate [flags]     Calibrate a saved model's outputs on validation rows
+//	nn autoencode [flags]    Train a plain, denoising or sparse autoencoder on unlabeled rows
+//	nn encode [flags]        Write the codes and anomaly scores a saved autoencoder gives rows
+//	nn ensemble [flags]      Train an ensemble of classifiers on CSV files, or evaluate a saved one
+//	nn generate [flags]      Write a synthetic dataset with learnable structure to CSV files
+func runCommand(name string, args []string) error {
+
+	switch name {
+	case "serve":
+		return serveCommand(args)
+	case "conv":
+		return convCommand(args)
+	case "rnn":
+		return rnnCommand(args)
+	case "train":
+		return trainCommand(args)
+	case "shard":
+		return shardCommand(args)
+	case "embed":
+		return embedCommand(args)
+	case "explain":
+		return explainCommand(args)
+	case "calibrate":
+		return calibrateCommand(args)
+	case "autoencode":
+		return autoencodeCommand(args)
+	case "encode":
+		return encodeCommand(args)
+	case "ensemble":
+		return ensembleCommand(args)
+	case "generate":
+		return generateCommand(args)
+	}
 
-	// Randomization for wights & biases
-	s1 := rand.NewSource(time.Now().UnixNano())
-	r1 := rand.New(s1)
+	return fmt.Errorf("unknown command %q", name)
+}
 
-	// For biases
-	hiddenBiasesRaw := make([]float64, network.config.numberOfHiddenNodes)
-	for i := range hiddenBiasesRaw {
-		hiddenBiasesRaw[i] = bias
-	}
-	outputBiasesRaw := make([]float64, network.config.numberOfOutputNodes)
-	for i := range outputBiasesRaw {
-		outputBiasesRaw[i] = bias
-	}
+// train trains a neural network using backpropagation, weighting each row's loss
+// by weights (one column, nil for equal weights). A network without layers gets
+// a hidden & output layer, each followed by a sigmoid, with every bias set to bias.
+func (network *network) train(inputs, labels, weights *mat.Dense, bias float64) error {
 
-	// The hidden & output weights/biases (initialized to nil)
-	hiddenWeights := mat.NewDense(network.config.numberOfInputNodes, network.config.numberOfHiddenNodes, nil)
-	hiddenBiases := mat.NewDense(1, network.config.numberOfHiddenNodes, hiddenBiasesRaw)
-	outputWeights := mat.NewDense(network.config.numberOfHiddenNodes, network.config.numberOfOutputNodes, nil)
-	outputBiases := mat.NewDense(1, network.config.numberOfOutputNodes, outputBiasesRaw)
+	if len(network.layers) == 0 {
 
-	// Slices for the hidden & output weights/biases (initialized to 0)
-	hiddenWeightsRaw := hiddenWeights.RawMatrix().Data
-	outputWeightsRaw := outputWeights.RawMatrix().Data
+		// Randomization for wights & biases
+		s1 := rand.NewSource(time.Now().UnixNano())
+		r1 := rand.New(s1)
 
-	// Assign the hidden/output weights/biases slices to randomized values
-	for _, param := range [][]float64{hiddenWeightsRaw, outputWeightsRaw} {
-		for i := range param {
-			param[i] = r1.Float64()
+		network.layers = []layer{
+			newDenseLayer(network.config.numberOfInputNodes, network.config.numberOfHiddenNodes, bias, r1),
+			&activationLayer{function: "sigmoid"},
+			newDenseLayer(network.config.numberOfHiddenNodes, network.config.numberOfOutputNodes, bias, r1),
+			&activationLayer{function: "sigmoid"},
 		}
 	}
 
-	// Create output matrix
-	output := new(mat.Dense)
-
 	// Backwards propagation for adjusting weights/biases
-	if err := network.propagate(inputs, labels, hiddenWeights, hiddenBiases, outputWeights, outputBiases, output); err != nil {
-		return err
-	}
-
-	// Assign the slices to the neural network
-	network.hiddenWeights = hiddenWeights
-	network.hiddenBiases = hiddenBiases
-	network.outputWeights = outputWeights
-	network.outputBiases = outputBiases
-
-	return nil
+	return network.propagate(inputs, labels, weights)
 }
 
 // propagate handles the backwards propagation for adjusting the weights and biases
-func (network *network) propagate(inputs, labels, hiddenWeights, hiddenBiases, outputWeights, outputBiases, output *mat.Dense) error {
+func (network *network) propagate(inputs, labels, weights *mat.Dense) error {
+
+	numberOfRows, numberOfInputs := inputs.Dims()
+	_, numberOfLabels := labels.Dims()
+	if labelRows, _ := labels.Dims(); labelRows != numberOfRows {
+		return fmt.Errorf("%d rows of inputs but %d rows of labels", numberOfRows, labelRows)
+	}
+	if weights != nil {
+		if weightRows, weightCols := weights.Dims(); weightRows != numberOfRows || weightCols != 1 {
+			return fmt.Errorf("%d rows of inputs but %dx%d weights", numberOfRows, weightRows, weightCols)
+		}
+	}
+	if err := network.checkLoss(); err != nil {
+		return err
+	}
+	if network.config.classWeights != nil && len(network.config.classWeights) != numberOfLabels {
+		return fmt.Errorf("%d class weights for %d classes", len(network.config.classWeights), numberOfLabels)
+	}
 
-	// Loop through the number of epochs
-	for i := 0; i < network.config.numberOfEpochs; i++ {
+	// Samplers use each row a different number of times, and need a random source to choose them
+	rates, err := samplingRates(classCounts(labels), network.config.sampler)
+	if err != nil {
+		return err
+	}
+	r := network.shuffle
+	if rates != nil && r == nil {
+		r = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
 
-		// // // // // // // //
-		// Forward propagation
+	// Loop through the remaining epochs
+	for i := network.epoch; i < network.config.numberOfEpochs; i++ {
 
-		// Hidden layer inputs
-		hiddenLayerInput := new(mat.Dense)                       // Create new hiddenLayerInput matrix
-		hiddenLayerInput.Mul(inputs, hiddenWeights)              // Multiply matrices inputs and hiddenWeights
-		addhiddenBiases := func(_, col int, v float64) float64 { // Adds the hidden biases
-			return v + hiddenBiases.At(0, col)
+		epochInputs, epochLabels, epochWeights := inputs, labels, weights
+		if r != nil {
+			order := epochOrder(labels, rates, r)
+			epochInputs, epochLabels, epochWeights = gatherRows(inputs, order), gatherRows(labels, order), gatherRows(weights, order)
 		}
-		hiddenLayerInput.Apply(addhiddenBiases, hiddenLayerInput) // Applies the addition to each element in hiddenLayerInput
+		epochRows, _ := epochInputs.Dims()
 
-		// Hidden layer activations
-		hiddenLayerActivations := new(mat.Dense)            // Create new hiddenLayerActivations matrix
-		applySigmoid := func(_, _ int, v float64) float64 { // Use the sigmoid function
-			return sigmoid(v)
+		batchSize := network.config.batchSize
+		if batchSize <= 0 || batchSize > epochRows {
+			batchSize = epochRows
 		}
-		hiddenLayerActivations.Apply(applySigmoid, hiddenLayerInput) // Apply the sigmoid function to each element in hidddenLayerInput
 
-		// Output layer inputs
-		outputLayerInput := new(mat.Dense)                          // Create new outputLayerInput matrix
-		outputLayerInput.Mul(hiddenLayerActivations, outputWeights) // Multiply matrices hiddenLayerActivations and outputWeights
-		addoutputBiases := func(_, col int, v float64) float64 {    // Adds the output biases
-			return v + outputBiases.At(0, col)
+		squaredError := 0.0
+		for start := 0; start < epochRows; start += batchSize {
+			end := min(start+batchSize, epochRows)
+			var batchWeights *mat.Dense
+			if epochWeights != nil {
+				batchWeights = epochWeights.Slice(start, end, 0, 1).(*mat.Dense)
+			}
+			squaredError += network.step(
+				epochInputs.Slice(start, end, 0, numberOfInputs).(*mat.Dense),
+				epochLabels.Slice(start, end, 0, numberOfLabels).(*mat.Dense),
+				batchWeights,
+			)
+		}
+
+		network.epoch = i + 1
+		meanSquaredError := squaredError / float64(max(1, epochRows*numberOfLabels))
+		if !network.quiet {
+			fmt.Printf("Epoch %d: mean squared error %.6f\n", i+1, meanSquaredError)
 		}
-		outputLayerInput.Apply(addoutputBiases, outputLayerInput) // Applies the addition to each element in outputLayerInput
-		output.Apply(applySigmoid, outputLayerInput)              // Applies te sigmoid function to the outputLayerInput matrix, output of forward propagation
-
-		// // // // // // // //
-		// Backward propagation
-
-		// Calculate the difference of values within the network
-		networkError := new(mat.Dense)   // Create the networkError matrix
-		networkError.Sub(labels, output) // Subtract outputs from labels and place them in networkError
-		// networkErrorAbs := func(_, _ int, v float64) float64 {
-		// 	return abs(v)
-		// }
-		// networkError.Apply(networkErrorAbs, networkError)
-		pretty.Println("NETWORK ERROR", networkError)
-		// break
-
-		slopeOutputLayer := new(mat.Dense)                       // Create new slopeOutputLayer matrix
-		applySigmoidPrime := func(_, _ int, v float64) float64 { // Uses the sigmoidPrime function
-			return sigmoidPrime(v)
+
+		if network.afterEpoch != nil {
+			if err := network.afterEpoch(meanSquaredError); err != nil {
+				return err
+			}
 		}
-		slopeOutputLayer.Apply(applySigmoidPrime, output) // Applies the sigmoidPrime function to each element of output
+	}
+
+	return nil
+}
 
-		slopeHiddenLayer := new(mat.Dense)                                // Create the slopeHiddenLayer matrix
-		slopeHiddenLayer.Apply(applySigmoidPrime, hiddenLayerActivations) // Apply sigmoidPrime function to each element of hiddenLayerActivations
+// checkLoss defaults the loss to squared error and checks it exists
+func (network *network) checkLoss() error {
+	if network.config.loss == "" {
+		network.config.loss = "squared-error"
+	}
+	if _, ok := lossFunctions[network.config.loss]; !ok {
+		return fmt.Errorf("unknown loss %q", network.config.loss)
+	}
+	return nil
+}
 
-		outputDifference := new(mat.Dense)                       // Create new outputDifference matrix
-		outputDifference.MulElem(networkError, slopeOutputLayer) // Multiply each element of networkError and slopeOutputLayer and place them in outputDifference
+// step adjusts the weights and biases once for a batch of rows, weighting each row's loss by
+// weights (one column, nil for equal weights), and returns the batch's squared error
+func (network *network) step(inputs, labels, weights *mat.Dense) float64 {
 
-		errorAtHiddenLayer := new(mat.Dense)                        // Create new errorAtHiddenLayer matrix
-		errorAtHiddenLayer.Mul(outputDifference, outputWeights.T()) // Multiply the outputDifference matrix and the transpose of the outputWeights matrix into errorAtHiddenLayer
+	// // // // // // // //
+	// Forward propagation
 
-		hiddenLayerDifference := new(mat.Dense)                             // Create hiddenLayerDifference
-		hiddenLayerDifference.MulElem(errorAtHiddenLayer, slopeHiddenLayer) // Multiply each element of errorAtHiddenLayer and slopeHiddenLayer and place them in hiddenLayerDifference
+	// Keep the input of every layer for the backward pass
+	activations := []*mat.Dense{inputs}
+	for _, layer := range network.layers {
+		activations = append(activations, layer.forward(activations[len(activations)-1]))
+	}
+	output := activations[len(activations)-1]
 
-		// // // // // // // //
-		// Adjust the weights
+	// // // // // // // //
+	// Backward propagation
 
-		// Adjust output weights
-		outputWeightsAdj := new(mat.Dense)                                    // Create new outputWeightsAdj matrix
-		outputWeightsAdj.Mul(hiddenLayerActivations.T(), outputDifference)    // Multiply the transpose of the hiddenLayerActivations matrix and outputDifference matrices and place them in outputWeightsAdj
-		outputWeightsAdj.Scale(network.config.learningRate, outputWeightsAdj) // Scale the matrix using a learning rate
-		outputWeights.Add(outputWeights, outputWeightsAdj)                    // Add the weights
+	// Calculate the difference of values within the network
+	networkError := new(mat.Dense)   // Create the networkError matrix
+	networkError.Sub(labels, output) // Subtract outputs from labels and place them in networkError
 
-		// Adjust hidden weights
-		hiddenWeightsAdj := new(mat.Dense)                                    // Create new hiddenWeightsAdj matrix
-		hiddenWeightsAdj.Mul(inputs.T(), hiddenLayerDifference)               // Multiply the transpose of inputs an hiddenlayerDifference and place them in hiddenWeightsAdj
-		hiddenWeightsAdj.Scale(network.config.learningRate, hiddenWeightsAdj) // Scale the hidden weights using a learning rate
-		hiddenWeights.Add(hiddenWeights, hiddenWeightsAdj)                    // Add hidden weights
+	// The gradient of the loss with respect to the output comes from its forward pass
+	_, gradient := lossGradient(network.lossFunction(), output, labels, network.rowWeights(labels, weights))
 
+	// Momentum works from each parameter's adjustment, so keep the parameters from before it
+	var parameters, before []*mat.Dense
+	if network.config.momentum > 0 {
+		parameters = network.parameters()
+		for _, parameter := range parameters {
+			before = append(before, mat.DenseCopyOf(parameter))
+		}
 	}
 
-	return nil
+	// Walk back through the layers, adjusting each one
+	for j := len(network.layers) - 1; j >= 0; j-- {
+		gradient = network.layers[j].backward(activations[j], activations[j+1], gradient, network.config.learningRate)
+	}
+
+	if network.config.momentum > 0 {
+		network.applyMomentum(parameters, before)
+	}
+
+	errorValues := networkError.RawMatrix().Data
+	return floats.Dot(errorValues, errorValues)
+}
+
+// parameters returns the matrices adjusted by training, layer by layer
+func (network *network) parameters() []*mat.Dense {
+	var parameters []*mat.Dense
+	for _, layer := range network.layers {
+		parameters = append(parameters, layerParameters(layer)...)
+	}
+	return parameters
+}
+
+// applyMomentum replaces each parameter's adjustment from before with its velocity, the
+// adjustment plus momentum times the previous velocity
+func (network *network) applyMomentum(parameters, before []*mat.Dense) {
+
+	if len(network.velocities) != len(parameters) {
+		network.velocities = make([]*mat.Dense, len(parameters))
+		for i, parameter := range parameters {
+			rows, cols := parameter.Dims()
+			network.velocities[i] = mat.NewDense(rows, cols, nil)
+		}
+	}
+
+	for i, parameter := range parameters {
+		adjustment := new(mat.Dense)
+		adjustment.Sub(before[i], parameter)
+
+		velocity := network.velocities[i]
+		velocity.Scale(network.config.momentum, velocity)
+		velocity.Add(velocity, adjustment)
+		parameter.Sub(before[i], velocity)
+	}
 }
 
 // sumAlongAxis sums a matrix along a particular dimension while preserving the other dimension
@@ -319,48 +475,42 @@ func sumAlongAxis(axis int, m *mat.Dense) (*mat.Dense, error) {
 // predict makes an output prediction
 func (network *network) predict(x *mat.Dense) (*mat.Dense, error) {
 
-	// Checks for nil values
-	if network.hiddenWeights == nil || network.outputWeights == nil { // For weights
-		return nil, errors.New("the weights are empty")
+	// Checks for an untrained network
+	if len(network.layers) == 0 {
+		return nil, errors.New("the network has no layers")
 	}
-	if network.hiddenBiases == nil || network.outputBiases == nil { // For biases
-		return nil, errors.New("the biases are empty")
-	}
-
-	output := new(mat.Dense) // Create a new output matrix
 
-	// // // // /// // // //
 	// Forward propagation
-
-	// Hidden layer inputs
-	hiddenLayerInput := new(mat.Dense)             // Create new hiddenLayerInput matrix
-	hiddenLayerInput.Mul(x, network.hiddenWeights) // Multiply x and the network;s hidden weights together
-
-	// Hidden Layer biases
-	addhiddenBiases := func(_, col int, v float64) float64 { // Function for adding hidden biases
-		return v + network.hiddenBiases.At(0, col)
+	output := x
+	for _, layer := range network.layers {
+		output = layer.forward(output)
 	}
-	hiddenLayerInput.Apply(addhiddenBiases, hiddenLayerInput) // Applies the function
 
-	// Hidden layer activations
-	hiddenLayerActivations := new(mat.Dense)            // Create new hiddenLayerActiviations matrix
-	applySigmoid := func(_, _ int, v float64) float64 { // Sigmoid function
-		return sigmoid(v)
+	if network.calibration != nil {
+		output = network.calibration.apply(output)
 	}
-	hiddenLayerActivations.Apply(applySigmoid, hiddenLayerInput) // Apply the function
 
-	// Output layer input
-	outputLayerInput := new(mat.Dense)                                  // Create new outputLayerInput matrix
-	outputLayerInput.Mul(hiddenLayerActivations, network.outputWeights) // Multiply the hidden layer activations by the output weights
+	return output, nil
+}
 
-	// Output biases
-	addoutputBiases := func(_, col int, v float64) float64 { // Function for adding output biases
-		return v + network.outputBiases.At(0, col)
-	}
-	outputLayerInput.Apply(addoutputBiases, outputLayerInput) // Apply the function
-	output.Apply(applySigmoid, outputLayerInput)              // Apply the sigmoid function for each output layer input
+// predictInBatches predicts batchSize rows at a time to limit the memory used by large layers
+func (network *network) predictInBatches(x *mat.Dense, batchSize int) (*mat.Dense, error) {
 
-	//
+	numberOfRows, numberOfCols := x.Dims()
+	var output *mat.Dense
+
+	for start := 0; start < numberOfRows; start += batchSize {
+		end := min(start+batchSize, numberOfRows)
+		batch, err := network.predict(x.Slice(start, end, 0, numberOfCols).(*mat.Dense))
+		if err != nil {
+			return nil, err
+		}
+		if output == nil {
+			_, numberOfOutputs := batch.Dims()
+			output = mat.NewDense(numberOfRows, numberOfOutputs, nil)
+		}
+		output.Slice(start, end, 0, output.RawMatrix().Cols).(*mat.Dense).Copy(batch)
+	}
 
 	return output, nil
 }
@@ -379,8 +529,31 @@ func abs(x float64) float64 {
 	return math.Abs(x)
 }
 
-func calcAccuracy(testInputs, testLabels *mat.Dense) {
+// calcAccuracy finds the fraction of rows where the largest output matches the label
+func calcAccuracy(outputs, labels *mat.Dense) float64 {
+
+	var hit int                          // For calculating accuracy
+	numberOfOutputs, _ := outputs.Dims() // Gets the dimension of the outputs AKA number of outputs
+
+	for i := 0; i < numberOfOutputs; i++ { // Iterate through number of outputs
+
+		labelRow := mat.Row(nil, i, labels) // Get the labels from the test data
+		var prediction int                  // For calculating accuracy
+		for ix, label := range labelRow {   // Get labels == 1.0 and assign them to prediction
+			if label == 1.0 {
+				prediction = ix
+				break
+			}
+		}
 
+		// Total up the values
+		if outputs.At(i, prediction) == floats.Max(mat.Row(nil, i, outputs)) {
+			hit++
+		}
+	}
+
+	// Calculates accuracy: hit / total
+	return float64(hit) / float64(numberOfOutputs)
 }
 
 // load loads a file and palces each file in 2 matrices
@@ -438,52 +611,3 @@ func load(fileName string, fields int) (*mat.Dense, *mat.Dense) {
 
 	return inputs, labels
 }
-
-// generateData generates random data and saves it to a file using a file name
-func generateData(fileName string, num int) {
-
-	// Create new file
-	f, err := os.Create(fileName)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer f.Close() // Close when function finishes
-
-	// Variables for each indiviual piece of data
-	var (
-		data string // The combined data as one long string
-		i1   string
-		i2   string
-		i3   string
-		i4   string
-		l1   string
-		l2   string
-		l3   string
-	)
-
-	// s1 := rand.NewSource(time.Now().UnixNano()) // Set randomization based on clock time
-	// r1 := rand.New(s1)                          // Create a new rand
-
-	// Min and max values for the random number generator
-	min := 0.0
-	max := 1.0
-
-	// Generate the random data
-	for i := 0; i < num; i++ {
-		i1 = strconv.FormatFloat(min+rand.Float64()*(max-min), 'f', 6, 64)
-		i2 = strconv.FormatFloat(min+rand.Float64()*(max-min), 'f', 6, 64)
-		i3 = strconv.FormatFloat(min+rand.Float64()*(max-min), 'f', 6, 64)
-		i4 = strconv.FormatFloat(min+rand.Float64()*(max-min), 'f', 6, 64)
-		l1 = strconv.Itoa(rand.Intn(2))
-		l2 = strconv.Itoa(rand.Intn(2))
-		l3 = strconv.Itoa(rand.Intn(2))
-		data += i1 + "," + i2 + "," + i3 + "," + i4 + "," + l1 + "," + l2 + "," + l3 + "\n" // Place the data in a giant string
-	}
-
-	// Write the data
-	_, err = f.WriteString(data)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-}
@@ -0,0 +1,639 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+
+	"gonum.org/v1/gonum/mat"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ONNX versions written by the exporter
+const (
+	onnxIRVersion    = 8  // IR version of the model file
+	onnxOpsetVersion = 13 // Version of the default operator set
+)
+
+// ONNX tensor element types
+const (
+	onnxFloat  = 1
+	onnxDouble = 11
+)
+
+// ONNX attribute types
+const (
+	onnxAttributeFloat = 1
+	onnxAttributeInt   = 2
+)
+
+// onnxNode is one operator of an ONNX graph
+type onnxNode struct {
+	opType     string             // Name of the operator e.g. "Gemm"
+	inputs     []string           // Names of the input tensors
+	outputs    []string           // Names of the output tensors
+	attributes map[string]float64 // Int and float attributes
+}
+
+// onnxGraph is the part of an ONNX model needed to rebuild a network
+type onnxGraph struct {
+	nodes        []onnxNode            // Operators in topological order
+	initializers map[string]*mat.Dense // Constant tensors by name
+	inputs       []string              // Names of the graph inputs
+	outputs      []string              // Names of the graph outputs
+}
+
+// exportONNX writes the network's dense and activation layers to an ONNX file
+func (network *network) exportONNX(fileName string) error {
+
+	if len(network.layers) == 0 {
+		return errors.New("the network has no layers")
+	}
+	if network.calibration != nil {
+		return errors.New("ONNX files can't hold a calibration")
+	}
+
+	var nodes, initializers [][]byte // Encoded graph nodes & constant tensors
+	current := "input"               // Name of the tensor flowing between nodes
+	numberOfInputs, numberOfOutputs := 0, 0
+
+	for i, layer := range network.layers {
+
+		output := fmt.Sprintf("layer%d", i)
+		if i == len(network.layers)-1 {
+			output = "output"
+		}
+
+		switch layer := layer.(type) {
+		case *denseLayer:
+			rows, cols := layer.weights.Dims()
+			if numberOfInputs == 0 {
+				numberOfInputs = rows
+			}
+			numberOfOutputs = cols
+
+			weightsName, biasesName := output+"_weights", output+"_biases"
+			initializers = append(initializers,
+				encodeONNXTensor(weightsName, []int64{int64(rows), int64(cols)}, layer.weights.RawMatrix().Data),
+				encodeONNXTensor(biasesName, []int64{int64(cols)}, layer.biases.RawMatrix().Data),
+			)
+			nodes = append(nodes, encodeONNXNode("Gemm", []string{current, weightsName, biasesName}, output, nil))
+		case *activationLayer:
+			var attributes [][]byte
+			if layer.function == "softmax" {
+				attributes = append(attributes, encodeONNXIntAttribute("axis", -1))
+			}
+			opType := map[string]string{"sigmoid": "Sigmoid", "relu": "Relu", "tanh": "Tanh", "softmax": "Softmax"}[layer.function]
+			nodes = append(nodes, encodeONNXNode(opType, []string{current}, output, attributes))
+		default:
+			return fmt.Errorf("layer %d: %T can't be exported to ONNX", i, layer)
+		}
+
+		current = output
+	}
+
+	return os.WriteFile(fileName, encodeONNXModel(nodes, initializers, numberOfInputs, numberOfOutputs), 0644)
+}
+
+// importONNX reads an ONNX file into a network. Only sequential graphs of
+// Gemm, MatMul, Add, Sigmoid, Relu, Tanh and Softmax are supported.
+func importONNX(fileName string) (*network, error) {
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	graph, err := decodeONNXModel(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+
+	// Find the graph input that isn't a constant
+	current := ""
+	for _, input := range graph.inputs {
+		if _, ok := graph.initializers[input]; !ok {
+			current = input
+			break
+		}
+	}
+	if current == "" {
+		return nil, errors.New("the graph has no input")
+	}
+
+	network := new(network)
+
+	for _, node := range graph.nodes {
+
+		if len(node.outputs) != 1 {
+			return nil, fmt.Errorf("%s node: expected 1 output, got %d", node.opType, len(node.outputs))
+		}
+		// Add is commutative, so the bias may come first
+		inputs := node.inputs
+		if node.opType == "Add" && len(inputs) == 2 && inputs[1] == current {
+			inputs = []string{inputs[1], inputs[0]}
+		}
+		if len(inputs) == 0 || inputs[0] != current {
+			return nil, fmt.Errorf("%s node: only sequential graphs are supported", node.opType)
+		}
+
+		// Constant operands of the node
+		constants := make([]*mat.Dense, len(inputs)-1)
+		for i, name := range inputs[1:] {
+			if constants[i] = graph.initializers[name]; constants[i] == nil {
+				return nil, fmt.Errorf("%s node: input %q is not a constant", node.opType, name)
+			}
+		}
+
+		switch node.opType {
+		case "Gemm":
+			if node.attributes["transA"] != 0 {
+				return nil, errors.New("Gemm node: transA is not supported")
+			}
+			if len(constants) == 0 {
+				return nil, errors.New("Gemm node: missing weights")
+			}
+			weights := mat.DenseCopyOf(constants[0])
+			if node.attributes["transB"] != 0 {
+				weights = mat.DenseCopyOf(constants[0].T())
+			}
+			alpha, beta := 1.0, 1.0
+			if v, ok := node.attributes["alpha"]; ok {
+				alpha = v
+			}
+			if v, ok := node.attributes["beta"]; ok {
+				beta = v
+			}
+			weights.Scale(alpha, weights)
+			_, cols := weights.Dims()
+			dense := &denseLayer{weights: weights, biases: mat.NewDense(1, cols, nil)}
+			if len(constants) > 1 {
+				if err := dense.addBiases(constants[1], beta); err != nil {
+					return nil, fmt.Errorf("Gemm node: %v", err)
+				}
+			}
+			network.layers = append(network.layers, dense)
+		case "MatMul":
+			if len(constants) != 1 {
+				return nil, errors.New("MatMul node: expected a constant right hand side")
+			}
+			_, cols := constants[0].Dims()
+			network.layers = append(network.layers, &denseLayer{weights: mat.DenseCopyOf(constants[0]), biases: mat.NewDense(1, cols, nil)})
+		case "Add":
+			// Fold the addition into the biases of the preceding dense layer
+			var dense *denseLayer
+			if len(network.layers) > 0 {
+				dense, _ = network.layers[len(network.layers)-1].(*denseLayer)
+			}
+			if dense == nil || len(constants) != 1 {
+				return nil, errors.New("Add node: only bias additions after Gemm or MatMul are supported")
+			}
+			if err := dense.addBiases(constants[0], 1); err != nil {
+				return nil, fmt.Errorf("Add node: %v", err)
+			}
+		case "Sigmoid", "Relu", "Tanh":
+			network.layers = append(network.layers, &activationLayer{function: map[string]string{"Sigmoid": "sigmoid", "Relu": "relu", "Tanh": "tanh"}[node.opType]})
+		case "Softmax":
+			if axis, ok := node.attributes["axis"]; ok && axis != -1 && axis != 1 {
+				return nil, fmt.Errorf("Softmax node: axis %v is not supported", axis)
+			}
+			network.layers = append(network.layers, &activationLayer{function: "softmax"})
+		default:
+			return nil, fmt.Errorf("unsupported operator %q", node.opType)
+		}
+
+		current = node.outputs[0]
+	}
+
+	// Fill in the config from the dense layers
+	for _, layer := range network.layers {
+		if dense, ok := layer.(*denseLayer); ok {
+			rows, cols := dense.weights.Dims()
+			if network.config.numberOfInputNodes == 0 {
+				network.config.numberOfInputNodes = rows
+			} else if network.config.numberOfHiddenNodes == 0 {
+				network.config.numberOfHiddenNodes = rows
+			}
+			network.config.numberOfOutputNodes = cols
+		}
+	}
+	if network.config.numberOfInputNodes == 0 {
+		return nil, errors.New("the graph has no Gemm or MatMul nodes")
+	}
+	if err := network.checkSizes(); err != nil {
+		return nil, err
+	}
+
+	return network, nil
+}
+
+// addBiases adds scale times a bias tensor of shape [outputs] or [1, outputs] to the layer's biases
+func (layer *denseLayer) addBiases(biases *mat.Dense, scale float64) error {
+
+	_, cols := layer.biases.Dims()
+	raw := biases.RawMatrix().Data
+	if len(raw) != cols && len(raw) != 1 {
+		return fmt.Errorf("bias has %d values, expected %d", len(raw), cols)
+	}
+
+	for j := 0; j < cols; j++ {
+		layer.biases.Set(0, j, layer.biases.At(0, j)+scale*raw[j%len(raw)])
+	}
+
+	return nil
+}
+
+// predictionDifference returns the largest absolute difference between the predictions of two networks
+func predictionDifference(a, b *network, x *mat.Dense) (float64, error) {
+
+	aOutputs, err := a.predict(x)
+	if err != nil {
+		return 0, err
+	}
+	bOutputs, err := b.predict(x)
+	if err != nil {
+		return 0, err
+	}
+
+	difference := new(mat.Dense)
+	difference.Sub(aOutputs, bOutputs)
+	difference.Apply(func(_, _ int, v float64) float64 { return math.Abs(v) }, difference)
+
+	return mat.Max(difference), nil
+}
+
+// // // // // // // //
+// Encoding
+
+// encodeONNXModel encodes a ModelProto whose graph runs the nodes from "input" to "output"
+func encodeONNXModel(nodes, initializers [][]byte, numberOfInputs, numberOfOutputs int) []byte {
+
+	// Graph
+	var graph []byte
+	for _, node := range nodes {
+		graph = appendMessage(graph, 1, node)
+	}
+	graph = appendString(graph, 2, "network")
+	for _, initializer := range initializers {
+		graph = appendMessage(graph, 5, initializer)
+	}
+	graph = appendMessage(graph, 11, encodeONNXValueInfo("input", numberOfInputs))
+	graph = appendMessage(graph, 12, encodeONNXValueInfo("output", numberOfOutputs))
+
+	// Model
+	var model []byte
+	model = appendVarint(model, 1, onnxIRVersion)
+	model = appendString(model, 2, "artificial-intelligence/neural-net")
+	model = appendMessage(model, 7, graph)
+	model = appendMessage(model, 8, appendVarint(nil, 2, onnxOpsetVersion))
+
+	return model
+}
+
+// encodeONNXNode encodes a NodeProto
+func encodeONNXNode(opType string, inputs []string, output string, attributes [][]byte) []byte {
+	var b []byte
+	for _, input := range inputs {
+		b = appendString(b, 1, input)
+	}
+	b = appendString(b, 2, output)
+	b = appendString(b, 3, output)
+	b = appendString(b, 4, opType)
+	for _, attribute := range attributes {
+		b = appendMessage(b, 5, attribute)
+	}
+	return b
+}
+
+// encodeONNXIntAttribute encodes an AttributeProto holding an int
+func encodeONNXIntAttribute(name string, v int64) []byte {
+	var b []byte
+	b = appendString(b, 1, name)
+	b = appendVarint(b, 3, uint64(v))
+	b = appendVarint(b, 20, onnxAttributeInt)
+	return b
+}
+
+// encodeONNXTensor encodes a TensorProto of 32 bit floats
+func encodeONNXTensor(name string, dims []int64, data []float64) []byte {
+
+	var b []byte
+	for _, dim := range dims {
+		b = appendVarint(b, 1, uint64(dim))
+	}
+	b = appendVarint(b, 2, onnxFloat)
+	b = appendString(b, 8, name)
+
+	raw := make([]byte, 4*len(data))
+	for i, v := range data {
+		binary.LittleEndian.PutUint32(raw[4*i:], math.Float32bits(float32(v)))
+	}
+	b = appendMessage(b, 9, raw)
+
+	return b
+}
+
+// encodeONNXValueInfo encodes a ValueInfoProto for a float tensor of shape [batch, size]
+func encodeONNXValueInfo(name string, size int) []byte {
+
+	var shape []byte
+	shape = appendMessage(shape, 1, appendString(nil, 2, "batch"))
+	shape = appendMessage(shape, 1, appendVarint(nil, 1, uint64(size)))
+
+	var tensorType []byte
+	tensorType = appendVarint(tensorType, 1, onnxFloat)
+	tensorType = appendMessage(tensorType, 2, shape)
+
+	var b []byte
+	b = appendString(b, 1, name)
+	b = appendMessage(b, 2, appendMessage(nil, 1, tensorType))
+
+	return b
+}
+
+func appendVarint(b []byte, number protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, number, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendString(b []byte, number protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, number, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendMessage(b []byte, number protowire.Number, message []byte) []byte {
+	b = protowire.AppendTag(b, number, protowire.BytesType)
+	return protowire.AppendBytes(b, message)
+}
+
+// // // // // // // //
+// Decoding
+
+// protoField is one field of a decoded protobuf message
+type protoField struct {
+	number   protowire.Number // Field number
+	wireType protowire.Type   // Wire type
+	value    uint64           // Value of varint, fixed32 & fixed64 fields
+	bytes    []byte           // Value of length delimited fields
+}
+
+// decodeMessage splits a protobuf message into its fields
+func decodeMessage(b []byte) ([]protoField, error) {
+
+	var fields []protoField
+
+	for len(b) > 0 {
+
+		number, wireType, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		field := protoField{number: number, wireType: wireType}
+		switch wireType {
+		case protowire.VarintType:
+			field.value, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			field.value = uint64(v)
+		case protowire.Fixed64Type:
+			field.value, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			field.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(number, wireType, b)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		fields = append(fields, field)
+	}
+
+	return fields, nil
+}
+
+// decodeONNXModel decodes the graph of a ModelProto
+func decodeONNXModel(b []byte) (*onnxGraph, error) {
+
+	fields, err := decodeMessage(b)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, field := range fields {
+		if field.number == 7 && field.wireType == protowire.BytesType {
+			return decodeONNXGraph(field.bytes)
+		}
+	}
+
+	return nil, errors.New("the model has no graph")
+}
+
+// decodeONNXGraph decodes a GraphProto
+func decodeONNXGraph(b []byte) (*onnxGraph, error) {
+
+	fields, err := decodeMessage(b)
+	if err != nil {
+		return nil, err
+	}
+
+	graph := &onnxGraph{initializers: map[string]*mat.Dense{}}
+
+	for _, field := range fields {
+		switch field.number {
+		case 1: // node
+			node, err := decodeONNXNode(field.bytes)
+			if err != nil {
+				return nil, err
+			}
+			graph.nodes = append(graph.nodes, node)
+		case 5: // initializer
+			name, tensor, err := decodeONNXTensor(field.bytes)
+			if err != nil {
+				return nil, err
+			}
+			graph.initializers[name] = tensor
+		case 11, 12: // input & output
+			name, err := decodeONNXName(field.bytes)
+			if err != nil {
+				return nil, err
+			}
+			if field.number == 11 {
+				graph.inputs = append(graph.inputs, name)
+			} else {
+				graph.outputs = append(graph.outputs, name)
+			}
+		}
+	}
+
+	return graph, nil
+}
+
+// decodeONNXNode decodes a NodeProto
+func decodeONNXNode(b []byte) (onnxNode, error) {
+
+	node := onnxNode{attributes: map[string]float64{}}
+
+	fields, err := decodeMessage(b)
+	if err != nil {
+		return node, err
+	}
+
+	for _, field := range fields {
+		switch field.number {
+		case 1:
+			node.inputs = append(node.inputs, string(field.bytes))
+		case 2:
+			node.outputs = append(node.outputs, string(field.bytes))
+		case 4:
+			node.opType = string(field.bytes)
+		case 5:
+			if err := decodeONNXAttribute(field.bytes, node.attributes); err != nil {
+				return node, err
+			}
+		}
+	}
+
+	return node, nil
+}
+
+// decodeONNXAttribute decodes an int or float AttributeProto into attributes
+func decodeONNXAttribute(b []byte, attributes map[string]float64) error {
+
+	fields, err := decodeMessage(b)
+	if err != nil {
+		return err
+	}
+
+	var name string
+	for _, field := range fields {
+		switch field.number {
+		case 1:
+			name = string(field.bytes)
+		case 2:
+			attributes[name] = float64(math.Float32frombits(uint32(field.value)))
+		case 3:
+			attributes[name] = float64(int64(field.value))
+		}
+	}
+
+	return nil
+}
+
+// decodeONNXName decodes the name of a ValueInfoProto
+func decodeONNXName(b []byte) (string, error) {
+
+	fields, err := decodeMessage(b)
+	if err != nil {
+		return "", err
+	}
+
+	for _, field := range fields {
+		if field.number == 1 {
+			return string(field.bytes), nil
+		}
+	}
+
+	return "", errors.New("value info has no name")
+}
+
+// decodeONNXTensor decodes a float or double TensorProto into a matrix. Tensors
+// with 1 dimension become a single row.
+func decodeONNXTensor(b []byte) (string, *mat.Dense, error) {
+
+	fields, err := decodeMessage(b)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var (
+		name     string
+		dims     []int64
+		dataType uint64
+		raw      []byte
+		data     []float64
+	)
+
+	for _, field := range fields {
+		switch field.number {
+		case 1: // dims, packed or not
+			if field.wireType == protowire.BytesType {
+				for packed := field.bytes; len(packed) > 0; {
+					v, n := protowire.ConsumeVarint(packed)
+					if n < 0 {
+						return "", nil, protowire.ParseError(n)
+					}
+					dims = append(dims, int64(v))
+					packed = packed[n:]
+				}
+			} else {
+				dims = append(dims, int64(field.value))
+			}
+		case 2:
+			dataType = field.value
+		case 4: // float_data
+			if field.wireType == protowire.BytesType {
+				for i := 0; i+4 <= len(field.bytes); i += 4 {
+					data = append(data, float64(math.Float32frombits(binary.LittleEndian.Uint32(field.bytes[i:]))))
+				}
+			} else {
+				data = append(data, float64(math.Float32frombits(uint32(field.value))))
+			}
+		case 8:
+			name = string(field.bytes)
+		case 9:
+			raw = field.bytes
+		case 10: // double_data
+			if field.wireType == protowire.BytesType {
+				for i := 0; i+8 <= len(field.bytes); i += 8 {
+					data = append(data, math.Float64frombits(binary.LittleEndian.Uint64(field.bytes[i:])))
+				}
+			} else {
+				data = append(data, math.Float64frombits(field.value))
+			}
+		}
+	}
+
+	// raw_data takes the place of the typed fields
+	if raw != nil {
+		switch dataType {
+		case onnxFloat:
+			for i := 0; i+4 <= len(raw); i += 4 {
+				data = append(data, float64(math.Float32frombits(binary.LittleEndian.Uint32(raw[i:]))))
+			}
+		case onnxDouble:
+			for i := 0; i+8 <= len(raw); i += 8 {
+				data = append(data, math.Float64frombits(binary.LittleEndian.Uint64(raw[i:])))
+			}
+		}
+	}
+	if dataType != onnxFloat && dataType != onnxDouble {
+		return "", nil, fmt.Errorf("tensor %q: unsupported data type %d", name, dataType)
+	}
+
+	// Shape the data as a matrix
+	rows, cols := 1, 1
+	switch len(dims) {
+	case 0:
+	case 1:
+		cols = int(dims[0])
+	case 2:
+		rows, cols = int(dims[0]), int(dims[1])
+	default:
+		return "", nil, fmt.Errorf("tensor %q: %d dimensions are not supported", name, len(dims))
+	}
+	if rows <= 0 || cols <= 0 {
+		return "", nil, fmt.Errorf("tensor %q: empty tensors are not supported", name)
+	}
+	if len(data) != rows*cols {
+		return "", nil, fmt.Errorf("tensor %q: expected %d values, got %d", name, rows*cols, len(data))
+	}
+
+	return name, mat.NewDense(rows, cols, data), nil
+}
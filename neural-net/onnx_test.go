@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// onnxTolerance covers rounding the parameters to the 32 bit floats ONNX files hold
+const onnxTolerance = 1e-5
+
+func TestONNXRoundTrip(t *testing.T) {
+
+	r := rand.New(rand.NewSource(1))
+	for _, activation := range []string{"sigmoid", "relu", "tanh"} {
+		t.Run(activation, func(t *testing.T) {
+
+			network := &network{layers: []layer{
+				newDenseLayer(3, 5, 0.5, r),
+				&activationLayer{function: activation},
+				newDenseLayer(5, 2, -0.25, r),
+				&activationLayer{function: "softmax"},
+			}}
+
+			fileName := filepath.Join(t.TempDir(), "model.onnx")
+			if err := network.exportONNX(fileName); err != nil {
+				t.Fatal(err)
+			}
+			imported, err := importONNX(fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(imported.layers) != len(network.layers) {
+				t.Fatalf("imported %d layers, want %d", len(imported.layers), len(network.layers))
+			}
+
+			x := mat.NewDense(4, 3, nil)
+			x.Apply(func(_, _ int, _ float64) float64 { return r.NormFloat64() }, x)
+			difference, err := predictionDifference(network, imported, x)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if difference > onnxTolerance {
+				t.Errorf("predictions differ by %g after the round trip", difference)
+			}
+		})
+	}
+}
+
+func TestONNXImportAddEitherSide(t *testing.T) {
+
+	weights := []float64{1, 2, 3, 4, 5, 6}
+	biases := []float64{0.5, -1}
+	x := mat.NewDense(1, 3, []float64{1, 1, 1})
+	want := []float64{1 + 3 + 5 + 0.5, 2 + 4 + 6 - 1}
+
+	for name, addInputs := range map[string][]string{
+		"bias second": {"product", "biases"},
+		"bias first":  {"biases", "product"},
+	} {
+		t.Run(name, func(t *testing.T) {
+
+			nodes := [][]byte{
+				encodeONNXNode("MatMul", []string{"input", "weights"}, "product", nil),
+				encodeONNXNode("Add", addInputs, "output", nil),
+			}
+			initializers := [][]byte{
+				encodeONNXTensor("weights", []int64{3, 2}, weights),
+				encodeONNXTensor("biases", []int64{2}, biases),
+			}
+			fileName := filepath.Join(t.TempDir(), "model.onnx")
+			if err := os.WriteFile(fileName, encodeONNXModel(nodes, initializers, 3, 2), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			network, err := importONNX(fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			output, err := network.predict(x)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for j, v := range want {
+				if got := output.At(0, j); got != v {
+					t.Errorf("output %d is %g, want %g", j, got, v)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeONNXTensorEmpty(t *testing.T) {
+	for _, dims := range [][]int64{{0}, {0, 3}, {3, 0}} {
+		if _, _, err := decodeONNXTensor(encodeONNXTensor("empty", dims, nil)); err == nil {
+			t.Errorf("decoding a tensor of shape %v succeeded, want an error", dims)
+		}
+	}
+}
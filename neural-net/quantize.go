@@ -0,0 +1,444 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// quantParams maps between real values and int8 values: real = scale * (q - zeroPoint)
+type quantParams struct {
+	scale     float64 // Size of one int8 step in real units
+	zeroPoint int32   // The int8 value that represents a real 0
+}
+
+// quantizedLayer is a dense layer whose weights, biases and activations are stored as integers
+type quantizedLayer struct {
+	rows, cols   int         // Dimensions of the weight matrix (inputs x outputs)
+	weights      []int8      // Row major int8 weights (symmetric, zero point of 0)
+	weightParams quantParams // Scale of the weights
+	biases       []int32     // Biases quantized with scale inputParams.scale * weightParams.scale
+	inputParams  quantParams // Quantization of the layer input
+	preActParams quantParams // Quantization of the layer input after the weights and biases
+	outputParams quantParams // Quantization of the layer output after the activation
+	multiplier   int32       // Fixed point multiplier from the accumulator to preActParams
+	shift        int         // Exponent that goes with multiplier
+	lookup       [256]int8   // Activation of every int8 pre-activation, indexed by q+128
+}
+
+// quantizedNetwork is an int8 copy of a trained network that predicts using integer arithmetic only
+type quantizedNetwork struct {
+	layers  []quantizedLayer // Dense layers, each with its activation folded into a lookup table
+	softmax bool             // Whether the float outputs still need a softmax
+}
+
+// quantize converts a trained network to int8 using a sample of inputs to calibrate the activation ranges
+func (network *network) quantize(sample *mat.Dense) (*quantizedNetwork, error) {
+
+	// Checks for nil values
+	if len(network.layers) == 0 {
+		return nil, errors.New("the network has no layers")
+	}
+	if sample == nil {
+		return nil, errors.New("the calibration sample is empty")
+	}
+
+	// Run the float network over the sample, keeping the output of every layer
+	activations := []*mat.Dense{sample}
+	for _, layer := range network.layers {
+		activations = append(activations, layer.forward(activations[len(activations)-1]))
+	}
+
+	quantized := new(quantizedNetwork)
+	inputParams := chooseQuantParams(matrixRange(sample))
+
+	for i := 0; i < len(network.layers); i++ {
+
+		dense, ok := network.layers[i].(*denseLayer)
+		if !ok {
+			return nil, fmt.Errorf("layer %d: only dense layers followed by an activation can be quantized", i)
+		}
+
+		// Calibrate the pre-activation range on the dense output
+		preActParams := chooseQuantParams(matrixRange(activations[i+1]))
+		outputParams := preActParams
+		var activation *activationLayer
+
+		// Fold an element-wise activation into the layer's lookup table
+		if i+1 < len(network.layers) {
+			if next, ok := network.layers[i+1].(*activationLayer); ok && next.elementwise() {
+				activation = next
+				outputParams = chooseQuantParams(matrixRange(activations[i+2]))
+				i++
+			}
+		}
+
+		quantized.layers = append(quantized.layers, newQuantizedLayer(dense.weights, dense.biases, inputParams, preActParams, outputParams, activation))
+		inputParams = outputParams
+
+		// A softmax may only come last, where it is applied to the float outputs
+		if i+1 < len(network.layers) {
+			if next, ok := network.layers[i+1].(*activationLayer); ok && !next.elementwise() {
+				if i+2 != len(network.layers) {
+					return nil, fmt.Errorf("layer %d: a softmax can only be quantized as the last layer", i+1)
+				}
+				quantized.softmax = true
+				break
+			}
+		}
+	}
+
+	return quantized, nil
+}
+
+// newQuantizedLayer quantizes the weights and biases of one dense layer
+func newQuantizedLayer(weights, biases *mat.Dense, inputParams, preActParams, outputParams quantParams, activation *activationLayer) quantizedLayer {
+
+	rows, cols := weights.Dims()
+
+	layer := quantizedLayer{
+		rows:         rows,
+		cols:         cols,
+		weights:      make([]int8, rows*cols),
+		biases:       make([]int32, cols),
+		inputParams:  inputParams,
+		preActParams: preActParams,
+		outputParams: outputParams,
+	}
+
+	// Symmetric weight scale so that the largest weight maps to +/-127
+	maxAbs := 0.0
+	for i := 0; i < rows; i++ {
+		for j := 0; j < cols; j++ {
+			maxAbs = math.Max(maxAbs, math.Abs(weights.At(i, j)))
+		}
+	}
+	layer.weightParams = quantParams{scale: maxAbs / 127}
+	if layer.weightParams.scale == 0 {
+		layer.weightParams.scale = 1
+	}
+
+	for i := 0; i < rows; i++ {
+		for j := 0; j < cols; j++ {
+			layer.weights[i*cols+j] = int8(clamp(math.Round(weights.At(i, j)/layer.weightParams.scale), -127, 127))
+		}
+	}
+
+	// Biases share the accumulator scale so they can be added to it directly
+	accumulatorScale := inputParams.scale * layer.weightParams.scale
+	for j := 0; j < cols; j++ {
+		layer.biases[j] = int32(math.Round(biases.At(0, j) / accumulatorScale))
+	}
+
+	layer.multiplier, layer.shift = quantizeMultiplier(accumulatorScale / preActParams.scale)
+
+	// Precompute the activation for every possible int8 pre-activation
+	for q := -128; q <= 127; q++ {
+		real := preActParams.scale * float64(int32(q)-preActParams.zeroPoint)
+		if activation != nil {
+			real = activation.activate(real)
+		}
+		layer.lookup[q+128] = outputParams.quantize(real)
+	}
+
+	return layer
+}
+
+// predict makes an output prediction using integer arithmetic, only converting at the inputs and outputs
+func (quantized *quantizedNetwork) predict(x *mat.Dense) (*mat.Dense, error) {
+
+	first := quantized.layers[0]
+	last := quantized.layers[len(quantized.layers)-1]
+
+	numberOfRows, numberOfCols := x.Dims()
+	if numberOfCols != first.rows {
+		return nil, fmt.Errorf("expected %d input columns, got %d", first.rows, numberOfCols)
+	}
+
+	output := mat.NewDense(numberOfRows, last.cols, nil)
+
+	for i := 0; i < numberOfRows; i++ {
+
+		// Quantize the row of inputs
+		values := make([]int8, numberOfCols)
+		for j := range values {
+			values[j] = first.inputParams.quantize(x.At(i, j))
+		}
+
+		// Run every layer in int8
+		for l := range quantized.layers {
+			values = quantized.layers[l].forward(values)
+		}
+
+		// Convert the outputs back to float
+		row := output.RawRowView(i)
+		for j, q := range values {
+			row[j] = last.outputParams.dequantize(q)
+		}
+		if quantized.softmax {
+			softmax(row)
+		}
+	}
+
+	return output, nil
+}
+
+// forward runs one row of int8 inputs through the layer
+func (layer *quantizedLayer) forward(input []int8) []int8 {
+
+	output := make([]int8, layer.cols)
+
+	for j := 0; j < layer.cols; j++ {
+
+		// Accumulate in int32
+		accumulator := layer.biases[j]
+		for i := 0; i < layer.rows; i++ {
+			accumulator += (int32(input[i]) - layer.inputParams.zeroPoint) * int32(layer.weights[i*layer.cols+j])
+		}
+
+		// Rescale to the pre-activation range and look up the activation
+		preAct := multiplyByQuantizedMultiplier(accumulator, layer.multiplier, layer.shift) + layer.preActParams.zeroPoint
+		preAct = int32(clamp(float64(preAct), -128, 127))
+		output[j] = layer.lookup[preAct+128]
+	}
+
+	return output
+}
+
+// quantizationStats is how far an int8 network is from its float network on a labelled dataset
+type quantizationStats struct {
+	floatAccuracy     float64 // Accuracy of the float network
+	quantizedAccuracy float64 // Accuracy of the int8 network
+	maxDifference     float64 // Largest difference between the two networks' outputs
+}
+
+// quantizationReport compares the float network and its int8 copy on a labelled dataset and prints the result
+func quantizationReport(network *network, quantized *quantizedNetwork, inputs, labels *mat.Dense) (quantizationStats, error) {
+
+	stats, err := compareQuantized(network, quantized, inputs, labels)
+	if err != nil {
+		return stats, err
+	}
+
+	fmt.Println("\nQuantization report:")
+	fmt.Println("  float accuracy:    ", stats.floatAccuracy)
+	fmt.Println("  int8 accuracy:     ", stats.quantizedAccuracy)
+	fmt.Println("  accuracy drop:     ", stats.floatAccuracy-stats.quantizedAccuracy)
+	fmt.Println("  max output change: ", stats.maxDifference)
+
+	return stats, nil
+}
+
+// compareQuantized measures the accuracy of the float network and its int8 copy and how far apart their outputs are
+func compareQuantized(network *network, quantized *quantizedNetwork, inputs, labels *mat.Dense) (quantizationStats, error) {
+
+	floatOutputs, err := network.predict(inputs)
+	if err != nil {
+		return quantizationStats{}, err
+	}
+	quantizedOutputs, err := quantized.predict(inputs)
+	if err != nil {
+		return quantizationStats{}, err
+	}
+
+	// Largest difference between the two sets of outputs
+	maxDifference := 0.0
+	rows, cols := floatOutputs.Dims()
+	for i := 0; i < rows; i++ {
+		for j := 0; j < cols; j++ {
+			maxDifference = math.Max(maxDifference, math.Abs(floatOutputs.At(i, j)-quantizedOutputs.At(i, j)))
+		}
+	}
+
+	return quantizationStats{
+		floatAccuracy:     calcAccuracy(floatOutputs, labels),
+		quantizedAccuracy: calcAccuracy(quantizedOutputs, labels),
+		maxDifference:     maxDifference,
+	}, nil
+}
+
+// quantizedFormat identifies the JSON files written by quantizedNetwork.save
+const quantizedFormat = "neural-net/int8-v1"
+
+// savedQuantizedModel is the JSON file format of an int8 network
+type savedQuantizedModel struct {
+	Format  string                `json:"format"`            // Always quantizedFormat
+	Layers  []savedQuantizedLayer `json:"layers"`            // Layers in order
+	Softmax bool                  `json:"softmax,omitempty"` // Whether the float outputs still need a softmax
+}
+
+// savedQuantizedLayer is the file representation of a quantizedLayer
+type savedQuantizedLayer struct {
+	Rows         int              `json:"rows"`
+	Cols         int              `json:"cols"`
+	Weights      []int8           `json:"weights"`
+	WeightParams savedQuantParams `json:"weightParams"`
+	Biases       []int32          `json:"biases"`
+	InputParams  savedQuantParams `json:"inputParams"`
+	PreActParams savedQuantParams `json:"preActParams"`
+	OutputParams savedQuantParams `json:"outputParams"`
+	Multiplier   int32            `json:"multiplier"`
+	Shift        int              `json:"shift"`
+	Lookup       []int8           `json:"lookup"` // The folded activation, as it can't be rebuilt without the float network
+}
+
+// savedQuantParams is the file representation of quantParams
+type savedQuantParams struct {
+	Scale     float64 `json:"scale"`
+	ZeroPoint int32   `json:"zeroPoint"`
+}
+
+// save writes the int8 network to a JSON file
+func (quantized *quantizedNetwork) save(fileName string) error {
+
+	model := savedQuantizedModel{Format: quantizedFormat, Softmax: quantized.softmax}
+	for _, layer := range quantized.layers {
+		model.Layers = append(model.Layers, savedQuantizedLayer{
+			Rows:         layer.rows,
+			Cols:         layer.cols,
+			Weights:      layer.weights,
+			WeightParams: savedQuantParams{layer.weightParams.scale, layer.weightParams.zeroPoint},
+			Biases:       layer.biases,
+			InputParams:  savedQuantParams{layer.inputParams.scale, layer.inputParams.zeroPoint},
+			PreActParams: savedQuantParams{layer.preActParams.scale, layer.preActParams.zeroPoint},
+			OutputParams: savedQuantParams{layer.outputParams.scale, layer.outputParams.zeroPoint},
+			Multiplier:   layer.multiplier,
+			Shift:        layer.shift,
+			Lookup:       layer.lookup[:],
+		})
+	}
+
+	data, err := json.Marshal(model)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(fileName, data, 0644)
+}
+
+// loadQuantizedNetwork reads an int8 network written by quantizedNetwork.save
+func loadQuantizedNetwork(fileName string) (*quantizedNetwork, error) {
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var model savedQuantizedModel
+	if err := json.Unmarshal(data, &model); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	if model.Format != quantizedFormat {
+		return nil, fmt.Errorf("%s: unknown format %q", fileName, model.Format)
+	}
+	if len(model.Layers) == 0 {
+		return nil, fmt.Errorf("%s: the network has no layers", fileName)
+	}
+
+	quantized := &quantizedNetwork{softmax: model.Softmax}
+	for i, saved := range model.Layers {
+
+		// Check the sizes so that forward can't index out of range
+		if saved.Rows <= 0 || saved.Cols <= 0 || len(saved.Weights) != saved.Rows*saved.Cols || len(saved.Biases) != saved.Cols {
+			return nil, fmt.Errorf("%s: layer %d: %d weights and %d biases don't fit %dx%d", fileName, i, len(saved.Weights), len(saved.Biases), saved.Rows, saved.Cols)
+		}
+		if len(saved.Lookup) != 256 {
+			return nil, fmt.Errorf("%s: layer %d: the lookup table has %d entries, want 256", fileName, i, len(saved.Lookup))
+		}
+		if i > 0 && saved.Rows != quantized.layers[i-1].cols {
+			return nil, fmt.Errorf("%s: layer %d: expects %d inputs, the previous layer has %d outputs", fileName, i, saved.Rows, quantized.layers[i-1].cols)
+		}
+
+		layer := quantizedLayer{
+			rows:         saved.Rows,
+			cols:         saved.Cols,
+			weights:      saved.Weights,
+			weightParams: quantParams{saved.WeightParams.Scale, saved.WeightParams.ZeroPoint},
+			biases:       saved.Biases,
+			inputParams:  quantParams{saved.InputParams.Scale, saved.InputParams.ZeroPoint},
+			preActParams: quantParams{saved.PreActParams.Scale, saved.PreActParams.ZeroPoint},
+			outputParams: quantParams{saved.OutputParams.Scale, saved.OutputParams.ZeroPoint},
+			multiplier:   saved.Multiplier,
+			shift:        saved.Shift,
+		}
+		copy(layer.lookup[:], saved.Lookup)
+		quantized.layers = append(quantized.layers, layer)
+	}
+
+	return quantized, nil
+}
+
+// chooseQuantParams picks a scale and zero point that cover a range of real values
+func chooseQuantParams(valueRange [2]float64) quantParams {
+
+	// The range must contain 0 so that 0 is exactly representable
+	min := math.Min(valueRange[0], 0)
+	max := math.Max(valueRange[1], 0)
+	if max == min {
+		return quantParams{scale: 1}
+	}
+
+	scale := (max - min) / 255
+	zeroPoint := int32(clamp(math.Round(-128-min/scale), -128, 127))
+
+	return quantParams{scale: scale, zeroPoint: zeroPoint}
+}
+
+// quantize converts a real value to int8
+func (params quantParams) quantize(v float64) int8 {
+	return int8(clamp(math.Round(v/params.scale)+float64(params.zeroPoint), -128, 127))
+}
+
+// dequantize converts an int8 value back to a real value
+func (params quantParams) dequantize(q int8) float64 {
+	return params.scale * float64(int32(q)-params.zeroPoint)
+}
+
+// quantizeMultiplier splits a real multiplier into a Q31 fixed point value and a power of 2 exponent
+func quantizeMultiplier(m float64) (int32, int) {
+
+	if m == 0 {
+		return 0, 0
+	}
+
+	fraction, exponent := math.Frexp(m) // m = fraction * 2^exponent with fraction in [0.5, 1)
+	q := int64(math.Round(fraction * (1 << 31)))
+	if q == 1<<31 { // Rounding pushed the fraction up to 1
+		q /= 2
+		exponent++
+	}
+
+	return int32(q), exponent
+}
+
+// multiplyByQuantizedMultiplier computes round(x * multiplier * 2^(shift-31)) with integers
+func multiplyByQuantizedMultiplier(x int32, multiplier int32, shift int) int32 {
+
+	product := int64(x) * int64(multiplier)
+	rightShift := 31 - shift
+
+	if rightShift <= 0 {
+		return int32(clamp(float64(product<<uint(-rightShift)), math.MinInt32, math.MaxInt32))
+	}
+
+	rounding := int64(1) << uint(rightShift-1)
+	if product < 0 {
+		rounding--
+	}
+
+	return int32(clamp(float64((product+rounding)>>uint(rightShift)), math.MinInt32, math.MaxInt32))
+}
+
+// matrixRange returns the smallest and largest value of a matrix
+func matrixRange(m *mat.Dense) [2]float64 {
+	return [2]float64{mat.Min(m), mat.Max(m)}
+}
+
+// clamp limits v to [min, max]
+func clamp(v, min, max float64) float64 {
+	return math.Max(min, math.Min(max, v))
+}
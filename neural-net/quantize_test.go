@@ -0,0 +1,115 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// Limits on how far the int8 network may be from the float network it was quantized from
+const (
+	quantizedOutputTolerance = 0.05
+	quantizedAccuracyDrop    = 0.02
+)
+
+func TestQuantizedMatchesFloat(t *testing.T) {
+
+	for _, activation := range []string{"sigmoid", "relu", "tanh"} {
+		t.Run(activation, func(t *testing.T) {
+
+			network, inputs, labels := quantizationNetwork(t, activation)
+			quantized, err := network.quantize(inputs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stats, err := compareQuantized(network, quantized, inputs, labels)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.maxDifference > quantizedOutputTolerance {
+				t.Errorf("int8 outputs change by up to %g", stats.maxDifference)
+			}
+			if drop := stats.floatAccuracy - stats.quantizedAccuracy; drop > quantizedAccuracyDrop {
+				t.Errorf("accuracy drops by %g, from %g to %g", drop, stats.floatAccuracy, stats.quantizedAccuracy)
+			}
+
+			// Every output is within the reported change
+			floatOutputs, err := network.predict(inputs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			quantizedOutputs, err := quantized.predict(inputs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows, cols := floatOutputs.Dims()
+			for i := 0; i < rows; i++ {
+				for j := 0; j < cols; j++ {
+					if difference := math.Abs(floatOutputs.At(i, j) - quantizedOutputs.At(i, j)); difference > stats.maxDifference {
+						t.Fatalf("output %d,%d changes by %g, more than the reported %g", i, j, difference, stats.maxDifference)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestQuantizedRoundTrip(t *testing.T) {
+
+	network, inputs, _ := quantizationNetwork(t, "relu")
+	quantized, err := network.quantize(inputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileName := filepath.Join(t.TempDir(), "model.int8")
+	if err := quantized.save(fileName); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadQuantizedNetwork(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := quantized.predict(inputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := loaded.predict(inputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mat.EqualApprox(got, want, 1e-12) {
+		t.Errorf("predictions differ after the round trip:\n%v\n%v", mat.Formatted(got), mat.Formatted(want))
+	}
+}
+
+// quantizationNetwork trains a small classifier with a softmax output on blobs, returning it and its training rows
+func quantizationNetwork(t *testing.T, activation string) (*network, *mat.Dense, *mat.Dense) {
+
+	d, err := generate("blobs", generatorConf{rows: 150, features: 4, classes: 3, spread: 1}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs, labels := d.inputs, d.labels()
+
+	r := rand.New(rand.NewSource(1))
+	network := &network{
+		config: networkConf{numberOfInputNodes: 4, numberOfOutputNodes: 3, numberOfHiddenNodes: 8, numberOfEpochs: 200, learningRate: 0.05},
+		layers: []layer{
+			newDenseLayer(4, 8, 0, r),
+			&activationLayer{function: activation},
+			newDenseLayer(8, 3, 0, r),
+			&activationLayer{function: "softmax"},
+		},
+		quiet: true,
+	}
+	if err := network.train(inputs, labels, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	return network, inputs, labels
+}
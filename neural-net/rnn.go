@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// Sequences are stored one per matrix row. The first column holds the length
+// of the sequence and the rest hold its steps one after another, padded with
+// zeros up to the longest sequence. Steps past a row's length are masked: they
+// don't change the recurrent state, their outputs are 0 and they get no
+// gradient.
+
+// sequenceShape is the shape of the sequences held in matrix rows
+type sequenceShape struct {
+	steps    int // Most steps in a sequence
+	features int // Values in each step
+}
+
+// size is the number of columns a sequence of this shape takes up
+func (shape sequenceShape) size() int {
+	return 1 + shape.steps*shape.features
+}
+
+func (shape sequenceShape) String() string {
+	return fmt.Sprintf("%dx%d", shape.steps, shape.features)
+}
+
+// sequenceLengths reads the length column of x, limited to [0, steps]
+func sequenceLengths(x *mat.Dense, steps int) []int {
+	numberOfRows, _ := x.Dims()
+	lengths := make([]int, numberOfRows)
+	for n := range lengths {
+		lengths[n] = max(0, min(steps, int(math.Round(x.At(n, 0)))))
+	}
+	return lengths
+}
+
+// lengthColumn returns sequence lengths as the length column of sequence rows
+func lengthColumn(lengths []int) *mat.Dense {
+	column := mat.NewDense(len(lengths), 1, nil)
+	for n, length := range lengths {
+		column.Set(n, 0, float64(length))
+	}
+	return column
+}
+
+// recurrentLayer is a simple RNN, LSTM or GRU over sequence rows
+type recurrentLayer struct {
+	cell            string        // "rnn", "lstm" or "gru"
+	input           sequenceShape // Shape of the input sequences
+	hidden          int           // Size of the hidden state
+	returnSequences bool          // Output every step (many-to-many) rather than the last one (many-to-one)
+	truncate        int           // Steps to backpropagate through before cutting the gradient (0 for all)
+	inputWeights    *mat.Dense    // features x gates*hidden
+	hiddenWeights   *mat.Dense    // hidden x gates*hidden
+	biases          *mat.Dense    // 1 x gates*hidden
+}
+
+// timeDistributedLayer applies a dense or activation layer to every step of a sequence
+type timeDistributedLayer struct {
+	inner tapeLayer     // The layer applied to each step
+	input sequenceShape // Shape of the input sequences
+}
+
+// newRecurrentLayer creates a recurrent layer with random weights
+func newRecurrentLayer(cell string, input sequenceShape, hidden int, returnSequences bool, truncate int, r *rand.Rand) (*recurrentLayer, error) {
+
+	layer := &recurrentLayer{cell: cell, input: input, hidden: hidden, returnSequences: returnSequences, truncate: truncate}
+	if layer.gates() == 0 {
+		return nil, fmt.Errorf("recurrent: unknown cell %q", cell)
+	}
+	if input.steps < 1 || input.features < 1 || hidden < 1 || truncate < 0 {
+		return nil, errors.New("recurrent: steps, features and hidden must be positive and truncate can't be negative")
+	}
+
+	width := layer.gates() * hidden
+	layer.inputWeights = randomNormalMatrix(input.features, width, 1/math.Sqrt(float64(input.features)), r)
+	layer.hiddenWeights = randomNormalMatrix(hidden, width, 1/math.Sqrt(float64(hidden)), r)
+	layer.biases = mat.NewDense(1, width, nil)
+
+	// Start the LSTM forget gate open so the cell remembers by default
+	if cell == "lstm" {
+		for j := hidden; j < 2*hidden; j++ {
+			layer.biases.Set(0, j, 1)
+		}
+	}
+
+	return layer, nil
+}
+
+// gates is the number of blocks of hidden values each step computes
+func (layer *recurrentLayer) gates() int {
+	switch layer.cell {
+	case "rnn":
+		return 1 // tanh
+	case "lstm":
+		return 4 // input, forget, output, candidate
+	case "gru":
+		return 3 // update, reset, candidate
+	}
+	return 0
+}
+
+// output is the shape of the output sequences when returnSequences is set
+func (layer *recurrentLayer) output() sequenceShape {
+	return sequenceShape{steps: layer.input.steps, features: layer.hidden}
+}
+
+// record steps through every sequence, returning the state after the last step of each one, or the
+// states of every step as sequence rows when returnSequences is set
+func (layer *recurrentLayer) record(t *tape, x *variable, parameters []*variable) *variable {
+
+	inputWeights, hiddenWeights, biases := parameters[0], parameters[1], parameters[2]
+	numberOfRows, _ := x.value.Dims()
+	h, features := layer.hidden, layer.input.features
+	lengths := sequenceLengths(x.value, layer.input.steps)
+
+	zeros := t.newVariable(mat.NewDense(numberOfRows, h, nil))
+	state, cells := zeros, zeros // LSTM cell states are only used by the LSTM
+	last := zeros                // The state after the last step of each sequence
+	outputs := []*variable{t.newVariable(lengthColumn(lengths))}
+
+	for step := 0; step < layer.input.steps; step++ {
+
+		// Truncated BPTT: don't carry the gradient back past the start of a chunk
+		previous, previousCells := state, cells
+		if layer.truncate > 0 && step > 0 && step%layer.truncate == 0 {
+			previous, previousCells = t.detach(state), t.detach(cells)
+		}
+
+		// Pre-activations from the input and from the previous state, with a block of h columns for each gate
+		inputPart := t.add(t.matMul(t.columns(x, 1+step*features, 1+(step+1)*features), inputWeights), biases)
+		hiddenPart := t.matMul(previous, hiddenWeights)
+		gate := func(part *variable, i int) *variable { return t.columns(part, i*h, (i+1)*h) }
+
+		var next, nextCells *variable
+		switch layer.cell {
+		case "rnn":
+			next = t.tanh(t.add(inputPart, hiddenPart))
+		case "lstm":
+			preActivation := t.add(inputPart, hiddenPart)
+			input, forget := t.sigmoid(gate(preActivation, 0)), t.sigmoid(gate(preActivation, 1))
+			output, candidate := t.sigmoid(gate(preActivation, 2)), t.tanh(gate(preActivation, 3))
+			nextCells = t.add(t.mul(forget, previousCells), t.mul(input, candidate))
+			next = t.mul(output, t.tanh(nextCells))
+		case "gru":
+			update := t.sigmoid(t.add(gate(inputPart, 0), gate(hiddenPart, 0)))
+			reset := t.sigmoid(t.add(gate(inputPart, 1), gate(hiddenPart, 1)))
+			candidate := t.tanh(t.add(gate(inputPart, 2), t.mul(reset, gate(hiddenPart, 2))))
+			next = t.add(t.mul(t.sub(t.constant(1), update), candidate), t.mul(update, previous))
+		}
+
+		// Masked steps carry the state through unchanged and output 0
+		active, isLast := make([]bool, numberOfRows), make([]bool, numberOfRows)
+		for n, length := range lengths {
+			active[n], isLast[n] = step < length, step == length-1
+		}
+		state = t.choose(active, next, previous)
+		if nextCells != nil {
+			cells = t.choose(active, nextCells, previousCells)
+		}
+		if layer.returnSequences {
+			outputs = append(outputs, t.choose(active, state, zeros))
+		} else {
+			last = t.choose(isLast, state, last)
+		}
+	}
+
+	if !layer.returnSequences {
+		return last
+	}
+
+	return t.concat(outputs...)
+}
+
+// forward returns the state after the last step of each sequence, or the
+// states of every step as sequence rows when returnSequences is set
+func (layer *recurrentLayer) forward(x *mat.Dense) *mat.Dense {
+	return tapeForward(layer, x)
+}
+
+// backward runs backpropagation through time, adjusts the weights and returns the gradient for the input sequences
+func (layer *recurrentLayer) backward(x, _, gradient *mat.Dense, learningRate float64) *mat.Dense {
+	return tapeBackward(layer, x, gradient, learningRate)
+}
+
+// record applies the inner layer to the valid steps of every sequence at once, one step per row
+func (layer *timeDistributedLayer) record(t *tape, x *variable, parameters []*variable) *variable {
+
+	numberOfRows, columns := x.value.Dims()
+	steps, features := layer.input.steps, layer.input.features
+	lengths := sequenceLengths(x.value, steps)
+
+	// Row n*steps+step holds that step of sequence n, or zeros if it's masked
+	stacked := t.gather(x, numberOfRows*steps, features, func(i, j int) int {
+		if i%steps >= lengths[i/steps] {
+			return -1
+		}
+		return i/steps*columns + 1 + i%steps*features + j
+	})
+	output := layer.inner.record(t, stacked, parameters)
+
+	// Back to sequence rows, zeroing the masked steps
+	_, outputFeatures := output.value.Dims()
+	unstacked := t.gather(output, numberOfRows, steps*outputFeatures, func(n, j int) int {
+		if j/outputFeatures >= lengths[n] {
+			return -1
+		}
+		return n*steps*outputFeatures + j
+	})
+
+	return t.concat(t.newVariable(lengthColumn(lengths)), unstacked)
+}
+
+// forward applies the inner layer to every step
+func (layer *timeDistributedLayer) forward(x *mat.Dense) *mat.Dense {
+	return tapeForward(layer, x)
+}
+
+// backward runs the inner layer's backward pass on every step at once
+func (layer *timeDistributedLayer) backward(x, _, gradient *mat.Dense, learningRate float64) *mat.Dense {
+	return tapeBackward(layer, x, gradient, learningRate)
+}
+
+// loadSequences loads variable length sequences from a CSV file. For
+// many-to-one data each record is a class label followed by the steps; for
+// many-to-many data each step is followed by its own class label.
+func loadSequences(fileName string, features int, manyToMany bool) (*mat.Dense, *mat.Dense, sequenceShape, int, error) {
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, nil, sequenceShape{}, 0, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1 // Sequences have different lengths
+	rawCSVData, err := reader.ReadAll()
+	if err != nil {
+		return nil, nil, sequenceShape{}, 0, err
+	}
+
+	stepSize := features
+	if manyToMany {
+		stepSize++
+	}
+
+	// Parse the records, finding the longest sequence and the number of classes
+	records := make([][]float64, len(rawCSVData))
+	shape := sequenceShape{features: features}
+	numberOfClasses := 0
+	for i, record := range rawCSVData {
+		for _, val := range record {
+			parsedVal, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				return nil, nil, sequenceShape{}, 0, fmt.Errorf("%s line %d: %v", fileName, i+1, err)
+			}
+			records[i] = append(records[i], parsedVal)
+		}
+
+		values := records[i]
+		if !manyToMany {
+			numberOfClasses = max(numberOfClasses, int(values[0])+1)
+			values = values[1:]
+		}
+		if len(values)%stepSize != 0 {
+			return nil, nil, sequenceShape{}, 0, fmt.Errorf("%s line %d: %d values aren't whole steps of %d", fileName, i+1, len(values), stepSize)
+		}
+		shape.steps = max(shape.steps, len(values)/stepSize)
+		for t := 0; manyToMany && t < len(values)/stepSize; t++ {
+			numberOfClasses = max(numberOfClasses, int(values[t*stepSize+features])+1)
+		}
+	}
+
+	inputs := mat.NewDense(len(records), shape.size(), nil)
+	labelShape := sequenceShape{steps: shape.steps, features: numberOfClasses}
+	labels := mat.NewDense(len(records), numberOfClasses, nil)
+	if manyToMany {
+		labels = mat.NewDense(len(records), labelShape.size(), nil)
+	}
+
+	for i, values := range records {
+		input, label := inputs.RawRowView(i), labels.RawRowView(i)
+		if !manyToMany {
+			label[int(values[0])] = 1
+			values = values[1:]
+		}
+		length := len(values) / stepSize
+		input[0] = float64(length)
+		if manyToMany {
+			label[0] = float64(length)
+		}
+		for t := 0; t < length; t++ {
+			copy(input[1+t*features:1+(t+1)*features], values[t*stepSize:t*stepSize+features])
+			if manyToMany {
+				label[1+t*numberOfClasses+int(values[t*stepSize+features])] = 1
+			}
+		}
+	}
+
+	return inputs, labels, shape, numberOfClasses, nil
+}
+
+// calcSequenceAccuracy finds the fraction of valid steps where the largest output matches the label
+func calcSequenceAccuracy(outputs, labels *mat.Dense, numberOfClasses int) float64 {
+
+	numberOfRows, _ := labels.Dims()
+	var hit, total int
+
+	for n := 0; n < numberOfRows; n++ {
+		output, label := outputs.RawRowView(n), labels.RawRowView(n)
+		for t := 0; t < int(label[0]); t++ {
+			start := 1 + t*numberOfClasses
+			if floats.MaxIdx(output[start:start+numberOfClasses]) == floats.MaxIdx(label[start:start+numberOfClasses]) {
+				hit++
+			}
+			total++
+		}
+	}
+
+	return float64(hit) / float64(total)
+}
+
+// rnnCommand runs `nn rnn`, training a recurrent classifier on sequences from CSV files
+func rnnCommand(args []string) error {
+
+	flags := flag.NewFlagSet("rnn", flag.ExitOnError)
+	data := flags.String("data", "sequences.csv", "CSV file of training sequences")
+	testData := flags.String("test-data", "", "CSV file of testing sequences (defaults to -data)")
+	features := flags.Int("features", 1, "values in each step")
+	cell := flags.String("cell", "lstm", "recurrent cell: rnn, lstm or gru")
+	hidden := flags.Int("hidden", 16, "size of the hidden state")
+	manyToMany := flags.Bool("many-to-many", false, "label every step instead of each whole sequence")
+	truncate := flags.Int("truncate", 0, "steps to backpropagate through time (0 for all)")
+	epochs := flags.Int("epochs", 50, "number of passes over the training sequences")
+	batchSize := flags.Int("batch-size", 16, "sequences per gradient step")
+	learningRate := flags.Float64("learning-rate", 0.5, "learning rate")
+	loss := flags.String("loss", "squared-error", "loss to train with: squared-error, cross-entropy or focal")
+	modelFile := flags.String("model", "", "file to save the trained model to (optional)")
+	flags.Parse(args)
+
+	if *testData == "" {
+		*testData = *data
+	}
+
+	inputs, labels, shape, numberOfClasses, err := loadSequences(*data, *features, *manyToMany)
+	if err != nil {
+		return err
+	}
+
+	// Build the network
+	r1 := rand.New(rand.NewSource(time.Now().UnixNano()))
+	recurrent, err := newRecurrentLayer(*cell, shape, *hidden, *manyToMany, *truncate, r1)
+	if err != nil {
+		return err
+	}
+
+	network := network{config: networkConf{
+		numberOfInputNodes:  shape.size(),
+		numberOfOutputNodes: numberOfClasses,
+		numberOfHiddenNodes: *hidden,
+		numberOfEpochs:      *epochs,
+		learningRate:        *learningRate / float64(*batchSize),
+		batchSize:           *batchSize,
+		loss:                *loss,
+	}}
+
+	if *manyToMany {
+		network.layers = []layer{
+			recurrent,
+			&timeDistributedLayer{inner: newNormalDenseLayer(*hidden, numberOfClasses, r1), input: recurrent.output()},
+			&timeDistributedLayer{inner: &activationLayer{function: "sigmoid"}, input: sequenceShape{steps: shape.steps, features: numberOfClasses}},
+		}
+	} else {
+		network.layers = []layer{
+			recurrent,
+			newNormalDenseLayer(*hidden, numberOfClasses, r1),
+			&activationLayer{function: "sigmoid"},
+		}
+	}
+
+	// Train the neural network
+	if err := network.train(inputs, labels, nil, 0); err != nil {
+		return err
+	}
+
+	// Check the accuracy on the testing sequences
+	testInputs, testLabels, testShape, _, err := loadSequences(*testData, *features, *manyToMany)
+	if err != nil {
+		return err
+	}
+	if testShape.steps > shape.steps {
+		return fmt.Errorf("testing sequences have up to %d steps, training sequences have %d", testShape.steps, shape.steps)
+	}
+	testInputs = padSequences(testInputs, testShape, shape)
+	outputs, err := network.predict(testInputs)
+	if err != nil {
+		return err
+	}
+
+	if *manyToMany {
+		testLabels = padSequences(testLabels, sequenceShape{steps: testShape.steps, features: numberOfClasses}, sequenceShape{steps: shape.steps, features: numberOfClasses})
+		fmt.Println("\nFinal accuracy per step:", calcSequenceAccuracy(outputs, testLabels, numberOfClasses))
+	} else {
+		fmt.Println("\nFinal accuracy:", calcAccuracy(outputs, testLabels))
+		fmt.Println("Final balanced accuracy:", calcBalancedAccuracy(outputs, testLabels))
+	}
+
+	if *modelFile != "" {
+		return network.save(*modelFile)
+	}
+
+	return nil
+}
+
+// padSequences widens sequence rows of shape from to the longer shape to
+func padSequences(x *mat.Dense, from, to sequenceShape) *mat.Dense {
+
+	if from == to {
+		return x
+	}
+
+	numberOfRows, _ := x.Dims()
+	padded := mat.NewDense(numberOfRows, to.size(), nil)
+	for n := 0; n < numberOfRows; n++ {
+		copy(padded.RawRowView(n), x.RawRowView(n))
+	}
+
+	return padded
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	"gonum.org/v1/gonum/mat"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/mem"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// predictionServer answers prediction requests for one trained network
+type predictionServer struct {
+	network  *network      // The loaded model
+	batches  *batcher      // Groups concurrent requests into one predict call
+	metadata modelMetadata // Description of the model
+}
+
+// modelMetadata describes the served model
+type modelMetadata struct {
+	Model   string   `json:"model"`   // File the model was loaded from
+	Inputs  int      `json:"inputs"`  // Number of values in each row
+	Outputs int      `json:"outputs"` // Number of probabilities returned for each row
+	Layers  []string `json:"layers"`  // Description of each layer
+}
+
+// predictRequest is the JSON body of a /predict request
+type predictRequest struct {
+	Rows [][]float64 `json:"rows"`
+}
+
+// predictResponse is the JSON body of a /predict response
+type predictResponse struct {
+	Probabilities [][]float64 `json:"probabilities"`
+}
+
+// serveCommand runs `nn serve`, serving a saved model over HTTP/JSON and gRPC until interrupted
+func serveCommand(args []string) error {
+
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	modelFile := flags.String("model", "", "saved model to serve (.json or .onnx)")
+	httpAddress := flags.String("http", ":8080", "HTTP listen address (\"\" to disable)")
+	grpcAddress := flags.String("grpc", ":9090", "gRPC listen address (\"\" to disable)")
+	maxBatch := flags.Int("max-batch", 256, "most rows to predict in one batch")
+	batchDelay := flags.Duration("batch-delay", 2*time.Millisecond, "longest time to wait for a batch to fill")
+	flags.Parse(args)
+
+	if *modelFile == "" {
+		return errors.New("serve: -model is required")
+	}
+
+	network, err := loadNetwork(*modelFile)
+	if err != nil {
+		return err
+	}
+
+	server := newPredictionServer(network, *modelFile, *maxBatch, *batchDelay)
+	defer server.batches.stop()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if *httpAddress == "" && *grpcAddress == "" {
+		return errors.New("serve: both -http and -grpc are disabled")
+	}
+
+	// Open both listeners before starting either server, so a bad address leaves nothing running
+	var httpListener, grpcListener net.Listener
+	if *httpAddress != "" {
+		if httpListener, err = net.Listen("tcp", *httpAddress); err != nil {
+			return err
+		}
+	}
+	if *grpcAddress != "" {
+		if grpcListener, err = net.Listen("tcp", *grpcAddress); err != nil {
+			if httpListener != nil {
+				httpListener.Close()
+			}
+			return err
+		}
+	}
+
+	errs := make(chan error, 2)
+
+	// HTTP/JSON
+	var httpServer *http.Server
+	if httpListener != nil {
+		httpServer = &http.Server{Handler: server.handler()}
+		go func() {
+			log.Println("serving HTTP on", httpListener.Addr())
+			if err := httpServer.Serve(httpListener); err != nil && err != http.ErrServerClosed {
+				errs <- err
+			}
+		}()
+	}
+
+	// gRPC
+	var grpcServer *grpc.Server
+	if grpcListener != nil {
+		grpcServer = server.grpcServer()
+		go func() {
+			log.Println("serving gRPC on", grpcListener.Addr())
+			if err := grpcServer.Serve(grpcListener); err != nil {
+				errs <- err
+			}
+		}()
+	}
+
+	// Run until interrupted or a server fails
+	select {
+	case <-ctx.Done():
+		err = nil
+	case err = <-errs:
+	}
+
+	if httpServer != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}
+	if grpcServer != nil {
+		grpcServer.GracefulStop()
+	}
+
+	return err
+}
+
+// newPredictionServer creates a server for a loaded network
+func newPredictionServer(network *network, modelFile string, maxBatch int, batchDelay time.Duration) *predictionServer {
+
+	metadata := modelMetadata{Model: modelFile}
+	for _, layer := range network.layers {
+		metadata.Layers = append(metadata.Layers, describeLayer(layer))
+	}
+	metadata.Inputs, metadata.Outputs = network.config.numberOfInputNodes, network.config.numberOfOutputNodes
+
+	return &predictionServer{
+		network:  network,
+		batches:  newBatcher(network, maxBatch, batchDelay),
+		metadata: metadata,
+	}
+}
+
+// predict checks the rows and runs them through the batcher
+func (server *predictionServer) predict(ctx context.Context, rows [][]float64) ([][]float64, error) {
+
+	if len(rows) == 0 {
+		return nil, errors.New("no rows to predict")
+	}
+	for i, row := range rows {
+		if len(row) != server.metadata.Inputs {
+			return nil, fmt.Errorf("row %d has %d values, expected %d", i, len(row), server.metadata.Inputs)
+		}
+	}
+
+	return server.batches.predict(ctx, rows)
+}
+
+// // // // // // // //
+// HTTP/JSON
+
+// handler routes the HTTP endpoints
+func (server *predictionServer) handler() http.Handler {
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST /predict", func(w http.ResponseWriter, r *http.Request) {
+		var request predictRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		probabilities, err := server.predict(r.Context(), request.Rows)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, predictResponse{Probabilities: probabilities})
+	})
+
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+
+	mux.HandleFunc("GET /metadata", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, server.metadata)
+	})
+
+	return mux
+}
+
+// writeJSON writes v as the JSON body of a response
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		log.Println("writing response:", err)
+	}
+}
+
+// // // // // // // //
+// Micro-batching
+
+// batcher collects rows from concurrent requests and predicts them with a single predict call
+type batcher struct {
+	network    *network           // The model, only used by the run goroutine
+	requests   chan *batchRequest // Pending requests
+	maxBatch   int                // Most rows in one predict call
+	batchDelay time.Duration      // Longest wait for more requests once one has arrived
+	done       chan struct{}      // Closed to stop the run goroutine
+}
+
+// batchRequest is one request waiting to be batched
+type batchRequest struct {
+	rows   [][]float64      // Rows to predict
+	result chan batchResult // Receives the outputs for rows
+}
+
+// batchResult is the outcome of a batchRequest
+type batchResult struct {
+	outputs [][]float64
+	err     error
+}
+
+// newBatcher creates a batcher and starts its goroutine
+func newBatcher(network *network, maxBatch int, batchDelay time.Duration) *batcher {
+
+	if maxBatch < 1 {
+		maxBatch = 1
+	}
+
+	b := &batcher{
+		network:    network,
+		requests:   make(chan *batchRequest, maxBatch),
+		maxBatch:   maxBatch,
+		batchDelay: batchDelay,
+		done:       make(chan struct{}),
+	}
+	go b.run()
+
+	return b
+}
+
+// predict queues rows and waits for their outputs
+func (b *batcher) predict(ctx context.Context, rows [][]float64) ([][]float64, error) {
+
+	request := &batchRequest{rows: rows, result: make(chan batchResult, 1)}
+
+	select {
+	case b.requests <- request:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case result := <-request.result:
+		return result.outputs, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// stop ends the run goroutine
+func (b *batcher) stop() {
+	close(b.done)
+}
+
+// run gathers requests into batches until stopped
+func (b *batcher) run() {
+
+	for {
+		// Wait for the first request of a batch
+		var batch []*batchRequest
+		select {
+		case request := <-b.requests:
+			batch = append(batch, request)
+		case <-b.done:
+			return
+		}
+		numberOfRows := len(batch[0].rows)
+
+		// Collect more requests until the batch is full or the delay is up
+		timer := time.NewTimer(b.batchDelay)
+	collect:
+		for numberOfRows < b.maxBatch {
+			select {
+			case request := <-b.requests:
+				batch = append(batch, request)
+				numberOfRows += len(request.rows)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		b.predictBatch(batch, numberOfRows)
+	}
+}
+
+// predictBatch runs every request of a batch through one predict call and hands back each request's rows
+func (b *batcher) predictBatch(batch []*batchRequest, numberOfRows int) {
+
+	// A panic fails the requests still waiting rather than the whole server
+	answered := 0
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println("predicting a batch:", r)
+			for _, request := range batch[answered:] {
+				request.result <- batchResult{err: fmt.Errorf("prediction failed: %v", r)}
+			}
+		}
+	}()
+
+	numberOfInputs := len(batch[0].rows[0])
+	inputs := mat.NewDense(numberOfRows, numberOfInputs, nil)
+
+	row := 0
+	for _, request := range batch {
+		for _, values := range request.rows {
+			inputs.SetRow(row, values)
+			row++
+		}
+	}
+
+	outputs, err := b.network.predict(inputs)
+
+	row = 0
+	for _, request := range batch {
+		if err != nil {
+			request.result <- batchResult{err: err}
+			answered++
+			continue
+		}
+		result := make([][]float64, len(request.rows))
+		for i := range result {
+			result[i] = mat.Row(nil, row, outputs)
+			row++
+		}
+		request.result <- batchResult{outputs: result}
+		answered++
+	}
+}
+
+// // // // // // // //
+// gRPC
+
+// predictorServer is implemented by predictionServer to back the nn.Predictor service in predict.proto
+type predictorServer interface {
+	grpcPredict(ctx context.Context, request *rowsMessage) (*rowsMessage, error)
+	grpcMetadata(ctx context.Context, request *emptyMessage) (*metadataMessage, error)
+}
+
+// predictorServiceDesc describes the nn.Predictor service in predict.proto
+var predictorServiceDesc = grpc.ServiceDesc{
+	ServiceName: "nn.Predictor",
+	HandlerType: (*predictorServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Predict",
+			Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+				request := new(rowsMessage)
+				if err := dec(request); err != nil {
+					return nil, err
+				}
+				handler := func(ctx context.Context, request any) (any, error) {
+					return srv.(predictorServer).grpcPredict(ctx, request.(*rowsMessage))
+				}
+				if interceptor == nil {
+					return handler(ctx, request)
+				}
+				return interceptor(ctx, request, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/nn.Predictor/Predict"}, handler)
+			},
+		},
+		{
+			MethodName: "Metadata",
+			Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+				request := new(emptyMessage)
+				if err := dec(request); err != nil {
+					return nil, err
+				}
+				handler := func(ctx context.Context, request any) (any, error) {
+					return srv.(predictorServer).grpcMetadata(ctx, request.(*emptyMessage))
+				}
+				if interceptor == nil {
+					return handler(ctx, request)
+				}
+				return interceptor(ctx, request, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/nn.Predictor/Metadata"}, handler)
+			},
+		},
+	},
+	Metadata: "predict.proto",
+}
+
+// grpcServer creates a gRPC server with the nn.Predictor and standard health services
+func (server *predictionServer) grpcServer() *grpc.Server {
+
+	grpcServer := grpc.NewServer(grpc.ForceServerCodecV2(protoCodec{fallback: encoding.GetCodecV2("proto")}))
+	grpcServer.RegisterService(&predictorServiceDesc, server)
+
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("nn.Predictor", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+
+	return grpcServer
+}
+
+func (server *predictionServer) grpcPredict(ctx context.Context, request *rowsMessage) (*rowsMessage, error) {
+	probabilities, err := server.predict(ctx, request.rows)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &rowsMessage{rows: probabilities}, nil
+}
+
+func (server *predictionServer) grpcMetadata(context.Context, *emptyMessage) (*metadataMessage, error) {
+	return &metadataMessage{server.metadata}, nil
+}
+
+// protoMessage is a gRPC message that encodes itself in the protobuf wire format
+type protoMessage interface {
+	marshalProto() []byte
+	unmarshalProto(b []byte) error
+}
+
+// protoCodec encodes the hand written messages in this file and hands anything else to fallback
+type protoCodec struct {
+	fallback encoding.CodecV2 // The standard protobuf codec, for the health service
+}
+
+func (codec protoCodec) Marshal(v any) (mem.BufferSlice, error) {
+	if message, ok := v.(protoMessage); ok {
+		return mem.BufferSlice{mem.SliceBuffer(message.marshalProto())}, nil
+	}
+	return codec.fallback.Marshal(v)
+}
+
+func (codec protoCodec) Unmarshal(data mem.BufferSlice, v any) error {
+	if message, ok := v.(protoMessage); ok {
+		return message.unmarshalProto(data.Materialize())
+	}
+	return codec.fallback.Unmarshal(data, v)
+}
+
+func (codec protoCodec) Name() string {
+	return "proto"
+}
+
+// rowsMessage is a PredictRequest or PredictResponse: repeated Row with each Row a repeated double
+type rowsMessage struct {
+	rows [][]float64
+}
+
+func (message *rowsMessage) marshalProto() []byte {
+	var b []byte
+	for _, values := range message.rows {
+		packed := make([]byte, 8*len(values))
+		for i, v := range values {
+			binary.LittleEndian.PutUint64(packed[8*i:], math.Float64bits(v))
+		}
+		b = appendMessage(b, 1, appendMessage(nil, 1, packed))
+	}
+	return b
+}
+
+func (message *rowsMessage) unmarshalProto(b []byte) error {
+
+	rows, err := decodeMessage(b)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		if row.number != 1 || row.wireType != protowire.BytesType {
+			continue
+		}
+		fields, err := decodeMessage(row.bytes)
+		if err != nil {
+			return err
+		}
+		values := []float64{}
+		for _, field := range fields {
+			switch {
+			case field.number != 1:
+			case field.wireType == protowire.BytesType: // Packed
+				for i := 0; i+8 <= len(field.bytes); i += 8 {
+					values = append(values, math.Float64frombits(binary.LittleEndian.Uint64(field.bytes[i:])))
+				}
+			case field.wireType == protowire.Fixed64Type:
+				values = append(values, math.Float64frombits(field.value))
+			}
+		}
+		message.rows = append(message.rows, values)
+	}
+
+	return nil
+}
+
+// emptyMessage is a MetadataRequest
+type emptyMessage struct{}
+
+func (*emptyMessage) marshalProto() []byte          { return nil }
+func (*emptyMessage) unmarshalProto(_ []byte) error { return nil }
+
+// metadataMessage is a MetadataResponse
+type metadataMessage struct {
+	modelMetadata
+}
+
+func (message *metadataMessage) marshalProto() []byte {
+	var b []byte
+	b = appendString(b, 1, message.Model)
+	b = appendVarint(b, 2, uint64(message.Inputs))
+	b = appendVarint(b, 3, uint64(message.Outputs))
+	for _, layer := range message.Layers {
+		b = appendString(b, 4, layer)
+	}
+	return b
+}
+
+func (message *metadataMessage) unmarshalProto(b []byte) error {
+
+	fields, err := decodeMessage(b)
+	if err != nil {
+		return err
+	}
+
+	for _, field := range fields {
+		switch field.number {
+		case 1:
+			message.Model = string(field.bytes)
+		case 2:
+			message.Inputs = int(field.value)
+		case 3:
+			message.Outputs = int(field.value)
+		case 4:
+			message.Layers = append(message.Layers, string(field.bytes))
+		}
+	}
+
+	return nil
+}
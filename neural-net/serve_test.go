@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDecodeNetworkChecksSizes(t *testing.T) {
+
+	r := rand.New(rand.NewSource(1))
+	for name, test := range map[string]struct {
+		layers []layer
+		config networkConf
+		ok     bool
+	}{
+		"matching":        {[]layer{newDenseLayer(3, 4, 0, r), &activationLayer{function: "relu"}, newDenseLayer(4, 2, 0, r)}, networkConf{numberOfInputNodes: 3, numberOfOutputNodes: 2}, true},
+		"no config sizes": {[]layer{newDenseLayer(3, 4, 0, r), newDenseLayer(4, 2, 0, r)}, networkConf{}, true},
+		"layers disagree": {[]layer{newDenseLayer(3, 4, 0, r), &activationLayer{function: "relu"}, newDenseLayer(5, 2, 0, r)}, networkConf{}, false},
+		"too many inputs": {[]layer{newDenseLayer(3, 2, 0, r)}, networkConf{numberOfInputNodes: 4}, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+
+			model, err := (&network{config: test.config, layers: test.layers}).encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			network, err := decodeNetwork(model)
+			if !test.ok {
+				if err == nil {
+					t.Fatal("decoding succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if network.config.numberOfInputNodes != 3 || network.config.numberOfOutputNodes != 2 {
+				t.Errorf("config has %d inputs and %d outputs, want 3 and 2", network.config.numberOfInputNodes, network.config.numberOfOutputNodes)
+			}
+		})
+	}
+}
+
+func TestPredictionServerSurvivesPanics(t *testing.T) {
+
+	// Built by hand, as loading would reject the mismatched layers
+	r := rand.New(rand.NewSource(1))
+	broken := &network{
+		config: networkConf{numberOfInputNodes: 3, numberOfOutputNodes: 2},
+		layers: []layer{newDenseLayer(3, 4, 0, r), newDenseLayer(5, 2, 0, r)},
+	}
+	server := newPredictionServer(broken, "broken.json", 8, time.Millisecond)
+	defer server.batches.stop()
+
+	ctx := context.Background()
+	if _, err := server.predict(ctx, [][]float64{{1, 2}}); err == nil {
+		t.Error("predicting a row of 2 values succeeded, want an error")
+	}
+	for i := 0; i < 2; i++ { // The batcher must still answer after a panic
+		if _, err := server.predict(ctx, [][]float64{{1, 2, 3}}); err == nil {
+			t.Errorf("request %d succeeded, want the panic as an error", i)
+		}
+	}
+}
+
+func TestServeReleasesHTTPWhenGRPCFails(t *testing.T) {
+
+	r := rand.New(rand.NewSource(1))
+	modelFile := filepath.Join(t.TempDir(), "model.json")
+	if err := (&network{layers: []layer{newDenseLayer(3, 2, 0, r)}}).save(modelFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// A free address for HTTP, and one already taken for gRPC
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpAddress := free.Addr().String()
+	free.Close()
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	if err := serveCommand([]string{"-model", modelFile, "-http", httpAddress, "-grpc", taken.Addr().String()}); err == nil {
+		t.Fatal("serving on a taken gRPC address succeeded, want an error")
+	}
+
+	// Nothing is left serving HTTP
+	listener, err := net.Listen("tcp", httpAddress)
+	if err != nil {
+		t.Fatalf("the HTTP address is still in use: %v", err)
+	}
+	listener.Close()
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// shardMagic starts every binary shard file
+const shardMagic = "NNSHARD1"
+
+// rowReader reads rows of inputs and labels from a file one at a time
+type rowReader interface {
+	next() (inputs, labels []float64, err error) // Returns io.EOF after the last row
+	close() error
+}
+
+// csvRowReader reads rows from a CSV file whose last labelColumns columns are labels. A single
+// label column holds a class number, which becomes a one-hot row of classes values if classes is set.
+type csvRowReader struct {
+	f            *os.File
+	reader       *csv.Reader
+	fileName     string
+	line         int
+	labelColumns int
+	classes      int
+}
+
+// shardRowReader reads rows from a binary shard file: shardMagic, the number of inputs and labels
+// as little endian uint32s, and then each row's inputs and labels as little endian float64s
+type shardRowReader struct {
+	f        *os.File
+	reader   *bufio.Reader
+	fileName string
+	width    int
+	outputs  int
+	row      []byte
+}
+
+// streamConfig describes a dataset read in batches from CSV or shard files
+type streamConfig struct {
+	files         []string  // CSV files, or shard files ending in .shard
+	labelColumns  int       // Label columns of CSV files (0 for unlabeled rows, whose batches have nil labels)
+	classes       int       // Classes of CSV files with a single label column
+	width         int       // Inputs in every row, checked if set
+	outputs       int       // Labels in every row, checked if set
+	batchSize     int       // Rows per batch
+	shuffleBuffer int       // Rows held back to shuffle them (0 or 1 to keep the file order)
+	prefetch      int       // Batches prepared ahead of training
+	readers       int       // Files read at once, more than 1 makes the row order vary between runs
+	rates         []float64 // Times each class's rows are used on average when shuffling (nil for once)
+}
+
+// batchStream yields the batches of one pass over a dataset, prepared by background goroutines
+type batchStream struct {
+	batches chan streamBatch
+	stop    chan struct{}
+	done    sync.WaitGroup
+	errOnce sync.Once
+	err     error
+}
+
+// streamBatch is one batch of rows
+type streamBatch struct {
+	inputs *mat.Dense
+	labels *mat.Dense
+}
+
+// streamRow is one row passed from the readers to the batcher
+type streamRow struct {
+	inputs []float64
+	labels []float64
+}
+
+// openRows opens a shard file if its name ends in .shard and a CSV file otherwise
+func openRows(fileName string, labelColumns, classes int) (rowReader, error) {
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	if filepath.Ext(fileName) != ".shard" {
+		reader := csv.NewReader(bufio.NewReader(f))
+		reader.ReuseRecord = true
+		return &csvRowReader{f: f, reader: reader, fileName: fileName, labelColumns: labelColumns, classes: classes}, nil
+	}
+
+	reader := bufio.NewReader(f)
+	header := make([]byte, len(shardMagic)+8)
+	if _, err := io.ReadFull(reader, header); err != nil || string(header[:len(shardMagic)]) != shardMagic {
+		f.Close()
+		return nil, fmt.Errorf("%s isn't a shard file", fileName)
+	}
+	width := int(binary.LittleEndian.Uint32(header[len(shardMagic):]))
+	outputs := int(binary.LittleEndian.Uint32(header[len(shardMagic)+4:]))
+
+	return &shardRowReader{f: f, reader: reader, fileName: fileName, width: width, outputs: outputs, row: make([]byte, 8*(width+outputs))}, nil
+}
+
+// next parses the next record
+func (rows *csvRowReader) next() ([]float64, []float64, error) {
+
+	record, err := rows.reader.Read()
+	if err != nil {
+		if err != io.EOF {
+			err = fmt.Errorf("%s: %v", rows.fileName, err)
+		}
+		return nil, nil, err
+	}
+	rows.line++
+
+	width := len(record) - rows.labelColumns
+	if width < 1 {
+		return nil, nil, fmt.Errorf("%s line %d: %d columns can't hold %d labels", rows.fileName, rows.line, len(record), rows.labelColumns)
+	}
+
+	values := make([]float64, len(record))
+	for j, val := range record {
+		if values[j], err = strconv.ParseFloat(strings.TrimSpace(val), 64); err != nil {
+			return nil, nil, fmt.Errorf("%s line %d: %v", rows.fileName, rows.line, err)
+		}
+	}
+
+	if rows.labelColumns != 1 || rows.classes == 0 {
+		return values[:width], values[width:], nil
+	}
+
+	class := int(values[width])
+	if class < 0 || class >= rows.classes || float64(class) != values[width] {
+		return nil, nil, fmt.Errorf("%s line %d: class %v isn't one of the %d classes", rows.fileName, rows.line, values[width], rows.classes)
+	}
+	labels := make([]float64, rows.classes)
+	labels[class] = 1
+
+	return values[:width], labels, nil
+}
+
+// close closes the file
+func (rows *csvRowReader) close() error {
+	return rows.f.Close()
+}
+
+// next decodes the next row
+func (rows *shardRowReader) next() ([]float64, []float64, error) {
+
+	if _, err := io.ReadFull(rows.reader, rows.row); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("%s ends part way through a row", rows.fileName)
+		}
+		return nil, nil, err
+	}
+
+	values := make([]float64, rows.width+rows.outputs)
+	for j := range values {
+		values[j] = math.Float64frombits(binary.LittleEndian.Uint64(rows.row[8*j:]))
+	}
+
+	return values[:rows.width], values[rows.width:], nil
+}
+
+// close closes the file
+func (rows *shardRowReader) close() error {
+	return rows.f.Close()
+}
+
+// shape reads the first row of the first file to find the number of inputs and outputs of every row
+func (config streamConfig) shape() (width, outputs int, err error) {
+
+	if len(config.files) == 0 {
+		return 0, 0, errors.New("no data files")
+	}
+
+	rows, err := openRows(config.files[0], config.labelColumns, config.classes)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.close()
+
+	inputs, labels, err := rows.next()
+	if err == io.EOF {
+		return 0, 0, fmt.Errorf("%s is empty", config.files[0])
+	}
+
+	return len(inputs), len(labels), err
+}
+
+// open starts reading one pass over the dataset. If r is set the file order is shuffled and the
+// rows go through a shuffle buffer; r must not be used elsewhere until the stream is closed.
+func (config streamConfig) open(r *rand.Rand) *batchStream {
+
+	stream := &batchStream{
+		batches: make(chan streamBatch, max(1, config.prefetch)),
+		stop:    make(chan struct{}),
+	}
+
+	files := make(chan string, len(config.files))
+	if r != nil {
+		for _, i := range r.Perm(len(config.files)) {
+			files <- config.files[i]
+		}
+	} else {
+		for _, fileName := range config.files {
+			files <- fileName
+		}
+	}
+	close(files)
+
+	// Readers parse whole files, passing their rows on to the batcher
+	rows := make(chan streamRow, 4*max(1, config.batchSize))
+	var readers sync.WaitGroup
+	for i := 0; i < max(1, config.readers); i++ {
+		readers.Add(1)
+		stream.done.Add(1)
+		go func() {
+			defer stream.done.Done()
+			defer readers.Done()
+			for fileName := range files {
+				if !stream.readFile(fileName, config, rows) {
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		readers.Wait()
+		close(rows)
+	}()
+
+	stream.done.Add(1)
+	go stream.batch(config, rows, r)
+
+	return stream
+}
+
+// readFile sends every row of a file to rows, returning false if the stream failed or was stopped
+func (stream *batchStream) readFile(fileName string, config streamConfig, rows chan<- streamRow) bool {
+
+	reader, err := openRows(fileName, config.labelColumns, config.classes)
+	if err != nil {
+		stream.fail(err)
+		return false
+	}
+	defer reader.close()
+
+	for {
+		inputs, labels, err := reader.next()
+		if err == io.EOF {
+			return true
+		}
+		if err == nil && config.width > 0 && (len(inputs) != config.width || len(labels) != config.outputs) {
+			err = fmt.Errorf("%s has rows of %d inputs and %d labels, expected %d and %d", fileName, len(inputs), len(labels), config.width, config.outputs)
+		}
+		if err != nil {
+			stream.fail(err)
+			return false
+		}
+
+		select {
+		case rows <- streamRow{inputs: inputs, labels: labels}:
+		case <-stream.stop:
+			return false
+		}
+	}
+}
+
+// batch gathers rows into batches, sampling them by class and shuffling them through a buffer if r is set
+func (stream *batchStream) batch(config streamConfig, rows <-chan streamRow, r *rand.Rand) {
+
+	defer stream.done.Done()
+	defer close(stream.batches)
+
+	// send passes the pending rows on as a batch, returning false if the stream was stopped
+	var pending []streamRow
+	send := func() bool {
+		batch := streamBatch{inputs: mat.NewDense(len(pending), len(pending[0].inputs), nil)}
+		if len(pending[0].labels) > 0 { // Unlabeled rows give nil labels
+			batch.labels = mat.NewDense(len(pending), len(pending[0].labels), nil)
+		}
+		for i, row := range pending {
+			batch.inputs.SetRow(i, row.inputs)
+			if batch.labels != nil {
+				batch.labels.SetRow(i, row.labels)
+			}
+		}
+		pending = pending[:0]
+
+		select {
+		case stream.batches <- batch:
+			return true
+		case <-stream.stop:
+			return false
+		}
+	}
+	emit := func(row streamRow) bool {
+		pending = append(pending, row)
+		return len(pending) < config.batchSize || send()
+	}
+
+	// A full buffer sends a random row on for each row that comes in
+	var buffer []streamRow
+	shuffle := r != nil && config.shuffleBuffer > 1
+	take := func(row streamRow) bool {
+		if !shuffle {
+			return emit(row)
+		}
+		if len(buffer) < config.shuffleBuffer {
+			buffer = append(buffer, row)
+			return true
+		}
+		i := r.Intn(len(buffer))
+		if !emit(buffer[i]) {
+			return false
+		}
+		buffer[i] = row
+		return true
+	}
+
+	for {
+		var row streamRow
+		var ok bool
+		select {
+		case row, ok = <-rows:
+		case <-stream.stop:
+			return
+		}
+		if !ok {
+			break
+		}
+
+		n := 1
+		if r != nil && config.rates != nil {
+			n = repeats(config.rates[labelClass(row.labels)], r)
+		}
+		for ; n > 0; n-- {
+			if !take(row) {
+				return
+			}
+		}
+	}
+
+	// Send on the buffered rows in a random order and then the last partial batch
+	if shuffle {
+		r.Shuffle(len(buffer), func(i, j int) { buffer[i], buffer[j] = buffer[j], buffer[i] })
+	}
+	for _, row := range buffer {
+		if !emit(row) {
+			return
+		}
+	}
+	if len(pending) > 0 {
+		send()
+	}
+}
+
+// fail records the first error and stops the stream
+func (stream *batchStream) fail(err error) {
+	stream.errOnce.Do(func() {
+		stream.err = err
+		close(stream.stop)
+	})
+}
+
+// next returns the next batch, or false after the last one
+func (stream *batchStream) next() (*mat.Dense, *mat.Dense, bool) {
+	batch, ok := <-stream.batches
+	return batch.inputs, batch.labels, ok
+}
+
+// close stops the stream and returns the first error it had
+func (stream *batchStream) close() error {
+	stream.errOnce.Do(func() { close(stream.stop) })
+	stream.done.Wait()
+	return stream.err
+}
+
+// propagateStream trains like propagate, but reads each epoch's batches from a stream
+func (network *network) propagateStream(config streamConfig) error {
+
+	if err := network.checkLoss(); err != nil {
+		return err
+	}
+	if config.batchSize < 1 {
+		return errors.New("streamed batches need at least 1 row")
+	}
+	if network.config.classWeights != nil && len(network.config.classWeights) != config.outputs {
+		return fmt.Errorf("%d class weights for %d classes", len(network.config.classWeights), config.outputs)
+	}
+
+	// Samplers need the class counts, which take a pass over the files if they weren't given
+	if config.rates == nil && network.config.sampler != "" && network.config.sampler != "none" {
+		counts, err := config.classCounts()
+		if err != nil {
+			return err
+		}
+		if config.rates, err = samplingRates(counts, network.config.sampler); err != nil {
+			return err
+		}
+	}
+	r := network.shuffle
+	if config.rates != nil && r == nil {
+		r = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	for i := network.epoch; i < network.config.numberOfEpochs; i++ {
+
+		stream := config.open(r)
+		squaredError, values := 0.0, 0
+		for {
+			inputs, labels, ok := stream.next()
+			if !ok {
+				break
+			}
+			squaredError += network.step(inputs, labels, nil)
+			rows, cols := labels.Dims()
+			values += rows * cols
+		}
+		if err := stream.close(); err != nil {
+			return err
+		}
+		if values == 0 {
+			return errors.New("the data files have no rows")
+		}
+
+		network.epoch = i + 1
+		meanSquaredError := squaredError / float64(values)
+		if !network.quiet {
+			fmt.Printf("Epoch %d: mean squared error %.6f\n", i+1, meanSquaredError)
+		}
+
+		if network.afterEpoch != nil {
+			if err := network.afterEpoch(meanSquaredError); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// evaluateStream returns the mean squared error, accuracy and balanced accuracy of the network's predictions for a dataset
+func (network *network) evaluateStream(config streamConfig) (float64, float64, float64, error) {
+
+	stream := config.open(nil)
+	squaredError, values, hits, numberOfRows := 0.0, 0, 0.0, 0
+	var classHitTotals, classTotals []float64
+	for {
+		inputs, labels, ok := stream.next()
+		if !ok {
+			break
+		}
+		outputs, err := network.predict(inputs)
+		if err != nil {
+			stream.close()
+			return 0, 0, 0, err
+		}
+
+		difference := new(mat.Dense)
+		difference.Sub(labels, outputs)
+		squaredError += floats.Dot(difference.RawMatrix().Data, difference.RawMatrix().Data)
+		rows, cols := labels.Dims()
+		values += rows * cols
+		hits += calcAccuracy(outputs, labels) * float64(rows)
+		numberOfRows += rows
+
+		batchHits, batchTotals := classHits(outputs, labels)
+		if classTotals == nil {
+			classHitTotals, classTotals = make([]float64, cols), make([]float64, cols)
+		}
+		floats.Add(classHitTotals, batchHits)
+		floats.Add(classTotals, batchTotals)
+	}
+	if err := stream.close(); err != nil {
+		return 0, 0, 0, err
+	}
+	if numberOfRows == 0 {
+		return 0, 0, 0, errors.New("the data files have no rows")
+	}
+
+	return squaredError / float64(values), hits / float64(numberOfRows), balancedAccuracy(classHitTotals, classTotals), nil
+}
+
+// classCounts reads the dataset once to count the rows of each class
+func (config streamConfig) classCounts() ([]float64, error) {
+
+	var counts []float64
+	stream := config.open(nil)
+	for {
+		_, labels, ok := stream.next()
+		if !ok {
+			break
+		}
+		batchCounts := classCounts(labels)
+		if counts == nil {
+			counts = make([]float64, len(batchCounts))
+		}
+		floats.Add(counts, batchCounts)
+	}
+
+	return counts, stream.close()
+}
+
+// dataFiles expands a comma separated list of file names and glob patterns
+func dataFiles(list string) ([]string, error) {
+
+	var files []string
+	for _, pattern := range strings.Split(list, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match %s", pattern)
+		}
+		files = append(files, matches...)
+	}
+
+	return files, nil
+}
+
+// shardCommand converts CSV files to binary shard files, which are faster to stream
+func shardCommand(args []string) error {
+
+	flags := flag.NewFlagSet("shard", flag.ExitOnError)
+	data := flags.String("data", "trainingData.csv", "comma separated CSV files or patterns, with the labels in the last columns")
+	labelColumns := flags.Int("labels", 3, "number of label columns, 1 for a single column holding a class number, 0 for unlabeled rows")
+	classes := flags.Int("classes", 0, "number of classes when -labels is 1")
+	rowsPerShard := flags.Int("rows", 100000, "rows in each shard file")
+	out := flags.String("out", "shards", "directory to write the shard files to")
+	flags.Parse(args)
+
+	if *rowsPerShard < 1 {
+		return errors.New("-rows must be at least 1")
+	}
+
+	files, err := dataFiles(*data)
+	if err != nil {
+		return err
+	}
+	if *labelColumns == 1 && *classes < 1 {
+		return errors.New("-classes is needed when -labels is 1")
+	}
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		return err
+	}
+
+	var f *os.File
+	var writer *bufio.Writer
+	rows, shards, width, outputs := 0, 0, 0, 0
+	finish := func() error {
+		if f == nil {
+			return nil
+		}
+		if err := writer.Flush(); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+
+	row := make([]byte, 0, 64)
+	for _, fileName := range files {
+		reader, err := openRows(fileName, *labelColumns, *classes)
+		if err != nil {
+			return err
+		}
+
+		for {
+			inputs, labels, err := reader.next()
+			if err == io.EOF {
+				break
+			}
+			if err == nil && rows > 0 && (len(inputs) != width || len(labels) != outputs) {
+				err = fmt.Errorf("%s has rows of %d inputs and %d labels, expected %d and %d", fileName, len(inputs), len(labels), width, outputs)
+			}
+			if err != nil {
+				reader.close()
+				finish()
+				return err
+			}
+			width, outputs = len(inputs), len(labels)
+
+			// Start a new shard when the last one is full
+			if f == nil || rows%*rowsPerShard == 0 {
+				if err := finish(); err != nil {
+					reader.close()
+					return err
+				}
+				if f, err = os.Create(filepath.Join(*out, fmt.Sprintf("shard-%05d.shard", shards))); err != nil {
+					reader.close()
+					return err
+				}
+				shards++
+				writer = bufio.NewWriter(f)
+				header := binary.LittleEndian.AppendUint32([]byte(shardMagic), uint32(len(inputs)))
+				writer.Write(binary.LittleEndian.AppendUint32(header, uint32(len(labels))))
+			}
+
+			row = row[:0]
+			for _, v := range append(inputs, labels...) {
+				row = binary.LittleEndian.AppendUint64(row, math.Float64bits(v))
+			}
+			writer.Write(row)
+			rows++
+		}
+		reader.close()
+	}
+
+	if err := finish(); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d rows to %d shards in %s\n", rows, shards, *out)
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShardRoundTrip(t *testing.T) {
+
+	// Rows numbered by their first input, over 2 CSV files
+	const numberOfRows = 50
+	dir := t.TempDir()
+	var csvFiles []string
+	for file, rows := range [][2]int{{0, 30}, {30, numberOfRows}} {
+		var lines strings.Builder
+		for i := rows[0]; i < rows[1]; i++ {
+			fmt.Fprintf(&lines, "%d,%g,%d,%d\n", i, float64(i)/3, i%2, 1-i%2)
+		}
+		fileName := filepath.Join(dir, fmt.Sprintf("rows-%d.csv", file))
+		if err := os.WriteFile(fileName, []byte(lines.String()), 0644); err != nil {
+			t.Fatal(err)
+		}
+		csvFiles = append(csvFiles, fileName)
+	}
+
+	// 7 rows per shard leaves a partial last shard
+	out := filepath.Join(dir, "shards")
+	if err := shardCommand([]string{"-data", strings.Join(csvFiles, ","), "-labels", "2", "-rows", "7", "-out", out}); err != nil {
+		t.Fatal(err)
+	}
+	files, err := dataFiles(filepath.Join(out, "*.shard"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 8 {
+		t.Fatalf("wrote %d shards, want 8", len(files))
+	}
+
+	for _, test := range []struct {
+		name          string
+		shuffle       bool
+		shuffleBuffer int
+		readers       int
+	}{
+		{"in order", false, 0, 1},
+		{"shuffled", true, 16, 1},
+		{"shuffled with 3 readers", true, 16, 3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+
+			config := streamConfig{files: files, width: 2, outputs: 2, batchSize: 4, shuffleBuffer: test.shuffleBuffer, prefetch: 2, readers: test.readers}
+			var r *rand.Rand
+			if test.shuffle {
+				r = rand.New(rand.NewSource(1))
+			}
+
+			stream := config.open(r)
+			seen := make([]int, numberOfRows)
+			var order []int
+			for {
+				inputs, labels, ok := stream.next()
+				if !ok {
+					break
+				}
+				rows, _ := inputs.Dims()
+				for n := 0; n < rows; n++ {
+					i := int(inputs.At(n, 0))
+					if i < 0 || i >= numberOfRows || inputs.At(n, 1) != float64(i)/3 || labels.At(n, 0) != float64(i%2) || labels.At(n, 1) != float64(1-i%2) {
+						t.Fatalf("row %v, %v doesn't match any written row", inputs.RawRowView(n), labels.RawRowView(n))
+					}
+					seen[i]++
+					order = append(order, i)
+				}
+			}
+			if err := stream.close(); err != nil {
+				t.Fatal(err)
+			}
+
+			for i, count := range seen {
+				if count != 1 {
+					t.Errorf("row %d was read %d times", i, count)
+				}
+			}
+			inOrder := true
+			for n, i := range order {
+				inOrder = inOrder && i == n
+			}
+			if inOrder != !test.shuffle {
+				t.Errorf("rows came in the order %v", order)
+			}
+		})
+	}
+}
+
+func TestShardRowsMustBePositive(t *testing.T) {
+
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "rows.csv")
+	if err := os.WriteFile(fileName, []byte("1,2,1,0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rows := range []string{"0", "-1"} {
+		if err := shardCommand([]string{"-data", fileName, "-labels", "2", "-rows", rows, "-out", filepath.Join(dir, "shards")}); err == nil {
+			t.Errorf("-rows %s was accepted", rows)
+		}
+	}
+}